@@ -8,6 +8,7 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -45,10 +46,31 @@ func main() {
 	mux.Handle("/balance/", service.BalanceHandler())
 	mux.Handle("/list", service.ListTransactionsHandler())
 	mux.Handle("/top-up", service.TopUpHandler())
+	mux.Handle("/top-up/settle", service.SettleTopUpHandler())
+	mux.Handle("/top-up/fail", service.FailTopUpHandler())
+	mux.Handle("/bonus", service.GrantBonusHandler())
 	mux.Handle("/reserve", service.ReserveHandler())
+	mux.Handle("/reserve/adjust", service.AdjustReservationHandler())
 	mux.Handle("/commit", service.CommitHandler())
 	mux.Handle("/cancel", service.CancelHandler())
+	mux.Handle("/transfer", service.TransferHandler())
+	mux.Handle("/refund", service.RefundHandler())
+	mux.Handle("/withdraw", service.WithdrawHandler())
+	mux.Handle("/reverse", service.ReverseHandler())
+	mux.Handle("/batch", service.BatchHandler())
 	mux.Handle("/statistics/", service.StatisticsCsvHandler())
+	mux.Handle("/credit-limit", service.SetCreditLimitHandler())
+	mux.Handle("/credit-limit/", service.CreditLimitHandler())
+	mux.Handle("/account-status", service.SetAccountStatusHandler())
+	mux.Handle("/account-status/", service.AccountStatusHandler())
+	mux.Handle("/overdrafts", service.OverdraftsHandler())
+	mux.Handle("/currencies", service.CurrenciesHandler())
+	mux.Handle("/convert", service.ConvertHandler())
+	mux.Handle("/subscription", service.CreateSubscriptionHandler())
+	mux.Handle("/subscription/pause", service.PauseSubscriptionHandler())
+	mux.Handle("/subscription/resume", service.ResumeSubscriptionHandler())
+	mux.Handle("/subscription/cancel", service.CancelSubscriptionHandler())
+	mux.Handle("/subscriptions/", service.ListSubscriptionsHandler())
 	mux.Handle("/swagger/", http.StripPrefix("/swagger/", http.FileServer(assets.SwaggerUI())))
 	mux.Handle("/openapi.yaml", http.FileServer(http.FS(assets.OpenapiYML)))
 
@@ -59,11 +81,39 @@ func main() {
 		}
 	}()
 
+	expiryInterval, err := time.ParseDuration(os.Getenv("RESERVATION_EXPIRY_INTERVAL"))
+	if err != nil || expiryInterval <= 0 {
+		expiryInterval = time.Minute
+	}
+	expiryDone := utils.RunPeriodically(expiryInterval, service.ExpireReservations)
+
+	subscriptionsInterval, err := time.ParseDuration(os.Getenv("SUBSCRIPTION_CHARGE_INTERVAL"))
+	if err != nil || subscriptionsInterval <= 0 {
+		subscriptionsInterval = time.Minute
+	}
+	subscriptionsDone := utils.RunPeriodically(subscriptionsInterval, service.ChargeSubscriptions)
+
+	bonusExpiryInterval, err := time.ParseDuration(os.Getenv("BONUS_EXPIRY_INTERVAL"))
+	if err != nil || bonusExpiryInterval <= 0 {
+		bonusExpiryInterval = time.Minute
+	}
+	bonusExpiryDone := utils.RunPeriodically(bonusExpiryInterval, service.ExpireBonuses)
+
+	ratesInterval, err := time.ParseDuration(os.Getenv("EXCHANGE_RATES_REFRESH_INTERVAL"))
+	if err != nil || ratesInterval <= 0 {
+		ratesInterval = time.Hour
+	}
+	ratesDone := utils.RunPeriodically(ratesInterval, service.RefreshRates)
+
 	utils.WaitForShutdownSignal()
 	err = server.Shutdown(context.Background())
 	if err != nil {
 		logger.Panic("server shutdown", zap.Error(err))
 	}
+	<-expiryDone
+	<-subscriptionsDone
+	<-bonusExpiryDone
+	<-ratesDone
 }
 
 type BalanceWebService struct {
@@ -139,9 +189,7 @@ func (s *BalanceWebService) ListTransactionsHandler() http.Handler {
 		var output proto.ListTransactionsOutput
 
 		// return current balance data
-		output.UserBalance = &proto.UserBalanceData{UserId: userID}
-		var available, reserved decimal.Decimal
-		output.UserBalance.Currency, available, reserved, err = s.db.FetchUserBalance(r.Context(), userID)
+		wallets, err := s.db.FetchUserBalance(r.Context(), userID)
 		if err != nil {
 			protoErr, ok := err.(*proto.Error)
 			if !ok {
@@ -151,11 +199,8 @@ func (s *BalanceWebService) ListTransactionsHandler() http.Handler {
 			}
 			logger.Info("fetch balance failed", zap.Error(err))
 			output.Error = protoErr
-			output.UserBalance = nil
 		} else {
-			output.UserBalance.Value = available.StringFixedBank(2)
-			output.UserBalance.ReservedValue = reserved.StringFixedBank(2)
-			output.UserBalance.IsOverdraft = available.LessThan(decimal.Zero)
+			output.UserBalance = userBalanceData(userID, wallets)
 		}
 
 		// return list of transactions
@@ -174,15 +219,24 @@ func (s *BalanceWebService) ListTransactionsHandler() http.Handler {
 			return
 		}
 		for _, item := range items {
-			output.Transactions = append(output.Transactions, &proto.UserTransaction{
-				Currency:           item.Currency,
-				Value:              item.Value.StringFixedBank(2),
-				UserCurrencyValue:  item.UserCurrencyValue.StringFixed(2),
+			next := &proto.UserTransaction{
+				Currency:           item.Value.Currency,
+				Value:              item.Value.String(),
+				UserCurrency:       item.UserCurrencyValue.Currency,
+				UserCurrencyValue:  item.UserCurrencyValue.String(),
 				IsTopUpTransaction: item.IsTopUpTransaction,
 				OrderId:            item.OrderID,
 				ItemId:             item.ItemID,
+				Kind:               transactionKind(item),
+				CounterpartyUserId: item.CounterpartyUserID,
+				BonusValue:         item.BonusValue.String(),
+				Status:             transactionStatus(item.Status),
 				CreatedAt:          &timestamppb.Timestamp{Seconds: item.CreatedAt.Unix()},
-			})
+			}
+			if next.Kind == proto.TransactionKind_TRANSACTION_KIND_SALE {
+				next.Commission = item.Commission.String()
+			}
+			output.Transactions = append(output.Transactions, next)
 		}
 		if nextBefore != 0 {
 			output.NextCursor = utils.MarshalCursor(&cursorForListTransactions{
@@ -200,6 +254,52 @@ func (s *BalanceWebService) ListTransactionsHandler() http.Handler {
 	return s.applyMiddlewares(handler, http.MethodPost)
 }
 
+func transactionKind(item database.UserTransactionItem) proto.TransactionKind {
+	switch item.Kind {
+	case database.TransactionKindTopUp:
+		return proto.TransactionKind_TRANSACTION_KIND_TOP_UP
+	case database.TransactionKindCharge:
+		if item.IsTopUpTransaction {
+			return proto.TransactionKind_TRANSACTION_KIND_SALE
+		}
+		return proto.TransactionKind_TRANSACTION_KIND_CHARGE
+	case database.TransactionKindTransfer:
+		if item.IsTopUpTransaction {
+			return proto.TransactionKind_TRANSACTION_KIND_TRANSFER_IN
+		}
+		return proto.TransactionKind_TRANSACTION_KIND_TRANSFER_OUT
+	case database.TransactionKindRefund:
+		return proto.TransactionKind_TRANSACTION_KIND_REFUND
+	case database.TransactionKindWithdrawal:
+		return proto.TransactionKind_TRANSACTION_KIND_WITHDRAWAL
+	case database.TransactionKindBonus:
+		return proto.TransactionKind_TRANSACTION_KIND_BONUS
+	case database.TransactionKindBonusExpiry:
+		return proto.TransactionKind_TRANSACTION_KIND_BONUS_EXPIRY
+	case database.TransactionKindReversal:
+		return proto.TransactionKind_TRANSACTION_KIND_REVERSAL
+	case database.TransactionKindRepayment:
+		return proto.TransactionKind_TRANSACTION_KIND_DEBT_REPAYMENT
+	default:
+		return proto.TransactionKind_TRANSACTION_KIND_UNSPECIFIED
+	}
+}
+
+func transactionStatus(status string) proto.TransactionStatus {
+	switch status {
+	case database.TransactionStatusPending:
+		return proto.TransactionStatus_TRANSACTION_STATUS_PENDING
+	case database.TransactionStatusCompleted:
+		return proto.TransactionStatus_TRANSACTION_STATUS_COMPLETED
+	case database.TransactionStatusFailed:
+		return proto.TransactionStatus_TRANSACTION_STATUS_FAILED
+	case database.TransactionStatusReversed:
+		return proto.TransactionStatus_TRANSACTION_STATUS_REVERSED
+	default:
+		return proto.TransactionStatus_TRANSACTION_STATUS_UNSPECIFIED
+	}
+}
+
 func (s *BalanceWebService) TopUpHandler() http.Handler {
 	var handler http.Handler
 
@@ -214,10 +314,14 @@ func (s *BalanceWebService) TopUpHandler() http.Handler {
 			return
 		}
 
-		// top-up balance
+		// top-up balance, pending funds are only shown until settled
+		topUp := s.db.TopUp
+		if input.Pending {
+			topUp = s.db.TopUpPending
+		}
 		var output proto.GenericOutput
 		var txID snowflake.ID
-		txID, err = s.db.TopUp(r.Context(), input.IdempotencyKey, input.UserId, input.Currency, input.Value, input.MerchantData)
+		txID, err = topUp(r.Context(), input.IdempotencyKey, input.UserId, input.Currency, input.Value, input.MerchantData)
 		if err != nil {
 			protoErr, ok := err.(*proto.Error)
 			if ok {
@@ -231,7 +335,97 @@ func (s *BalanceWebService) TopUpHandler() http.Handler {
 			return
 		}
 
-		logger.Info("new transaction (top-up)", zap.Int64("txID", txID.Int64()))
+		logger.Info("new transaction (top-up)", zap.Int64("txID", txID.Int64()), zap.Bool("pending", input.Pending))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) SettleTopUpHandler() http.Handler {
+	return s.topUpSettlementHandler("settle", s.db.SettleTopUp)
+}
+
+func (s *BalanceWebService) FailTopUpHandler() http.Handler {
+	return s.topUpSettlementHandler("fail", s.db.FailTopUp)
+}
+
+// topUpSettlementHandler moves pending top-up into its final status
+func (s *BalanceWebService) topUpSettlementHandler(action string, finish func(ctx context.Context, userID, idempotencyKey string) error) http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.TopUpSettlementInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var output proto.GenericOutput
+		err = finish(r.Context(), input.UserId, input.IdempotencyKey)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info(action+" top-up failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error(action+" top-up error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("pending top-up finished", zap.String("action", action), zap.String("idempotencyKey", input.IdempotencyKey))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) GrantBonusHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.GrantBonusInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var expiresAt time.Time
+		if input.ExpiresAt != nil {
+			expiresAt = time.Unix(input.ExpiresAt.Seconds, int64(input.ExpiresAt.Nanos))
+		}
+
+		// credit bonus part of user balance
+		var output proto.GenericOutput
+		var txID snowflake.ID
+		txID, err = s.db.GrantBonus(r.Context(), input.IdempotencyKey, input.UserId, input.Currency, input.Value, input.MerchantData, expiresAt)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("grant bonus failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("grant bonus error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("new transaction (bonus)", zap.Int64("txID", txID.Int64()))
 
 		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
 	})
@@ -253,9 +447,14 @@ func (s *BalanceWebService) ReserveHandler() http.Handler {
 			return
 		}
 
+		var expiresAt time.Time
+		if input.ExpiresAt != nil {
+			expiresAt = time.Unix(input.ExpiresAt.Seconds, int64(input.ExpiresAt.Nanos))
+		}
+
 		// add reservation
 		var output proto.GenericOutput
-		err = s.db.Reserve(r.Context(), input.UserId, input.Currency, input.Value, input.OrderId, input.ItemId)
+		err = s.db.Reserve(r.Context(), input.UserId, input.Currency, input.Value, input.OrderId, input.ItemId, expiresAt)
 		if err != nil {
 			protoErr, ok := err.(*proto.Error)
 			if ok {
@@ -277,6 +476,44 @@ func (s *BalanceWebService) ReserveHandler() http.Handler {
 	return s.applyMiddlewares(handler, http.MethodPost)
 }
 
+func (s *BalanceWebService) AdjustReservationHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.AdjustReservationInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// raise or lower reserved value
+		var output proto.GenericOutput
+		err = s.db.AdjustReservation(r.Context(), input.UserId, input.Currency, input.Value, input.OrderId, input.ItemId)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("reservation adjustment failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("reservation adjustment error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("reservation adjusted", zap.String("orderID", input.OrderId), zap.String("userID", input.UserId), zap.String("value", input.Value))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
 func (s *BalanceWebService) CommitHandler() http.Handler {
 	var handler http.Handler
 
@@ -294,7 +531,11 @@ func (s *BalanceWebService) CommitHandler() http.Handler {
 		// charge from balance
 		var output proto.GenericOutput
 		var txID snowflake.ID
-		txID, err = s.db.CommitReservation(r.Context(), input.UserId, input.Currency, input.Value, input.OrderId, input.ItemId)
+		if input.SellerId == "" {
+			txID, err = s.db.CommitReservation(r.Context(), input.IdempotencyKey, input.UserId, input.Currency, input.Value, input.OrderId, input.ItemId, input.KeepRemainder)
+		} else {
+			txID, err = s.db.CommitSale(r.Context(), input.IdempotencyKey, input.UserId, input.SellerId, input.Currency, input.Value, input.OrderId, input.ItemId, input.KeepRemainder, commission(input.Commission))
+		}
 		if err != nil {
 			protoErr, ok := err.(*proto.Error)
 			if ok {
@@ -316,6 +557,13 @@ func (s *BalanceWebService) CommitHandler() http.Handler {
 	return s.applyMiddlewares(handler, http.MethodPost)
 }
 
+func commission(input *proto.Commission) database.Commission {
+	return database.Commission{
+		Percent: input.GetPercent(),
+		Fixed:   input.GetFixed(),
+	}
+}
+
 func (s *BalanceWebService) CancelHandler() http.Handler {
 	var handler http.Handler
 
@@ -354,114 +602,965 @@ func (s *BalanceWebService) CancelHandler() http.Handler {
 	return s.applyMiddlewares(handler, http.MethodPost)
 }
 
-const (
-	errStatisticsBadParameters     = "bad parameters, use YYYY-MM"
-	errStatisticsBadParameterYear  = `bad parameter "year", use YYYY-MM`
-	errStatisticsBadParameterMonth = `bad parameter "month", use YYYY-MM`
-)
-
-func (s *BalanceWebService) StatisticsCsvHandler() http.Handler {
+func (s *BalanceWebService) TransferHandler() http.Handler {
 	var handler http.Handler
 
 	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		logger := utils.GetRequestLogger(r)
 
-		key := r.RequestURI[12:]
-		if len(key) != 7 || key[4] != '/' {
-			logger.Info(errStatisticsBadParameters, zap.String("key", key))
-			w.Header().Set(utils.HeaderContentType, "text/plain")
+		input := proto.TransferInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
 			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte(errStatisticsBadParameters))
 			return
 		}
-		year, err := strconv.Atoi(key[0:4])
-		if err != nil || year < 2022 || year > time.Now().Year() {
-			logger.Info(errStatisticsBadParameterYear, zap.String("key", key))
-			w.Header().Set(utils.HeaderContentType, "text/plain")
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte(errStatisticsBadParameterYear))
+
+		// move money between users
+		var output proto.GenericOutput
+		var txID snowflake.ID
+		txID, err = s.db.Transfer(r.Context(), input.IdempotencyKey, input.UserId, input.RecipientId, input.Currency, input.Value)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("transfer failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("transfer error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
 			return
 		}
-		month, err := strconv.Atoi(key[5:7])
-		if err != nil || month < 1 || month > 12 {
-			logger.Info(errStatisticsBadParameterMonth, zap.String("key", key))
-			w.Header().Set(utils.HeaderContentType, "text/plain")
+
+		logger.Info("new transaction (transfer)", zap.Int64("txID", txID.Int64()))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) RefundHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.RefundInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
 			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte(errStatisticsBadParameterMonth))
 			return
 		}
 
-		var headerWritten bool
-		var resCurrencies []string
-		var resWriter *csv.Writer
-		s.db.FetchStatistics(r.Context(), year, month, database.StatisticsCallbacks{
-			OnCurrencies: func(currencies []string) {
-				w.Header().Set(utils.HeaderContentType, "application/csv")
-				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=item_statistics_%04d_%02d.csv", year, month))
-				w.WriteHeader(http.StatusOK)
-				resCurrencies = currencies
-				resWriter = csv.NewWriter(w)
-				_ = resWriter.Write(append([]string{"Item ID"}, resCurrencies...))
-				headerWritten = true
-			},
-			OnRecord: func(item string, values map[string]decimal.Decimal) {
-				record := make([]string, 0, len(resCurrencies)+1)
-				record = append(record, item)
-				for _, c := range resCurrencies {
-					record = append(record, values[c].StringFixedBank(2))
-				}
-				_ = resWriter.Write(record)
-			},
-			OnError: func(err error) {
-				if headerWritten {
-					record := make([]string, len(resCurrencies)+1)
-					record[0] = err.Error()
-					_ = resWriter.Write(record)
-				} else {
-					w.Header().Set(utils.HeaderContentType, "text/plain")
-					w.WriteHeader(http.StatusInternalServerError)
-					_, _ = w.Write([]byte(err.Error()))
-				}
-			},
-		})
-		if headerWritten {
-			resWriter.Flush()
+		// return money for committed order
+		var output proto.GenericOutput
+		var txID snowflake.ID
+		txID, err = s.db.Refund(r.Context(), input.IdempotencyKey, input.UserId, input.Currency, input.Value, input.OrderId, input.ItemId)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("refund failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("refund error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
 		}
+
+		logger.Info("new transaction (refund)", zap.Int64("txID", txID.Int64()), zap.String("orderID", input.OrderId))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
 	})
 
-	return s.applyMiddlewares(handler, http.MethodGet)
+	return s.applyMiddlewares(handler, http.MethodPost)
 }
 
-func (s *BalanceWebService) applyMiddlewares(handler http.Handler, method string) http.Handler {
-	handler = utils.APIKey(handler, s.apiKey)
-	handler = utils.OnlyMethod(handler, method)
-	handler = utils.RequestLogger(handler, s.logger)
-	handler = utils.RequestID(handler)
-	handler = http.TimeoutHandler(handler, 5*time.Second, "")
-	return handler
-}
+func (s *BalanceWebService) WithdrawHandler() http.Handler {
+	var handler http.Handler
 
-func (s *BalanceWebService) sendGenericOutputCurrentUserBalanceData(w http.ResponseWriter, r *http.Request, userID string) {
-	logger := utils.GetRequestLogger(r)
-	var output proto.GenericOutput
-	var err error
-	output.UserBalance = &proto.UserBalanceData{UserId: userID}
-	var available, reserved decimal.Decimal
-	output.UserBalance.Currency, available, reserved, err = s.db.FetchUserBalance(r.Context(), userID)
-	if err != nil {
-		protoErr, ok := err.(*proto.Error)
-		if !ok {
-			logger.Error("fetch balance error", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.WithdrawInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		logger.Info("fetch balance failed", zap.Error(err))
-		output.Error = protoErr
-		output.UserBalance = nil
-	} else {
-		output.UserBalance.Value = available.StringFixedBank(2)
-		output.UserBalance.ReservedValue = reserved.StringFixedBank(2)
-		output.UserBalance.IsOverdraft = available.LessThan(decimal.Zero)
-	}
+
+		// pay out user funds
+		var output proto.GenericOutput
+		var txID snowflake.ID
+		txID, err = s.db.Withdraw(r.Context(), input.IdempotencyKey, input.UserId, input.Currency, input.Value, input.PayoutData)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("withdraw failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("withdraw error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("new transaction (withdrawal)", zap.Int64("txID", txID.Int64()))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) ReverseHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.ReverseInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var topUpID snowflake.ID
+		if input.TransactionId != "" {
+			if topUpID, err = snowflake.ParseString(input.TransactionId); err != nil || topUpID == 0 {
+				utils.WriteOutput(r, w, logger, &proto.GenericOutput{Error: proto.NewBadParameterError("transaction id")})
+				return
+			}
+		}
+
+		// take top-up back, user may end up in debt
+		var output proto.GenericOutput
+		var txID snowflake.ID
+		var userID string
+		txID, userID, err = s.db.Reverse(r.Context(), topUpID, input.IdempotencyKey)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("reverse failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("reverse error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("new transaction (reversal)", zap.Int64("txID", txID.Int64()))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, userID)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) BatchHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.BatchInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		operations := make([]database.BatchOperation, len(input.Operations))
+		for i, op := range input.Operations {
+			operations[i] = batchOperation(op)
+		}
+
+		// apply all operations or none
+		var output proto.BatchOutput
+		results, err := s.db.Batch(r.Context(), operations)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if !ok {
+				logger.Error("batch error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			logger.Info("batch failed", zap.Int("operation", len(results)-1), zap.Error(err))
+			output.Error = protoErr
+		} else {
+			logger.Info("batch applied", zap.Int("operations", len(results)))
+		}
+
+		output.Results = make([]*proto.BatchOperationResult, len(results))
+		for i, result := range results {
+			output.Results[i] = &proto.BatchOperationResult{}
+			if result.Err != nil {
+				output.Results[i].Error, _ = result.Err.(*proto.Error)
+			}
+			if result.TxID != 0 {
+				output.Results[i].TransactionId = result.TxID.String()
+			}
+		}
+
+		utils.WriteOutput(r, w, logger, &output)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func batchOperation(op *proto.BatchOperation) database.BatchOperation {
+	switch {
+	case op.GetTopUp() != nil:
+		in := op.GetTopUp()
+		return database.BatchOperation{
+			Kind:           database.BatchOperationTopUp,
+			IdempotencyKey: in.IdempotencyKey,
+			UserID:         in.UserId,
+			Currency:       in.Currency,
+			Value:          in.Value,
+			MerchantData:   in.MerchantData,
+			Pending:        in.Pending,
+		}
+	case op.GetReserve() != nil:
+		in := op.GetReserve()
+		var expiresAt time.Time
+		if in.ExpiresAt != nil {
+			expiresAt = time.Unix(in.ExpiresAt.Seconds, int64(in.ExpiresAt.Nanos))
+		}
+		return database.BatchOperation{
+			Kind:      database.BatchOperationReserve,
+			UserID:    in.UserId,
+			Currency:  in.Currency,
+			Value:     in.Value,
+			OrderID:   in.OrderId,
+			ItemID:    in.ItemId,
+			ExpiresAt: expiresAt,
+		}
+	case op.GetCommit() != nil:
+		in := op.GetCommit()
+		return database.BatchOperation{
+			Kind:           database.BatchOperationCommit,
+			IdempotencyKey: in.IdempotencyKey,
+			UserID:         in.UserId,
+			Currency:       in.Currency,
+			Value:          in.Value,
+			OrderID:        in.OrderId,
+			ItemID:         in.ItemId,
+			KeepRemainder:  in.KeepRemainder,
+			SellerID:       in.SellerId,
+			Commission:     commission(in.Commission),
+		}
+	case op.GetCancel() != nil:
+		in := op.GetCancel()
+		return database.BatchOperation{
+			Kind:    database.BatchOperationCancel,
+			UserID:  in.UserId,
+			OrderID: in.OrderId,
+			ItemID:  in.ItemId,
+		}
+	case op.GetAdjust() != nil:
+		in := op.GetAdjust()
+		return database.BatchOperation{
+			Kind:     database.BatchOperationAdjust,
+			UserID:   in.UserId,
+			Currency: in.Currency,
+			Value:    in.Value,
+			OrderID:  in.OrderId,
+			ItemID:   in.ItemId,
+		}
+	default:
+		// constb: empty kind is rejected by database as bad parameter
+		return database.BatchOperation{}
+	}
+}
+
+func (s *BalanceWebService) SetCreditLimitHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.SetCreditLimitInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// update user wallet credit limit
+		var output proto.GenericOutput
+		err = s.db.SetCreditLimit(r.Context(), input.UserId, input.Currency, input.CreditLimit)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("set credit limit failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("set credit limit error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("credit limit set", zap.String("userID", input.UserId), zap.String("currency", input.Currency), zap.String("creditLimit", input.CreditLimit))
+
+		s.sendGenericOutputCurrentUserBalanceData(w, r, input.UserId)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) CreditLimitHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.RequestURI[14:]
+		s.sendGenericOutputCurrentUserBalanceData(w, r, userID)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodGet)
+}
+
+func (s *BalanceWebService) SetAccountStatusHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.SetAccountStatusInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// change account status, previous statuses are kept as history
+		var output proto.AccountStatusOutput
+		err = s.db.SetAccountStatus(r.Context(), input.UserId, accountStatusName(input.Status), input.Reason)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("set account status failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("set account status error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("account status set", zap.String("userID", input.UserId), zap.String("status", input.Status.String()), zap.String("reason", input.Reason))
+
+		s.sendAccountStatusOutput(w, r, input.UserId)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) AccountStatusHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.RequestURI[16:]
+		s.sendAccountStatusOutput(w, r, userID)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodGet)
+}
+
+func (s *BalanceWebService) sendAccountStatusOutput(w http.ResponseWriter, r *http.Request, userID string) {
+	logger := utils.GetRequestLogger(r)
+
+	var output proto.AccountStatusOutput
+	history, err := s.db.FetchAccountStatus(r.Context(), userID)
+	if err != nil {
+		protoErr, ok := err.(*proto.Error)
+		if ok {
+			logger.Info("fetch account status failed", zap.Error(err))
+			output.Error = protoErr
+			utils.WriteOutput(r, w, logger, &output)
+		} else {
+			logger.Error("fetch account status error", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	output.Status = proto.AccountStatus_ACCOUNT_STATUS_ACTIVE
+	if len(history) > 0 {
+		output.Status = accountStatus(history[0].Status)
+	}
+	output.History = make([]*proto.AccountStatusChange, len(history))
+	for i, item := range history {
+		output.History[i] = &proto.AccountStatusChange{
+			Status:    accountStatus(item.Status),
+			Reason:    item.Reason,
+			CreatedAt: &timestamppb.Timestamp{Seconds: item.CreatedAt.Unix()},
+		}
+	}
+
+	utils.WriteOutput(r, w, logger, &output)
+}
+
+func (s *BalanceWebService) OverdraftsHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		var output proto.OverdraftsOutput
+		overdrafts, err := s.db.FetchOverdrafts(r.Context())
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("fetch overdrafts failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("fetch overdrafts error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		now := time.Now()
+		for _, item := range overdrafts {
+			next := &proto.Overdraft{
+				UserId:      item.UserID,
+				Currency:    item.Currency,
+				Value:       database.NewMoney(item.Available, item.Currency).String(),
+				CreditLimit: database.NewMoney(item.CreditLimit, item.Currency).String(),
+			}
+			for _, debt := range item.Debts {
+				next.Debts = append(next.Debts, &proto.Debt{
+					Value:          database.NewMoney(debt.Value, item.Currency).String(),
+					RemainingValue: database.NewMoney(debt.Remaining, item.Currency).String(),
+					TransactionId:  debt.TransactionID.String(),
+					OrderId:        debt.OrderID,
+					ItemId:         debt.ItemID,
+					AgeSeconds:     int64(now.Sub(debt.CreatedAt).Seconds()),
+					CreatedAt:      &timestamppb.Timestamp{Seconds: debt.CreatedAt.Unix()},
+				})
+			}
+			output.Overdrafts = append(output.Overdrafts, next)
+		}
+
+		utils.WriteOutput(r, w, logger, &output)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodGet)
+}
+
+func (s *BalanceWebService) CurrenciesHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		rates := database.CurrentRates()
+		output := proto.CurrenciesOutput{
+			BaseCurrency:     rates.Base,
+			RatesPublishedAt: &timestamppb.Timestamp{Seconds: rates.Timestamp.Unix()},
+			RatesFetchedAt:   &timestamppb.Timestamp{Seconds: rates.FetchedAt.Unix()},
+			RatesAgeSeconds:  int64(time.Since(rates.Timestamp).Seconds()),
+		}
+		if rates.ID != 0 {
+			output.RatesId = rates.ID.String()
+		}
+		codes := make([]string, 0, len(rates.Rates))
+		for code := range rates.Rates {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			output.Currencies = append(output.Currencies, &proto.Currency{
+				Code:      code,
+				Precision: database.CurrencyPrecision(code),
+				Rate:      rates.Rates[code].String(),
+			})
+		}
+
+		utils.WriteOutput(r, w, logger, &output)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodGet)
+}
+
+func (s *BalanceWebService) ConvertHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.ConvertInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// quote only, no money moves
+		var output proto.ConvertOutput
+		quote, err := s.db.QuoteConversion(input.Currency, input.Value, input.ToCurrency)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("convert failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("convert error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		output.Quote = &proto.ConversionQuote{
+			Currency:         quote.Value.Currency,
+			Value:            quote.Value.String(),
+			ToCurrency:       quote.To.Currency,
+			ToValue:          quote.To.String(),
+			ReservedValue:    quote.Reserved.String(),
+			Rate:             quote.Rate.String(),
+			Buffer:           quote.Buffer.String(),
+			RatesPublishedAt: &timestamppb.Timestamp{Seconds: quote.Rates.Timestamp.Unix()},
+		}
+		if quote.Rates.ID != 0 {
+			output.Quote.RatesId = quote.Rates.ID.String()
+		}
+
+		utils.WriteOutput(r, w, logger, &output)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func accountStatus(status string) proto.AccountStatus {
+	switch status {
+	case database.AccountStatusActive:
+		return proto.AccountStatus_ACCOUNT_STATUS_ACTIVE
+	case database.AccountStatusFrozen:
+		return proto.AccountStatus_ACCOUNT_STATUS_FROZEN
+	case database.AccountStatusBlocked:
+		return proto.AccountStatus_ACCOUNT_STATUS_BLOCKED
+	default:
+		return proto.AccountStatus_ACCOUNT_STATUS_UNSPECIFIED
+	}
+}
+
+func accountStatusName(status proto.AccountStatus) string {
+	switch status {
+	case proto.AccountStatus_ACCOUNT_STATUS_ACTIVE:
+		return database.AccountStatusActive
+	case proto.AccountStatus_ACCOUNT_STATUS_FROZEN:
+		return database.AccountStatusFrozen
+	case proto.AccountStatus_ACCOUNT_STATUS_BLOCKED:
+		return database.AccountStatusBlocked
+	default:
+		return ""
+	}
+}
+
+const expireReservationsBatchSize = 100
+
+// ExpireReservations is a background job, cancels reservations that are past their expiry time.
+func (s *BalanceWebService) ExpireReservations() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for !utils.IsShuttingDown() {
+		count, err := s.db.ExpireReservations(ctx, expireReservationsBatchSize)
+		if err != nil {
+			s.logger.Error("expire reservations error", zap.Error(err))
+			return
+		}
+		if count > 0 {
+			s.logger.Info("expired reservations", zap.Int("count", count))
+		}
+		if count < expireReservationsBatchSize {
+			return
+		}
+	}
+}
+
+func (s *BalanceWebService) CreateSubscriptionHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.CreateSubscriptionInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var startAt time.Time
+		if input.StartAt != nil {
+			startAt = time.Unix(input.StartAt.Seconds, int64(input.StartAt.Nanos))
+		}
+		maxRetries := -1
+		if input.MaxRetries != nil {
+			maxRetries = int(*input.MaxRetries)
+		}
+
+		// register recurring charge, scheduler picks it up when it is due
+		var output proto.SubscriptionOutput
+		subscription, err := s.db.CreateSubscription(r.Context(), input.UserId, input.Currency, input.Value, input.ItemId, input.Interval, startAt, maxRetries, input.RetryInterval)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("create subscription failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("create subscription error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("new subscription", zap.Int64("subscriptionID", subscription.ID.Int64()))
+
+		output.Subscription = subscriptionData(subscription)
+		utils.WriteOutput(r, w, logger, &output)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) PauseSubscriptionHandler() http.Handler {
+	return s.subscriptionStatusHandler("pause", s.db.PauseSubscription)
+}
+
+func (s *BalanceWebService) ResumeSubscriptionHandler() http.Handler {
+	return s.subscriptionStatusHandler("resume", s.db.ResumeSubscription)
+}
+
+func (s *BalanceWebService) CancelSubscriptionHandler() http.Handler {
+	return s.subscriptionStatusHandler("cancel", s.db.CancelSubscription)
+}
+
+func (s *BalanceWebService) subscriptionStatusHandler(action string, change func(context.Context, snowflake.ID) (*database.Subscription, error)) http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		input := proto.SubscriptionInput{}
+		err := utils.UnmarshalInput(r, &input)
+		if err != nil {
+			logger.Info("bad input", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// constb: unparsable id becomes zero and is rejected by database as bad parameter
+		id, _ := snowflake.ParseString(input.SubscriptionId)
+
+		var output proto.SubscriptionOutput
+		subscription, err := change(r.Context(), id)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info(action+" subscription failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error(action+" subscription error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		logger.Info("subscription status changed", zap.Int64("subscriptionID", id.Int64()), zap.String("status", subscription.Status))
+
+		output.Subscription = subscriptionData(subscription)
+		utils.WriteOutput(r, w, logger, &output)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodPost)
+}
+
+func (s *BalanceWebService) ListSubscriptionsHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		userID := r.RequestURI[15:]
+
+		var output proto.ListSubscriptionsOutput
+		subscriptions, err := s.db.FetchUserSubscriptions(r.Context(), userID)
+		if err != nil {
+			protoErr, ok := err.(*proto.Error)
+			if ok {
+				logger.Info("fetch subscriptions failed", zap.Error(err))
+				output.Error = protoErr
+				utils.WriteOutput(r, w, logger, &output)
+			} else {
+				logger.Error("fetch subscriptions error", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		output.Subscriptions = make([]*proto.Subscription, len(subscriptions))
+		for i, subscription := range subscriptions {
+			output.Subscriptions[i] = subscriptionData(subscription)
+		}
+
+		utils.WriteOutput(r, w, logger, &output)
+	})
+
+	return s.applyMiddlewares(handler, http.MethodGet)
+}
+
+func subscriptionData(subscription *database.Subscription) *proto.Subscription {
+	return &proto.Subscription{
+		SubscriptionId: subscription.ID.String(),
+		UserId:         subscription.UserID,
+		Currency:       subscription.Currency,
+		Value:          database.NewMoney(subscription.Value, subscription.Currency).String(),
+		ItemId:         subscription.ItemID,
+		Interval:       subscription.Interval,
+		Status:         subscriptionStatus(subscription.Status),
+		NextChargeAt:   &timestamppb.Timestamp{Seconds: subscription.NextAttemptAt.Unix()},
+		ChargeCount:    int32(subscription.ChargeCount),
+		RetryCount:     int32(subscription.RetryCount),
+		LastError:      subscription.LastError,
+		CreatedAt:      &timestamppb.Timestamp{Seconds: subscription.CreatedAt.Unix()},
+	}
+}
+
+func subscriptionStatus(status string) proto.SubscriptionStatus {
+	switch status {
+	case database.SubscriptionStatusActive:
+		return proto.SubscriptionStatus_SUBSCRIPTION_STATUS_ACTIVE
+	case database.SubscriptionStatusPaused:
+		return proto.SubscriptionStatus_SUBSCRIPTION_STATUS_PAUSED
+	case database.SubscriptionStatusPastDue:
+		return proto.SubscriptionStatus_SUBSCRIPTION_STATUS_PAST_DUE
+	case database.SubscriptionStatusCancelled:
+		return proto.SubscriptionStatus_SUBSCRIPTION_STATUS_CANCELLED
+	default:
+		return proto.SubscriptionStatus_SUBSCRIPTION_STATUS_UNSPECIFIED
+	}
+}
+
+const chargeSubscriptionsBatchSize = 100
+
+// ChargeSubscriptions is a background job, charges subscriptions that are due. Runs on every replica, database makes
+// sure each subscription is charged once.
+func (s *BalanceWebService) ChargeSubscriptions() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for !utils.IsShuttingDown() {
+		count, err := s.db.ChargeDueSubscriptions(ctx, chargeSubscriptionsBatchSize)
+		if err != nil {
+			s.logger.Error("charge subscriptions error", zap.Error(err))
+			return
+		}
+		if count > 0 {
+			s.logger.Info("charged subscriptions", zap.Int("count", count))
+		}
+		if count < chargeSubscriptionsBatchSize {
+			return
+		}
+	}
+}
+
+const expireBonusesBatchSize = 100
+
+// ExpireBonuses is a background job, writes off bonus that is past its expiry time.
+func (s *BalanceWebService) ExpireBonuses() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for !utils.IsShuttingDown() {
+		count, err := s.db.ExpireBonuses(ctx, expireBonusesBatchSize)
+		if err != nil {
+			s.logger.Error("expire bonuses error", zap.Error(err))
+			return
+		}
+		if count > 0 {
+			s.logger.Info("expired bonuses", zap.Int("count", count))
+		}
+		if count < expireBonusesBatchSize {
+			return
+		}
+	}
+}
+
+func (s *BalanceWebService) RefreshRates() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := s.db.RefreshRates(ctx); err != nil {
+		s.logger.Error("refresh rates error", zap.Error(err))
+	}
+}
+
+const (
+	errStatisticsBadParameters     = "bad parameters, use YYYY-MM"
+	errStatisticsBadParameterYear  = `bad parameter "year", use YYYY-MM`
+	errStatisticsBadParameterMonth = `bad parameter "month", use YYYY-MM`
+)
+
+func (s *BalanceWebService) StatisticsCsvHandler() http.Handler {
+	var handler http.Handler
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetRequestLogger(r)
+
+		key := r.RequestURI[12:]
+		if len(key) != 7 || key[4] != '/' {
+			logger.Info(errStatisticsBadParameters, zap.String("key", key))
+			w.Header().Set(utils.HeaderContentType, "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(errStatisticsBadParameters))
+			return
+		}
+		year, err := strconv.Atoi(key[0:4])
+		if err != nil || year < 2022 || year > time.Now().Year() {
+			logger.Info(errStatisticsBadParameterYear, zap.String("key", key))
+			w.Header().Set(utils.HeaderContentType, "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(errStatisticsBadParameterYear))
+			return
+		}
+		month, err := strconv.Atoi(key[5:7])
+		if err != nil || month < 1 || month > 12 {
+			logger.Info(errStatisticsBadParameterMonth, zap.String("key", key))
+			w.Header().Set(utils.HeaderContentType, "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(errStatisticsBadParameterMonth))
+			return
+		}
+
+		var headerWritten bool
+		var resCurrencies []string
+		var resWriter *csv.Writer
+		s.db.FetchStatistics(r.Context(), year, month, database.StatisticsCallbacks{
+			OnCurrencies: func(currencies []string) {
+				w.Header().Set(utils.HeaderContentType, "application/csv")
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=item_statistics_%04d_%02d.csv", year, month))
+				w.WriteHeader(http.StatusOK)
+				resCurrencies = currencies
+				resWriter = csv.NewWriter(w)
+				// constb: total revenue per currency first, then its bonus-funded part (cash is the difference)
+				header := append([]string{"Item ID"}, resCurrencies...)
+				for _, c := range resCurrencies {
+					header = append(header, c+" bonus")
+				}
+				_ = resWriter.Write(header)
+				headerWritten = true
+			},
+			OnRecord: func(item string, values, bonusValues map[string]decimal.Decimal) {
+				record := make([]string, 0, 2*len(resCurrencies)+1)
+				record = append(record, item)
+				for _, c := range resCurrencies {
+					record = append(record, database.NewMoney(values[c], c).String())
+				}
+				for _, c := range resCurrencies {
+					record = append(record, database.NewMoney(bonusValues[c], c).String())
+				}
+				_ = resWriter.Write(record)
+			},
+			OnError: func(err error) {
+				if headerWritten {
+					record := make([]string, 2*len(resCurrencies)+1)
+					record[0] = err.Error()
+					_ = resWriter.Write(record)
+				} else {
+					w.Header().Set(utils.HeaderContentType, "text/plain")
+					w.WriteHeader(http.StatusInternalServerError)
+					_, _ = w.Write([]byte(err.Error()))
+				}
+			},
+		})
+		if headerWritten {
+			resWriter.Flush()
+		}
+	})
+
+	return s.applyMiddlewares(handler, http.MethodGet)
+}
+
+func (s *BalanceWebService) applyMiddlewares(handler http.Handler, method string) http.Handler {
+	handler = utils.APIKey(handler, s.apiKey)
+	handler = utils.OnlyMethod(handler, method)
+	handler = utils.RequestLogger(handler, s.logger)
+	handler = utils.RequestID(handler)
+	handler = http.TimeoutHandler(handler, 5*time.Second, "")
+	return handler
+}
+
+func (s *BalanceWebService) sendGenericOutputCurrentUserBalanceData(w http.ResponseWriter, r *http.Request, userID string) {
+	logger := utils.GetRequestLogger(r)
+	var output proto.GenericOutput
+	var err error
+	var wallets []database.UserWallet
+	wallets, err = s.db.FetchUserBalance(r.Context(), userID)
+	if err != nil {
+		protoErr, ok := err.(*proto.Error)
+		if !ok {
+			logger.Error("fetch balance error", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logger.Info("fetch balance failed", zap.Error(err))
+		output.Error = protoErr
+	} else {
+		output.UserBalance = userBalanceData(userID, wallets)
+	}
 	utils.WriteOutput(r, w, logger, &output)
 }
+
+func userBalanceData(userID string, wallets []database.UserWallet) *proto.UserBalanceData {
+	data := &proto.UserBalanceData{UserId: userID}
+	for _, wallet := range wallets {
+		creditUsed := decimal.Max(wallet.Available.Neg(), decimal.Zero)
+		next := &proto.UserWalletData{
+			Currency:           wallet.Currency,
+			Value:              database.NewMoney(wallet.Available, wallet.Currency).String(),
+			ReservedValue:      database.NewMoney(wallet.Reserved, wallet.Currency).String(),
+			IsOverdraft:        creditUsed.GreaterThan(wallet.CreditLimit),
+			CreditLimit:        database.NewMoney(wallet.CreditLimit, wallet.Currency).String(),
+			CreditUsed:         database.NewMoney(creditUsed, wallet.Currency).String(),
+			BonusValue:         database.NewMoney(wallet.BonusAvailable, wallet.Currency).String(),
+			ReservedBonusValue: database.NewMoney(wallet.BonusReserved, wallet.Currency).String(),
+			PendingValue:       database.NewMoney(wallet.Pending, wallet.Currency).String(),
+		}
+		data.Wallets = append(data.Wallets, next)
+		data.IsOverdraft = data.IsOverdraft || next.IsOverdraft
+	}
+	if len(data.Wallets) == 1 {
+		// constb: keep single-currency clients working
+		data.Currency = data.Wallets[0].Currency
+		data.Value = data.Wallets[0].Value
+		data.ReservedValue = data.Wallets[0].ReservedValue
+		data.BonusValue = data.Wallets[0].BonusValue
+		data.PendingValue = data.Wallets[0].PendingValue
+	}
+	return data
+}
@@ -0,0 +1,386 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/constb/tt-golang/internal/proto"
+	"github.com/constb/tt-golang/internal/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// bonusPart decides how much of value debited from the wallet is paid with bonus, according to bonus priority. At
+// most bonus is taken, and with cash first only what cash can't cover.
+func (d *BalanceDatabase) bonusPart(value, bonus, cash Money) Money {
+	zero := NewMoney(decimal.Zero, value.Currency)
+	if bonus.IsNegative() {
+		bonus = zero
+	}
+	if d.bonusPriority == BonusPriorityCashFirst {
+		if cash.IsNegative() {
+			cash = zero
+		}
+		if !value.GreaterThan(cash) {
+			return zero
+		}
+		return bonus.Min(value.Sub(cash))
+	}
+	return bonus.Min(value)
+}
+
+// GrantBonus credits promotional funds to the bonus part of user wallet. Bonus can only be spent on charges, what is
+// left of it after expiresAt is written off.
+func (d *BalanceDatabase) GrantBonus(ctx context.Context, idempotencyKey, userID, currency, value, merchantData string, expiresAt time.Time) (txID snowflake.ID, err error) {
+	if idempotencyKey == "" {
+		return 0, proto.NewBadParameterError("idempotency key")
+	}
+	if userID == "" {
+		return 0, proto.NewBadParameterError("user id")
+	}
+	if !IsCurrencyValid(currency) {
+		return 0, proto.NewBadParameterError("currency")
+	}
+	bonusValue, err := ParseMoney(value, currency)
+	if err != nil || !bonusValue.IsPositive() {
+		return 0, proto.NewBadParameterError("value")
+	}
+	if !expiresAt.After(time.Now()) {
+		return 0, proto.NewBadParameterError("expires at")
+	}
+	if merchantData != "" && !json.Valid([]byte(merchantData)) {
+		return 0, proto.NewBadParameterError("merchant data")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) CREATE ZERO WALLET IF NOT EXISTS
+	// constb: blocked users don't get new wallets. status is checked again below, once wallet is locked
+	if err = checkAccountStatus(ctx, tx, userID, false); err != nil {
+		return 0, err
+	}
+	err = initUserBalance(ctx, tx, userID, currency)
+	if err != nil {
+		return 0, err
+	}
+
+	// 2) LOAD WALLET IN BONUS CURRENCY AND LOCK FOR UPDATE
+	var balanceBonusValue decimal.Decimal
+	row := tx.QueryRow(ctx, "SELECT bonus_value FROM balance WHERE user_id = $1 AND currency = $2 FOR UPDATE", userID, currency)
+	if err = row.Scan(&balanceBonusValue); err != nil {
+		return 0, fmt.Errorf("lock balance: %w", err)
+	}
+
+	// x) IDEMPOTENCY CHECK
+	txID, err = findIdempotentTransaction(ctx, tx, idempotencyKey, idempotencyParams{
+		kind:        TransactionKindBonus,
+		recipientID: userID,
+		value:       bonusValue,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if txID != 0 {
+		// constb: bonus already was granted earlier, continue as if we have applied it now
+		return txID, nil
+	}
+
+	// x) CHECK ACCOUNT STATUS
+	if err = checkAccountStatus(ctx, tx, userID, false); err != nil {
+		return 0, err
+	}
+
+	// 3) CREATE TRANSACTION RECORD AND GRANT (balance before and after are of the bonus part)
+	txID = utils.GenerateID()
+	var merchantDataParam any
+	if merchantData != "" {
+		merchantDataParam = merchantData
+	}
+	_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, recipient_id, recipient_currency, recipient_value,
+                         recipient_balance_before, recipient_balance_after, bonus_value, bonus_expires_at, merchant_data,
+                         idempotency_key)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		txID.Int64(), TransactionKindBonus, currency, bonusValue.Amount, userID, currency, bonusValue.Amount,
+		balanceBonusValue, balanceBonusValue.Add(bonusValue.Amount), bonusValue.Amount, expiresAt, merchantDataParam,
+		idempotencyKey,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("save user tx: %w", err)
+	}
+	if err = addBonus(ctx, tx, txID, userID, bonusValue, expiresAt); err != nil {
+		return 0, err
+	}
+
+	// 4) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountPromo, "", bonusValue.Neg())
+	entries.add(LedgerAccountUserBonus, userID, bonusValue)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, err
+	}
+
+	return txID, nil
+}
+
+// addBonus credits bonus part of locked user wallet, bonus is tracked until it expires
+func addBonus(ctx context.Context, tx pgx.Tx, txID snowflake.ID, userID string, value Money, expiresAt time.Time) error {
+	_, err := tx.Exec(ctx, `
+INSERT INTO bonus (id, user_id, currency, "value", remaining_value, expires_at, transaction_id)
+VALUES ($1, $2, $3, $4, $4, $5, $6)`,
+		utils.GenerateID().Int64(), userID, value.Currency, value.Amount, expiresAt, txID.Int64(),
+	)
+	if err != nil {
+		return fmt.Errorf("save bonus: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET bonus_value = bonus_value + $3 WHERE user_id = $1 AND currency = $2`,
+		userID, value.Currency, value.Amount,
+	)
+	if err != nil {
+		return fmt.Errorf("update balance: %w", err)
+	}
+	return nil
+}
+
+// spendBonus debits bonus part of locked user wallet, bonuses that expire first are spent first. Returns expiry of
+// the latest bonus spent, so that refund can give it back for the same time.
+func spendBonus(ctx context.Context, tx pgx.Tx, userID string, value Money) (time.Time, error) {
+	currency := value.Currency
+	var latestExpiresAt time.Time
+	if !value.IsPositive() {
+		return latestExpiresAt, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+SELECT id, remaining_value, expires_at
+FROM bonus
+WHERE user_id = $1 AND currency = $2 AND remaining_value > 0
+ORDER BY expires_at, id
+FOR UPDATE`, userID, currency)
+	if err != nil {
+		return latestExpiresAt, fmt.Errorf("lock bonus: %w", err)
+	}
+	type bonusRemaining struct {
+		id        int64
+		remaining decimal.Decimal
+	}
+	var spent []bonusRemaining
+	left := value.Amount
+	for rows.Next() && left.IsPositive() {
+		var next bonusRemaining
+		var expiresAt time.Time
+		if err = rows.Scan(&next.id, &next.remaining, &expiresAt); err != nil {
+			rows.Close()
+			return latestExpiresAt, fmt.Errorf("lock bonus: %w", err)
+		}
+		take := decimal.Min(next.remaining, left)
+		next.remaining = next.remaining.Sub(take)
+		left = left.Sub(take)
+		spent = append(spent, next)
+		latestExpiresAt = expiresAt
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return latestExpiresAt, fmt.Errorf("lock bonus: %w", err)
+	}
+	if left.IsPositive() {
+		// constb: balance.bonus_value is always the sum of remaining bonuses, so this is a bug
+		return latestExpiresAt, fmt.Errorf("spend bonus: %s %s is missing", left.String(), currency)
+	}
+
+	for _, b := range spent {
+		_, err = tx.Exec(ctx, `UPDATE bonus SET remaining_value = $2 WHERE id = $1`, b.id, b.remaining)
+		if err != nil {
+			return latestExpiresAt, fmt.Errorf("update bonus: %w", err)
+		}
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET bonus_value = bonus_value - $3 WHERE user_id = $1 AND currency = $2`,
+		userID, currency, value.Amount,
+	)
+	if err != nil {
+		return latestExpiresAt, fmt.Errorf("update balance: %w", err)
+	}
+
+	return latestExpiresAt, nil
+}
+
+// ExpireBonuses writes off expired bonus in up to limit wallets. Reserved bonus is kept until reservation is committed
+// or released. Returns number of wallets written off.
+func (d *BalanceDatabase) ExpireBonuses(ctx context.Context, limit int) (int, error) {
+	now := time.Now()
+
+	// 1) FIND WALLETS WITH EXPIRED BONUS THAT IS NOT RESERVED
+	// constb: bonuses that expire first are spent first, so reservations hold expired bonus before the rest
+	rows, err := d.db.Query(ctx, `
+SELECT b.user_id, b.currency
+FROM bonus b
+WHERE b.expires_at <= $1
+  AND b.remaining_value > 0
+GROUP BY b.user_id, b.currency
+HAVING SUM(b.remaining_value) > (SELECT coalesce(SUM(r.bonus_value), 0)
+                                 FROM balance_reserve r
+                                 WHERE r.user_id = b.user_id AND r.wallet_currency = b.currency)
+LIMIT $2`,
+		now, limit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("find expired bonus: %w", err)
+	}
+	type expiredBonus struct{ userID, currency string }
+	var expired []expiredBonus
+	for rows.Next() {
+		var next expiredBonus
+		if err = rows.Scan(&next.userID, &next.currency); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("find expired bonus: %w", err)
+		}
+		expired = append(expired, next)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("find expired bonus: %w", err)
+	}
+
+	// 2) WRITE OFF EACH WALLET IN ITS OWN TRANSACTION
+	var count int
+	for _, bonus := range expired {
+		var ok bool
+		ok, err = d.expireBonus(ctx, bonus.userID, bonus.currency, now)
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (d *BalanceDatabase) expireBonus(ctx context.Context, userID, currency string, now time.Time) (ok bool, err error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) LOAD WALLETS WITH EXISTING RESERVES AND LOCK FOR UPDATE (same lock order as reserve/commit/cancel)
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, userID)
+	if err != nil {
+		return false, err
+	}
+	userWallet := findWallet(wallets[userID], currency)
+	if userWallet == nil {
+		return false, nil
+	}
+
+	// 2) KEEP RESERVED PART OF EXPIRED BONUSES, WRITE OFF THE REST
+	rows, err := tx.Query(ctx, `
+SELECT id, remaining_value, expires_at
+FROM bonus
+WHERE user_id = $1 AND currency = $2 AND remaining_value > 0
+ORDER BY expires_at, id
+FOR UPDATE`, userID, currency)
+	if err != nil {
+		return false, fmt.Errorf("lock bonus: %w", err)
+	}
+	type bonusRemaining struct {
+		id        int64
+		remaining decimal.Decimal
+	}
+	var written []bonusRemaining
+	writeOff := NewMoney(decimal.Zero, currency)
+	held := userWallet.reservedBonus.Amount
+	for rows.Next() {
+		var next bonusRemaining
+		var expiresAt time.Time
+		if err = rows.Scan(&next.id, &next.remaining, &expiresAt); err != nil {
+			rows.Close()
+			return false, fmt.Errorf("lock bonus: %w", err)
+		}
+		kept := decimal.Min(held, next.remaining)
+		held = held.Sub(kept)
+		if expiresAt.After(now) || kept.Equal(next.remaining) {
+			continue
+		}
+		writeOff = writeOff.Add(NewMoney(next.remaining.Sub(kept), currency))
+		next.remaining = kept
+		written = append(written, next)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, fmt.Errorf("lock bonus: %w", err)
+	}
+	if writeOff.IsZero() {
+		// constb: spent or reserved since we have looked
+		return false, nil
+	}
+	for _, b := range written {
+		_, err = tx.Exec(ctx, `UPDATE bonus SET remaining_value = $2 WHERE id = $1`, b.id, b.remaining)
+		if err != nil {
+			return false, fmt.Errorf("update bonus: %w", err)
+		}
+	}
+
+	// 3) CREATE TRANSACTION RECORD AND WRITE OFF (balance before and after are of the bonus part)
+	txID := utils.GenerateID()
+	bonusNewValue := userWallet.bonus.Sub(writeOff)
+	_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
+                         sender_balance_before, sender_balance_after, bonus_value)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		txID.Int64(), TransactionKindBonusExpiry, currency, writeOff.Amount, userID, currency, writeOff.Amount,
+		userWallet.bonus.Amount, bonusNewValue.Amount, writeOff.Amount,
+	)
+	if err != nil {
+		return false, fmt.Errorf("save user tx: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET bonus_value = $3 WHERE user_id = $1 AND currency = $2`,
+		userID, currency, bonusNewValue.Amount,
+	)
+	if err != nil {
+		return false, fmt.Errorf("update balance: %w", err)
+	}
+
+	// 4) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountUserBonus, userID, writeOff.Neg())
+	entries.add(LedgerAccountPromo, "", writeOff)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -2,15 +2,41 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"time"
 
 	pgxdecimal "github.com/jackc/pgx-shopspring-decimal"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+)
+
+// what to do on commit when exchange rate locked by reservation has expired
+const (
+	RateExpiryPolicyCurrent = "current" // convert at current rate
+	RateExpiryPolicyReject  = "reject"  // fail commit, reservation has to be cancelled and made again
+)
+
+// which part of the wallet reservations and charges are paid from first
+const (
+	BonusPriorityBonusFirst = "bonus_first"
+	BonusPriorityCashFirst  = "cash_first"
 )
 
 type BalanceDatabase struct {
 	db *pgxpool.Pool
+	// debit other user wallets with currency conversion when wallet in operation currency has not enough funds
+	conversionFallback bool
+	// reserved value is multiplied by buffer when converted, key is "FROM/TO", empty key holds default buffer
+	conversionBuffers map[string]decimal.Decimal
+	// how long exchange rate is locked by reservation, zero – until commit
+	rateLockTTL      time.Duration
+	rateExpiryPolicy string
+	bonusPriority    string
+	// how conversions and proportional shares are rounded to minor units
+	roundingPolicy string
+	rateProvider   RateProvider
 	// TODO: add caching
 }
 
@@ -20,6 +46,52 @@ func NewDatabaseConnection() (*BalanceDatabase, error) {
 		panic("DB_URL is not defined")
 	}
 
+	var err error
+	var rateLockTTL time.Duration
+	if ttl := os.Getenv("RATE_LOCK_TTL"); ttl != "" {
+		if rateLockTTL, err = time.ParseDuration(ttl); err != nil || rateLockTTL < 0 {
+			return nil, fmt.Errorf("RATE_LOCK_TTL: bad duration %q", ttl)
+		}
+	}
+	rateExpiryPolicy := os.Getenv("RATE_LOCK_EXPIRY_POLICY")
+	switch rateExpiryPolicy {
+	case "":
+		rateExpiryPolicy = RateExpiryPolicyCurrent
+	case RateExpiryPolicyCurrent, RateExpiryPolicyReject:
+	default:
+		return nil, fmt.Errorf("RATE_LOCK_EXPIRY_POLICY: unknown policy %q", rateExpiryPolicy)
+	}
+
+	bonusPriority := os.Getenv("BONUS_SPEND_PRIORITY")
+	switch bonusPriority {
+	case "":
+		bonusPriority = BonusPriorityBonusFirst
+	case BonusPriorityBonusFirst, BonusPriorityCashFirst:
+	default:
+		return nil, fmt.Errorf("BONUS_SPEND_PRIORITY: unknown priority %q", bonusPriority)
+	}
+
+	roundingPolicy := os.Getenv("AMOUNT_ROUNDING")
+	switch roundingPolicy {
+	case "":
+		roundingPolicy = RoundingHalfEven
+	case RoundingHalfEven, RoundingHalfUp:
+	default:
+		return nil, fmt.Errorf("AMOUNT_ROUNDING: unknown policy %q", roundingPolicy)
+	}
+
+	// constb: refuse to start with rates that can't be loaded rather than silently convert at stub rates
+	rateProvider := NewRateProvider(os.Getenv("EXCHANGE_RATES_SOURCE"))
+	rates, err := rateProvider.Rates(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("EXCHANGE_RATES_SOURCE: %w", err)
+	}
+	// constb: pairs are checked against rates that will be used, not the stub the service started with
+	conversionBuffers, err := parseConversionBuffers(os.Getenv("CURRENCY_CONVERSION_BUFFER"), rates)
+	if err != nil {
+		return nil, fmt.Errorf("CURRENCY_CONVERSION_BUFFER: %w", err)
+	}
+
 	if err := RunMigrations(url); err != nil {
 		return nil, err
 	}
@@ -39,5 +111,31 @@ func NewDatabaseConnection() (*BalanceDatabase, error) {
 		return nil, err
 	}
 
-	return &BalanceDatabase{pool}, nil
+	d := &BalanceDatabase{
+		db:                 pool,
+		conversionFallback: os.Getenv("CURRENCY_CONVERSION_FALLBACK") != "no",
+		conversionBuffers:  conversionBuffers,
+		rateLockTTL:        rateLockTTL,
+		rateExpiryPolicy:   rateExpiryPolicy,
+		bonusPriority:      bonusPriority,
+		roundingPolicy:     roundingPolicy,
+		rateProvider:       rateProvider,
+	}
+	if err = d.saveRates(context.Background(), rates); err != nil {
+		return nil, err
+	}
+	storeRates(rates)
+
+	return d, nil
+}
+
+// conversionBuffer returns safety buffer for reservations converted from one currency to another
+func (d *BalanceDatabase) conversionBuffer(from, to string) decimal.Decimal {
+	if buffer, ok := d.conversionBuffers[from+"/"+to]; ok {
+		return buffer
+	}
+	if buffer, ok := d.conversionBuffers[""]; ok {
+		return buffer
+	}
+	return decimal.NewFromInt(1)
 }
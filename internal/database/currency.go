@@ -1,98 +1,148 @@
 package database
 
 import (
-	"bytes"
-	"encoding/json"
-	"reflect"
+	"context"
+	"fmt"
+	"strings"
 
 	"github.com/constb/tt-golang/internal/proto"
 	"github.com/shopspring/decimal"
 )
 
-var (
-	baseCurrency string
-	rates        map[string]decimal.Decimal
-)
-
 func init() {
-	// loadRates()
+	// constb: service starts with stub rates, configured provider replaces them on connect
 	loadRatesFromStub()
 }
 
-// TODO: actually load conversion rates from api
-// func loadRates() {}
-
 func loadRatesFromStub() {
-	v := map[string]any{}
-	err := json.NewDecoder(bytes.NewReader([]byte(stub))).Decode(&v)
+	set, err := StubRateProvider{}.Rates(context.Background())
 	if err != nil {
 		panic(err)
 	}
-
-	base, ok := v["base"].(string)
-	if !ok {
-		panic(reflect.TypeOf(v["base"]))
-	}
-	ratesData, ok := v["rates"].(map[string]any)
-	if !ok {
-		panic(reflect.TypeOf(v["rates"]))
-	}
-
-	baseCurrency = base
-	rates = make(map[string]decimal.Decimal, len(ratesData))
-
-	for cur, rate := range ratesData {
-		rateValue, ok := rate.(float64)
-		if !ok {
-			panic(reflect.TypeOf(rate))
-		}
-		rates[cur] = decimal.NewFromFloat(rateValue)
-	}
+	storeRates(set)
 }
 
 func IsCurrencyValid(currency string) bool {
-	_, ok := rates[currency]
+	_, ok := rateSet().Rates[currency]
 	return ok
 }
 
-func ConvertCurrency(value decimal.Decimal, from, to string) (decimal.Decimal, error) {
-	var valueInBase decimal.Decimal
-	if value.IsNegative() {
-		return decimal.Zero, proto.NewBadParameterError("value")
+// ConversionRate returns how much of currency "to" is one unit of currency "from"
+func ConversionRate(from, to string) (decimal.Decimal, error) {
+	return rateSet().ConversionRate(from, to)
+}
+
+// Quote is conversion of an amount at current rates, the same way charges and reservations convert it
+type Quote struct {
+	Value    Money
+	To       Money           // at rate, what a charge takes
+	Reserved Money           // at rate multiplied by buffer, what a reservation holds
+	Rate     decimal.Decimal // how much of "to" currency is one unit of value currency
+	Buffer   decimal.Decimal // conversion buffer of reservations
+	Rates    *RateSet
+}
+
+// QuoteConversion converts value from one currency to another without moving any money
+func (d *BalanceDatabase) QuoteConversion(currency, value, toCurrency string) (*Quote, error) {
+	rates := rateSet()
+	if _, ok := rates.Rates[currency]; !ok {
+		return nil, proto.NewBadParameterError("currency")
 	}
-	if from == to {
-		return decimal.Zero, proto.NewBadParameterError("currency")
+	if _, ok := rates.Rates[toCurrency]; !ok || toCurrency == currency {
+		return nil, proto.NewBadParameterError("to currency")
+	}
+	amount, err := ParseMoney(value, currency)
+	if err != nil || !amount.IsPositive() {
+		return nil, proto.NewBadParameterError("value")
 	}
 
-	if from == baseCurrency {
-		valueInBase = value
-	} else {
-		rate, ok := rates[from]
-		if !ok {
-			return decimal.Zero, proto.NewInvalidCurrencyError(from)
-		}
+	rate, err := rates.ConversionRate(currency, toCurrency)
+	if err != nil {
+		return nil, err
+	}
+	buffer := d.conversionBuffer(currency, toCurrency)
+	return &Quote{
+		Value:    amount,
+		To:       amount.Convert(rate, toCurrency, d.roundingPolicy),
+		Reserved: amount.Convert(rate.Mul(buffer), toCurrency, d.roundingPolicy),
+		Rate:     rate,
+		Buffer:   buffer,
+		Rates:    rates,
+	}, nil
+}
 
-		if value.IsZero() {
-			valueInBase = decimal.Zero
-		} else {
-			valueInBase = value.Div(rate)
-		}
+// defaultPrecision is number of digits after dot of currencies not listed in currencyPrecision
+const defaultPrecision = 2
+
+// currencyPrecision is number of digits after dot (minor units, ISO 4217) of currencies that don't have cents.
+// Precious metals have no minor units in ISO 4217, they are kept with precision that is practical for them.
+var currencyPrecision = map[string]int32{
+	"BHD": 3,
+	"BIF": 0,
+	"BTC": 8,
+	"CLF": 4,
+	"CLP": 0,
+	"DJF": 0,
+	"GNF": 0,
+	"IQD": 3,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KMF": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"LYD": 3,
+	"OMR": 3,
+	"PYG": 0,
+	"RWF": 0,
+	"TND": 3,
+	"UGX": 0,
+	"VND": 0,
+	"VUV": 0,
+	"XAF": 0,
+	"XAG": 6,
+	"XAU": 6,
+	"XOF": 0,
+	"XPF": 0,
+}
+
+// CurrencyPrecision returns number of digits after dot in amounts of given currency
+func CurrencyPrecision(currency string) int32 {
+	if precision, ok := currencyPrecision[currency]; ok {
+		return precision
 	}
+	return defaultPrecision
+}
 
-	if to == baseCurrency {
-		return valueInBase, nil
-	} else {
-		rate, ok := rates[to]
-		if !ok {
-			return decimal.Zero, proto.NewInvalidCurrencyError(to)
-		}
+const defaultConversionBuffer = "1.06"
 
-		if value.IsZero() {
-			return decimal.Zero, nil
+// parseConversionBuffers parses safety buffers applied when reserved funds are converted to another currency.
+// Format is a comma separated list of "FROM/TO=buffer" pairs and an optional plain buffer used for all other pairs,
+// e.g. "1.06,EUR/USD=1.02,USD/EUR=1.02". Empty string means 6% for all pairs.
+func parseConversionBuffers(s string, rates *RateSet) (map[string]decimal.Decimal, error) {
+	if s == "" {
+		s = defaultConversionBuffer
+	}
+	buffers := map[string]decimal.Decimal{"": decimal.RequireFromString(defaultConversionBuffer)}
+	for _, item := range strings.Split(s, ",") {
+		pair, value, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			pair, value = "", pair
 		} else {
-			return valueInBase.Mul(rate), nil
+			from, to, ok := strings.Cut(pair, "/")
+			_, fromValid := rates.Rates[from]
+			_, toValid := rates.Rates[to]
+			if !ok || !fromValid || !toValid || from == to {
+				return nil, fmt.Errorf("bad currency pair %q", pair)
+			}
+		}
+		buffer, err := decimal.NewFromString(value)
+		if err != nil || buffer.LessThan(decimal.NewFromInt(1)) {
+			return nil, fmt.Errorf("bad conversion buffer %q", item)
 		}
+		buffers[pair] = buffer
 	}
+	return buffers, nil
 }
 
 var stub = `{
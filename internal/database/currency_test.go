@@ -8,7 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestConvertCurrency(t *testing.T) {
+func TestMoney_Convert(t *testing.T) {
 	loadRatesFromStub()
 	t.Parallel()
 
@@ -20,26 +20,26 @@ func TestConvertCurrency(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    decimal.Decimal
+		want    string
 		wantErr assert.ErrorAssertionFunc
 	}{
-		{"zero value", args{decimal.Zero, "EUR", "USD"}, decimal.Zero, assert.NoError},
-		{"conversion", args{decimal.NewFromInt(500), "TRY", "USD"}, decimal.NewFromFloat(26.85), assert.NoError},
+		{"zero value", args{decimal.Zero, "EUR", "USD"}, "0.00", assert.NoError},
+		{"conversion", args{decimal.NewFromInt(500), "TRY", "USD"}, "26.85", assert.NoError},
+		{"same currency", args{decimal.NewFromInt(500), "EUR", "EUR"}, "500.00", assert.NoError},
 
-		{"bad from", args{decimal.Zero, "xxx", "USD"}, decimal.Zero, assert.Error},
-		{"bad to", args{decimal.Zero, "EUR", "xxx"}, decimal.Zero, assert.Error},
-		{"same currency", args{decimal.Zero, "EUR", "EUR"}, decimal.Zero, assert.Error},
-		{"negative value", args{decimal.NewFromInt(-1), "EUR", "USD"}, decimal.Zero, assert.Error},
+		{"bad from", args{decimal.Zero, "xxx", "USD"}, "", assert.Error},
+		{"bad to", args{decimal.Zero, "EUR", "xxx"}, "", assert.Error},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			got, err := ConvertCurrency(tt.args.value, tt.args.from, tt.args.to)
-			if !tt.wantErr(t, err, fmt.Sprintf("ConvertCurrency(%v, %v, %v)", tt.args.value, tt.args.from, tt.args.to)) {
+			rate, err := ConversionRate(tt.args.from, tt.args.to)
+			if !tt.wantErr(t, err, fmt.Sprintf("ConversionRate(%v, %v)", tt.args.from, tt.args.to)) || err != nil {
 				return
 			}
-			assert.Equalf(t, tt.want.StringFixed(2), got.StringFixed(2), "ConvertCurrency(%v, %v, %v)", tt.args.value, tt.args.from, tt.args.to)
+			got := NewMoney(tt.args.value, tt.args.from).Convert(rate, tt.args.to, RoundingHalfEven)
+			assert.Equalf(t, tt.want, got.String(), "Convert(%v, %v, %v)", tt.args.value, tt.args.from, tt.args.to)
 		})
 	}
 }
@@ -67,3 +67,163 @@ func TestIsCurrencyValid(t *testing.T) {
 		})
 	}
 }
+
+func TestConversionRate(t *testing.T) {
+	t.Parallel()
+	got, err := ConversionRate("USD", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.966604", got.StringFixed(6))
+
+	_, err = ConversionRate("xxx", "EUR")
+	assert.Error(t, err)
+}
+
+func TestParseConversionBuffers(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"default", "", map[string]string{"": "1.06"}, assert.NoError},
+		{"all pairs", "1.03", map[string]string{"": "1.03"}, assert.NoError},
+		{"per pair", "EUR/USD=1.02, USD/EUR=1.01", map[string]string{"": "1.06", "EUR/USD": "1.02", "USD/EUR": "1.01"}, assert.NoError},
+
+		{"bad pair", "EUR=1.02", nil, assert.Error},
+		{"same currency", "EUR/EUR=1.02", nil, assert.Error},
+		{"bad currency", "EUR/xxx=1.02", nil, assert.Error},
+		{"currency provider doesn't have", "EUR/JPY=1.02", nil, assert.Error},
+		{"bad buffer", "EUR/USD=abc", nil, assert.Error},
+		{"buffer below one", "0.95", nil, assert.Error},
+	}
+	// constb: pairs are validated against provider's rates, not against stub ones
+	rates := &RateSet{Base: "EUR", Rates: map[string]decimal.Decimal{"EUR": decimal.NewFromInt(1), "USD": decimal.NewFromFloat(1.04)}}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseConversionBuffers(tt.value, rates)
+			if !tt.wantErr(t, err, fmt.Sprintf("parseConversionBuffers(%v)", tt.value)) || err != nil {
+				return
+			}
+			gotStrings := make(map[string]string, len(got))
+			for pair, buffer := range got {
+				gotStrings[pair] = buffer.StringFixed(2)
+			}
+			assert.Equalf(t, tt.want, gotStrings, "parseConversionBuffers(%v)", tt.value)
+		})
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		value    string
+		currency string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"cents", args{"10.25", "USD"}, "10.25", assert.NoError},
+		{"no minor units", args{"1500", "JPY"}, "1500", assert.NoError},
+		{"trailing zeroes", args{"1500.00", "JPY"}, "1500", assert.NoError},
+		{"three digits", args{"1.125", "KWD"}, "1.125", assert.NoError},
+		{"satoshi", args{"0.00000001", "BTC"}, "0.00000001", assert.NoError},
+		{"above 99 million", args{"1000000000.00", "TRY"}, "1000000000.00", assert.NoError},
+
+		{"too precise cents", args{"10.255", "USD"}, "", assert.Error},
+		{"too precise yen", args{"1500.5", "JPY"}, "", assert.Error},
+		{"not a number", args{"ten", "USD"}, "", assert.Error},
+		{"unknown currency", args{"10.00", "ABC"}, "", assert.Error},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseMoney(tt.args.value, tt.args.currency)
+			if !tt.wantErr(t, err, fmt.Sprintf("ParseMoney(%v, %v)", tt.args.value, tt.args.currency)) || err != nil {
+				return
+			}
+			assert.Equalf(t, tt.args.currency, got.Currency, "ParseMoney(%v, %v)", tt.args.value, tt.args.currency)
+			assert.Equalf(t, tt.want, got.String(), "ParseMoney(%v, %v)", tt.args.value, tt.args.currency)
+		})
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "10.50", NewMoney(decimal.NewFromFloat(10.5), "EUR").String())
+	assert.Equal(t, "1502", NewMoney(decimal.NewFromFloat(1502.5), "JPY").String())
+	assert.Equal(t, "0.320", NewMoney(decimal.NewFromFloat(0.32), "BHD").String())
+	assert.Equal(t, "0.00006251", NewMoney(decimal.NewFromFloat(0.000062510943), "BTC").String())
+	assert.Equal(t, "2.12", NewMoney(decimal.NewFromFloat(2.125), "USD").Round(RoundingHalfEven).Amount.String())
+	assert.Equal(t, "2.13", NewMoney(decimal.NewFromFloat(2.125), "USD").Round(RoundingHalfUp).Amount.String())
+}
+
+func TestMoney_Arithmetic(t *testing.T) {
+	t.Parallel()
+	ten := NewMoney(decimal.NewFromInt(10), "USD")
+
+	assert.Equal(t, "10.50", ten.Add(NewMoney(decimal.NewFromFloat(0.5), "USD")).String())
+	assert.Equal(t, "-5.00", ten.Sub(NewMoney(decimal.NewFromInt(15), "USD")).String())
+	assert.Equal(t, "-10.00", ten.Neg().String())
+	assert.True(t, ten.GreaterThan(NewMoney(decimal.NewFromFloat(9.99), "USD")))
+	assert.True(t, ten.Equal(NewMoney(decimal.NewFromFloat(10.00), "USD")))
+	assert.Equal(t, "9.99", ten.Min(NewMoney(decimal.NewFromFloat(9.99), "USD")).String())
+
+	assert.Panics(t, func() { ten.Add(NewMoney(decimal.NewFromInt(1), "EUR")) })
+	assert.Panics(t, func() { ten.Sub(NewMoney(decimal.NewFromInt(1), "EUR")) })
+
+	assert.Equal(t, "3.33", ten.Share(decimal.NewFromInt(1), decimal.NewFromInt(3), RoundingHalfEven).Amount.String())
+	assert.Equal(t, "1500", ten.Convert(decimal.NewFromFloat(150.04), "JPY", RoundingHalfEven).String())
+	assert.Equal(t, "1.25", NewMoney(decimal.NewFromFloat(2.5), "USD").Share(decimal.NewFromInt(1), decimal.NewFromInt(2), RoundingHalfUp).String())
+	assert.Equal(t, "1", NewMoney(decimal.NewFromFloat(0.01), "USD").Convert(decimal.NewFromInt(50), "JPY", RoundingHalfUp).String())
+	assert.Equal(t, "0", NewMoney(decimal.NewFromFloat(0.01), "USD").Convert(decimal.NewFromInt(50), "JPY", RoundingHalfEven).String())
+	assert.True(t, NewMoney(decimal.NewFromFloat(0.001), "KWD").IsMinorUnits())
+	assert.False(t, NewMoney(decimal.NewFromFloat(0.001), "USD").IsMinorUnits())
+}
+
+func TestBalanceDatabase_QuoteConversion(t *testing.T) {
+	t.Parallel()
+	buffers, err := parseConversionBuffers("1.06,EUR/JPY=1.10", rateSet())
+	assert.NoError(t, err)
+	d := &BalanceDatabase{conversionBuffers: buffers, roundingPolicy: RoundingHalfEven}
+
+	type args struct {
+		currency   string
+		value      string
+		toCurrency string
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantTo       string
+		wantReserved string
+		wantErr      assert.ErrorAssertionFunc
+	}{
+		{"default buffer", args{"EUR", "100.00", "USD"}, "103.46", "109.66", assert.NoError},
+		{"pair buffer, no minor units", args{"EUR", "10.00", "JPY"}, "1452", "1597", assert.NoError},
+
+		{"bad currency", args{"xxx", "10.00", "USD"}, "", "", assert.Error},
+		{"bad to currency", args{"EUR", "10.00", "xxx"}, "", "", assert.Error},
+		{"same currency", args{"EUR", "10.00", "EUR"}, "", "", assert.Error},
+		{"too precise", args{"JPY", "10.5", "EUR"}, "", "", assert.Error},
+		{"zero", args{"EUR", "0", "USD"}, "", "", assert.Error},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := d.QuoteConversion(tt.args.currency, tt.args.value, tt.args.toCurrency)
+			if !tt.wantErr(t, err, fmt.Sprintf("QuoteConversion(%v, %v, %v)", tt.args.currency, tt.args.value, tt.args.toCurrency)) || err != nil {
+				return
+			}
+			assert.Equalf(t, tt.wantTo, got.To.String(), "QuoteConversion(%v, %v, %v)", tt.args.currency, tt.args.value, tt.args.toCurrency)
+			assert.Equalf(t, tt.wantReserved, got.Reserved.String(), "QuoteConversion(%v, %v, %v)", tt.args.currency, tt.args.value, tt.args.toCurrency)
+		})
+	}
+}
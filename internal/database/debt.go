@@ -0,0 +1,263 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/constb/tt-golang/internal/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// overLimit is how far wallet balance is beyond credit limit, zero if it is within
+func overLimit(balance, creditLimit Money) Money {
+	return NewMoney(decimal.Max(balance.Add(creditLimit).Neg().Amount, decimal.Zero), balance.Currency)
+}
+
+// reservedCash is the cash part of reservations held in locked user wallet
+func reservedCash(ctx context.Context, tx pgx.Tx, userID, currency string) (Money, error) {
+	var reserved decimal.Decimal
+	row := tx.QueryRow(ctx, "SELECT coalesce(SUM(user_currency_value - bonus_value), 0) FROM balance_reserve WHERE user_id = $1 AND wallet_currency = $2",
+		userID, currency,
+	)
+	if err := row.Scan(&reserved); err != nil {
+		return Money{}, fmt.Errorf("read reserve: %w", err)
+	}
+	return NewMoney(reserved, currency), nil
+}
+
+// recordDebt tracks how far transaction took available funds (balance less reserved cash) of locked user wallet
+// beyond its credit limit, spending within the limit is not a debt. Nothing is recorded if the wallet stays within the
+// limit or was beyond it already by at least as much.
+func recordDebt(ctx context.Context, tx pgx.Tx, txID snowflake.ID, userID string, creditLimit, before, after Money, orderID, itemID string) error {
+	debt := overLimit(after, creditLimit).Sub(overLimit(before, creditLimit))
+	if !debt.IsPositive() {
+		return nil
+	}
+
+	var orderIDParam, itemIDParam any
+	if orderID != "" {
+		orderIDParam = orderID
+	}
+	if itemID != "" {
+		itemIDParam = itemID
+	}
+	_, err := tx.Exec(ctx, `
+INSERT INTO debt (id, user_id, currency, "value", remaining_value, transaction_id, order_id, item_id)
+VALUES ($1, $2, $3, $4, $4, $5, $6, $7)`,
+		utils.GenerateID().Int64(), userID, debt.Currency, debt.Amount, txID.Int64(), orderIDParam, itemIDParam,
+	)
+	if err != nil {
+		return fmt.Errorf("save debt: %w", err)
+	}
+
+	var entries ledger
+	entries.add(LedgerAccountOverdraft, "", debt.Neg())
+	entries.add(LedgerAccountDebt, "", debt)
+	return entries.post(ctx, tx, txID)
+}
+
+// collectDebt repays debts of locked user wallet, oldest first, with what has been credited to the wallet or released
+// from its reservations. Call it after every credit or release. Repaid part is recorded as debt repayment transaction,
+// wallet balance itself doesn't change: it is what was just credited or released that covers the debt. Returns zero
+// id if there was nothing to repay.
+func collectDebt(ctx context.Context, tx pgx.Tx, userID string, creditLimit, balance Money) (snowflake.ID, error) {
+	currency := balance.Currency
+	rows, err := tx.Query(ctx, `
+SELECT id, remaining_value
+FROM debt
+WHERE user_id = $1 AND currency = $2 AND remaining_value > 0
+ORDER BY id
+FOR UPDATE`, userID, currency)
+	if err != nil {
+		return 0, fmt.Errorf("lock debt: %w", err)
+	}
+	type debtRemaining struct {
+		id        int64
+		remaining decimal.Decimal
+	}
+	var debts []debtRemaining
+	total := NewMoney(decimal.Zero, currency)
+	for rows.Next() {
+		var next debtRemaining
+		if err = rows.Scan(&next.id, &next.remaining); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("lock debt: %w", err)
+		}
+		debts = append(debts, next)
+		total = total.Add(NewMoney(next.remaining, currency))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("lock debt: %w", err)
+	}
+
+	if !total.IsPositive() {
+		return 0, nil
+	}
+
+	// constb: whatever available funds are still beyond credit limit stays owed, the rest is repaid (credit limit may
+	// have been raised since, debt covered by it is closed now too). reservations are not paid from the credit.
+	var reserved Money
+	if reserved, err = reservedCash(ctx, tx, userID, currency); err != nil {
+		return 0, err
+	}
+	repaid := total.Sub(total.Min(overLimit(balance.Sub(reserved), creditLimit)))
+	if !repaid.IsPositive() {
+		return 0, nil
+	}
+
+	// 1) CLOSE DEBTS, OLDEST FIRST
+	left := repaid.Amount
+	for _, debt := range debts {
+		if !left.IsPositive() {
+			break
+		}
+		take := decimal.Min(debt.remaining, left)
+		left = left.Sub(take)
+		_, err = tx.Exec(ctx, `
+UPDATE debt
+SET remaining_value = $2, repaid_at = CASE WHEN $2 = 0 THEN CURRENT_TIMESTAMP END
+WHERE id = $1`, debt.id, debt.remaining.Sub(take))
+		if err != nil {
+			return 0, fmt.Errorf("update debt: %w", err)
+		}
+	}
+
+	// 2) CREATE REPAYMENT TRANSACTION RECORD (wallet doesn't change, only debt is closed)
+	txID := utils.GenerateID()
+	_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
+                         sender_balance_before, sender_balance_after)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		txID.Int64(), TransactionKindRepayment, currency, repaid.Amount, userID, currency, repaid.Amount,
+		balance.Amount, balance.Amount,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("save user tx: %w", err)
+	}
+
+	// 3) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountDebt, "", repaid.Neg())
+	entries.add(LedgerAccountOverdraft, "", repaid)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, err
+	}
+
+	return txID, nil
+}
+
+// collectWalletsDebt repays debts of every locked user wallet, for when cash was released rather than credited to a
+// known wallet
+func collectWalletsDebt(ctx context.Context, tx pgx.Tx, userID string, wallets []*wallet) error {
+	for _, w := range wallets {
+		if _, err := collectDebt(ctx, tx, userID, w.creditLimit, w.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Debt struct {
+	ID            snowflake.ID
+	Value         decimal.Decimal
+	Remaining     decimal.Decimal
+	TransactionID snowflake.ID // transaction that took the wallet below zero
+	OrderID       string       // empty unless debt was caused by a charge
+	ItemID        string
+	CreatedAt     time.Time
+}
+
+type Overdraft struct {
+	UserID      string
+	Currency    string
+	Available   decimal.Decimal // cash, not reserved, below credit limit
+	CreditLimit decimal.Decimal
+	Debts       []Debt // outstanding, oldest first
+}
+
+// FetchOverdrafts returns wallets that went beyond their credit limit, ordered by user and currency, together with
+// outstanding debts.
+func (d *BalanceDatabase) FetchOverdrafts(ctx context.Context) (overdrafts []Overdraft, err error) {
+	// x) WRAP IN TRANSACTION (avoid inconsistent data with balance and debts)
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) FIND WALLETS IN OVERDRAFT (same as is_overdraft of user balance: reserved cash counts as spent)
+	var rows pgx.Rows
+	rows, err = tx.Query(ctx, `
+SELECT b.user_id, b.currency, b.current_value - COALESCE(r.cash_value, 0), b.credit_limit
+FROM balance b
+         LEFT JOIN (SELECT user_id, wallet_currency, SUM(user_currency_value - bonus_value) AS cash_value
+                    FROM balance_reserve
+                    GROUP BY user_id, wallet_currency) r ON r.user_id = b.user_id AND r.wallet_currency = b.currency
+WHERE b.current_value - COALESCE(r.cash_value, 0) < -b.credit_limit
+ORDER BY b.user_id, b.currency`)
+	if err != nil {
+		return nil, fmt.Errorf("read overdrafts: %w", err)
+	}
+	var userIDs []string
+	for rows.Next() {
+		var next Overdraft
+		if err = rows.Scan(&next.UserID, &next.Currency, &next.Available, &next.CreditLimit); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("read overdrafts: %w", err)
+		}
+		overdrafts = append(overdrafts, next)
+		if len(userIDs) == 0 || userIDs[len(userIDs)-1] != next.UserID {
+			userIDs = append(userIDs, next.UserID)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read overdrafts: %w", err)
+	}
+	if len(overdrafts) == 0 {
+		return nil, nil
+	}
+
+	// 2) GET OUTSTANDING DEBTS
+	rows, err = tx.Query(ctx, `
+SELECT id, user_id, currency, "value", remaining_value, transaction_id, COALESCE(order_id, ''), COALESCE(item_id, ''), created_at
+FROM debt
+WHERE user_id = ANY($1) AND remaining_value > 0
+ORDER BY id`, userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("read debts: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, currency string
+		var next Debt
+		if err = rows.Scan(&next.ID, &userID, &currency, &next.Value, &next.Remaining, &next.TransactionID, &next.OrderID, &next.ItemID, &next.CreatedAt); err != nil {
+			return nil, fmt.Errorf("read debts: %w", err)
+		}
+		for i := range overdrafts {
+			if overdrafts[i].UserID == userID && overdrafts[i].Currency == currency {
+				overdrafts[i].Debts = append(overdrafts[i].Debts, next)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read debts: %w", err)
+	}
+
+	return overdrafts, nil
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/constb/tt-golang/internal/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// ledger accounts as stored in ledger_entry.account column. User wallets are LedgerAccountUser and
+// LedgerAccountUserBonus with user id, the rest are system accounts.
+const (
+	LedgerAccountUser      = "user"
+	LedgerAccountUserBonus = "user_bonus" // bonus part of user wallet
+	LedgerAccountRevenue   = "revenue"    // company revenue: charges, minus refunds
+	LedgerAccountFX        = "fx"         // currency exchange gains and losses
+	LedgerAccountCashIn    = "cash_in"    // money coming from outside: top-ups
+	LedgerAccountCashOut   = "cash_out"   // money going outside: withdrawals
+	LedgerAccountPromo     = "promo"      // marketing spend: bonuses granted, minus expired ones
+	LedgerAccountDebt      = "debt"       // owed by users beyond their credit limit: debts recorded, minus repaid
+	LedgerAccountOverdraft = "overdraft"  // counterpart of debt, user wallets themselves already show the money spent
+)
+
+// ledgerEntry is a single movement of money, positive amount comes into the account, negative leaves it
+type ledgerEntry struct {
+	account  string
+	userID   string
+	currency string
+	amount   decimal.Decimal
+}
+
+// ledger collects balanced entries of one transaction: in every currency entries sum to zero
+type ledger []ledgerEntry
+
+func (l *ledger) add(account, userID string, amount Money) {
+	if amount.IsZero() {
+		return
+	}
+	*l = append(*l, ledgerEntry{account: account, userID: userID, currency: amount.Currency, amount: amount.Amount})
+}
+
+// exchange books currency conversion on FX account: it receives from and pays out to
+func (l *ledger) exchange(from, to Money) {
+	if from.Currency == to.Currency {
+		return
+	}
+	l.add(LedgerAccountFX, "", from)
+	l.add(LedgerAccountFX, "", to.Neg())
+}
+
+// check makes sure entries of every currency sum to zero
+func (l ledger) check() error {
+	sums := make(map[string]decimal.Decimal)
+	for _, entry := range l {
+		sums[entry.currency] = sums[entry.currency].Add(entry.amount)
+	}
+	for currency, sum := range sums {
+		if !sum.IsZero() {
+			return fmt.Errorf("unbalanced ledger entries: %s %s", sum.String(), currency)
+		}
+	}
+	return nil
+}
+
+// post saves entries of transaction txID, fails if they are not balanced
+func (l ledger) post(ctx context.Context, tx pgx.Tx, txID snowflake.ID) error {
+	if err := l.check(); err != nil {
+		return err
+	}
+	for _, entry := range l {
+		var userIDParam any
+		if entry.userID != "" {
+			userIDParam = entry.userID
+		}
+		_, err := tx.Exec(ctx, `
+INSERT INTO ledger_entry (id, transaction_id, account, user_id, currency, amount)
+VALUES ($1, $2, $3, $4, $5, $6)`,
+			utils.GenerateID().Int64(), txID.Int64(), entry.account, userIDParam, entry.currency, entry.amount,
+		)
+		if err != nil {
+			return fmt.Errorf("save ledger entry: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedger_check(t *testing.T) {
+	t.Parallel()
+
+	var entries ledger
+	entries.add(LedgerAccountUser, "nina", NewMoney(decimal.NewFromFloat(-9.67), "EUR"))
+	entries.exchange(NewMoney(decimal.NewFromFloat(9.67), "EUR"), NewMoney(decimal.NewFromInt(10), "USD"))
+	entries.add(LedgerAccountRevenue, "", NewMoney(decimal.NewFromInt(10), "USD"))
+	entries.add(LedgerAccountRevenue, "", NewMoney(decimal.Zero, "EUR"))
+	assert.Len(t, entries, 4)
+	assert.NoError(t, entries.check())
+
+	var sameCurrency ledger
+	sameCurrency.add(LedgerAccountCashIn, "", NewMoney(decimal.NewFromInt(-5), "EUR"))
+	sameCurrency.exchange(NewMoney(decimal.NewFromInt(5), "EUR"), NewMoney(decimal.NewFromInt(5), "EUR"))
+	sameCurrency.add(LedgerAccountUser, "nina", NewMoney(decimal.NewFromInt(5), "EUR"))
+	assert.Len(t, sameCurrency, 2)
+	assert.NoError(t, sameCurrency.check())
+
+	var unbalanced ledger
+	unbalanced.add(LedgerAccountUser, "nina", NewMoney(decimal.NewFromFloat(-9.67), "EUR"))
+	unbalanced.add(LedgerAccountRevenue, "", NewMoney(decimal.NewFromInt(10), "USD"))
+	assert.Error(t, unbalanced.check())
+}
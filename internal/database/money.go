@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// how amounts are rounded to currency minor units
+const (
+	RoundingHalfEven = "half_even" // banker's rounding, 2.125 → 2.12
+	RoundingHalfUp   = "half_up"   // half away from zero, 2.125 → 2.13
+)
+
+// Money is an amount in a currency. Amounts are kept in currency minor units: anything that may produce more digits
+// after dot (conversions, proportional shares) rounds its result.
+type Money struct {
+	Amount   decimal.Decimal
+	Currency string
+}
+
+// NewMoney makes money from amount as is, without rounding
+func NewMoney(amount decimal.Decimal, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// ParseMoney parses amount in given currency. Currency must be valid and amount can't have more digits after dot
+// than currency has minor units.
+func ParseMoney(value, currency string) (Money, error) {
+	if !IsCurrencyValid(currency) {
+		return Money{}, fmt.Errorf("unknown currency %q", currency)
+	}
+	amount, err := decimal.NewFromString(value)
+	if err != nil {
+		return Money{}, err
+	}
+	m := NewMoney(amount, currency)
+	if !m.IsMinorUnits() {
+		return Money{}, fmt.Errorf("%s has at most %d digits after dot", currency, CurrencyPrecision(currency))
+	}
+	return m, nil
+}
+
+// Round rounds amount to currency minor units according to rounding policy
+func (m Money) Round(policy string) Money {
+	precision := CurrencyPrecision(m.Currency)
+	if policy == RoundingHalfUp {
+		return NewMoney(m.Amount.Round(precision), m.Currency)
+	}
+	return NewMoney(m.Amount.RoundBank(precision), m.Currency)
+}
+
+// IsMinorUnits tells if amount has no more digits after dot than currency has minor units
+func (m Money) IsMinorUnits() bool {
+	return m.Amount.Truncate(CurrencyPrecision(m.Currency)).Equal(m.Amount)
+}
+
+// Add sums amounts of the same currency. Adding another currency is a bug and panics, like division by zero does.
+func (m Money) Add(o Money) Money {
+	if m.Currency != o.Currency {
+		panic(fmt.Sprintf("add %s to %s", o.Currency, m.Currency))
+	}
+	return NewMoney(m.Amount.Add(o.Amount), m.Currency)
+}
+
+// Sub subtracts amount of the same currency, panics on another currency
+func (m Money) Sub(o Money) Money {
+	if m.Currency != o.Currency {
+		panic(fmt.Sprintf("subtract %s from %s", o.Currency, m.Currency))
+	}
+	return NewMoney(m.Amount.Sub(o.Amount), m.Currency)
+}
+
+func (m Money) Neg() Money {
+	return NewMoney(m.Amount.Neg(), m.Currency)
+}
+
+func (m Money) IsPositive() bool {
+	return m.Amount.IsPositive()
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount.IsNegative()
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount.IsZero()
+}
+
+// Equal compares amounts of the same currency, panics on another currency
+func (m Money) Equal(o Money) bool {
+	return m.Sub(o).IsZero()
+}
+
+// GreaterThan compares amounts of the same currency, panics on another currency
+func (m Money) GreaterThan(o Money) bool {
+	return m.Sub(o).IsPositive()
+}
+
+// Min is the smaller of amounts of the same currency
+func (m Money) Min(o Money) Money {
+	if m.GreaterThan(o) {
+		return o
+	}
+	return m
+}
+
+// Convert converts money to another currency at given rate (how much of "to" is one unit of money currency),
+// rounded according to policy
+func (m Money) Convert(rate decimal.Decimal, to, policy string) Money {
+	return NewMoney(m.Amount.Mul(rate), to).Round(policy)
+}
+
+// Share is part/whole of money, rounded according to policy. Multiplies first, so that no precision is lost on
+// division.
+func (m Money) Share(part, whole decimal.Decimal, policy string) Money {
+	return NewMoney(m.Amount.Mul(part).Div(whole), m.Currency).Round(policy)
+}
+
+// String formats amount with exactly as many digits after dot as currency has minor units. Amounts are expected to
+// be rounded already, anything finer is shown rounded half to even.
+func (m Money) String() string {
+	return m.Amount.StringFixedBank(CurrencyPrecision(m.Currency))
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/constb/tt-golang/internal/proto"
@@ -14,8 +15,35 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-func (d *BalanceDatabase) initUserBalance(ctx context.Context, userID string, currency string) error {
-	_, err := d.db.Exec(ctx, `INSERT INTO balance (user_id, currency, current_value) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+// transaction kinds as stored in "transaction".kind column
+const (
+	TransactionKindTopUp       = "top_up"
+	TransactionKindCharge      = "charge"
+	TransactionKindTransfer    = "transfer"
+	TransactionKindRefund      = "refund"
+	TransactionKindWithdrawal  = "withdrawal"
+	TransactionKindBonus       = "bonus"          // promotional funds credited to bonus part of the wallet
+	TransactionKindBonusExpiry = "bonus_expiry"   // expired bonus written off
+	TransactionKindReversal    = "reversal"       // top-up taken back, e.g. chargeback
+	TransactionKindRepayment   = "debt_repayment" // part of a credit that covered debt, balance is not changed by it
+)
+
+// transaction statuses as stored in "transaction".status column, only top-ups may be pending
+const (
+	TransactionStatusPending   = "pending"   // funds are not settled yet and can't be spent
+	TransactionStatusCompleted = "completed" // final, except completed top-ups may be reversed
+	TransactionStatusFailed    = "failed"    // pending funds never arrived
+	TransactionStatusReversed  = "reversed"  // top-up was taken back by a reversal transaction
+)
+
+// execer is either connection pool or an open transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// initUserBalance creates empty user wallet in given currency if it does not exist yet
+func initUserBalance(ctx context.Context, db execer, userID string, currency string) error {
+	_, err := db.Exec(ctx, `INSERT INTO balance (user_id, currency, current_value) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
 		userID, currency, 0,
 	)
 	if err != nil {
@@ -24,30 +52,257 @@ func (d *BalanceDatabase) initUserBalance(ctx context.Context, userID string, cu
 	return nil
 }
 
-func (d *BalanceDatabase) TopUp(ctx context.Context, idempotencyKey, userID, currency, value, merchantData string) (snowflake.ID, error) {
-	if idempotencyKey == "" {
-		return 0, proto.NewBadParameterError("idempotency key")
+// account statuses as stored in account_status.status column
+const (
+	AccountStatusActive  = "active"
+	AccountStatusFrozen  = "frozen"  // money can come in, but can't go out
+	AccountStatusBlocked = "blocked" // no operations at all
+)
+
+// checkAccountStatus rejects operation if user account is blocked, or if it is frozen and operation takes money from
+// it. Call it after user wallets are locked, so status can't change until transaction ends.
+func checkAccountStatus(ctx context.Context, tx pgx.Tx, userID string, debit bool) error {
+	var status string
+	row := tx.QueryRow(ctx, "SELECT status FROM account_status WHERE user_id = $1 ORDER BY id DESC LIMIT 1", userID)
+	if err := row.Scan(&status); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("read account status: %w", err)
 	}
-	if userID == "" {
-		return 0, proto.NewBadParameterError("user id")
+	if status == AccountStatusBlocked || (status == AccountStatusFrozen && debit) {
+		return proto.NewAccountFrozenError(status)
 	}
-	if !IsCurrencyValid(currency) {
-		return 0, proto.NewBadParameterError("currency")
+	return nil
+}
+
+// wallet is one of user's per-currency balances, all amounts are in wallet currency
+type wallet struct {
+	currency      string
+	value         Money // cash
+	bonus         Money // promotional funds, can only be spent on charges
+	creditLimit   Money // how far below zero reservations and charges may take the wallet
+	reserved      Money // sum of reservations held in this wallet, cash and bonus
+	reservedBonus Money // bonus part of reservations
+}
+
+func newWallet(currency string, value, bonus, creditLimit decimal.Decimal) *wallet {
+	return &wallet{
+		currency:      currency,
+		value:         NewMoney(value, currency),
+		bonus:         NewMoney(bonus, currency),
+		creditLimit:   NewMoney(creditLimit, currency),
+		reserved:      NewMoney(decimal.Zero, currency),
+		reservedBonus: NewMoney(decimal.Zero, currency),
 	}
-	topUpValue, err := decimal.NewFromString(value)
-	if err != nil || topUpValue.LessThanOrEqual(decimal.Zero) {
-		return 0, proto.NewBadParameterError("value")
+}
+
+// available is cash that is not reserved
+func (w *wallet) available() Money {
+	return w.value.Sub(w.reserved.Sub(w.reservedBonus))
+}
+
+// bonusAvailable is bonus that is not reserved
+func (w *wallet) bonusAvailable() Money {
+	return w.bonus.Sub(w.reservedBonus)
+}
+
+// spendable is available cash, plus bonus and credit for reservations and charges
+func (w *wallet) spendable(charge bool) Money {
+	if charge {
+		return w.available().Add(w.bonusAvailable()).Add(w.creditLimit)
 	}
-	if merchantData != "" && !json.Valid([]byte(merchantData)) {
-		return 0, proto.NewBadParameterError("merchant data")
+	return w.available()
+}
+
+func lockUserWallets(ctx context.Context, tx pgx.Tx, userIDs ...string) (map[string][]*wallet, error) {
+	rows, err := tx.Query(ctx, "SELECT user_id, currency, current_value, bonus_value, credit_limit FROM balance WHERE user_id = ANY($1) ORDER BY user_id, currency FOR UPDATE",
+		userIDs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("lock balance: %w", err)
+	}
+	wallets := make(map[string][]*wallet, len(userIDs))
+	for rows.Next() {
+		var userID, currency string
+		var value, bonus, creditLimit decimal.Decimal
+		if err = rows.Scan(&userID, &currency, &value, &bonus, &creditLimit); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("lock balance: %w", err)
+		}
+		wallets[userID] = append(wallets[userID], newWallet(currency, value, bonus, creditLimit))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("lock balance: %w", err)
 	}
 
-	// 1) CREATE ZERO BALANCE IF NOT EXISTS
-	err = d.initUserBalance(ctx, userID, currency)
+	rows, err = tx.Query(ctx, "SELECT user_id, wallet_currency, SUM(user_currency_value), SUM(bonus_value) FROM balance_reserve WHERE user_id = ANY($1) GROUP BY user_id, wallet_currency",
+		userIDs,
+	)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("read reserve: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, currency string
+		var reserved, reservedBonus decimal.Decimal
+		if err = rows.Scan(&userID, &currency, &reserved, &reservedBonus); err != nil {
+			return nil, fmt.Errorf("read reserve: %w", err)
+		}
+		if w := findWallet(wallets[userID], currency); w != nil {
+			w.reserved, w.reservedBonus = NewMoney(reserved, currency), NewMoney(reservedBonus, currency)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read reserve: %w", err)
+	}
+
+	return wallets, nil
+}
+
+func findWallet(wallets []*wallet, currency string) *wallet {
+	for _, w := range wallets {
+		if w.currency == currency {
+			return w
+		}
+	}
+	return nil
+}
+
+// pickWallet chooses wallet to debit value from and converts value to wallet currency (multiplied by per-pair buffer
+// when converted and buffered is set). Wallet in the same currency is used if it has enough spendable funds,
+// otherwise, if conversion fallback is enabled, the first wallet that has enough. If none has enough, the same
+// currency wallet (or the first one when falling back) is returned anyway and caller decides what to do. Returns nil
+// wallet if there is nothing to debit. Applied conversion (without buffer) is returned as well, zero if value was not
+// converted.
+func (d *BalanceDatabase) pickWallet(wallets []*wallet, value Money, buffered, charge bool) (*wallet, Money, conversion, error) {
+	sameCurrency := findWallet(wallets, value.Currency)
+	if sameCurrency != nil && !value.GreaterThan(sameCurrency.spendable(charge)) {
+		return sameCurrency, value, conversion{}, nil
+	}
+	if !d.conversionFallback {
+		return sameCurrency, value, conversion{}, nil
+	}
+
+	// constb: all wallets are tried with the same rates, even if they are refreshed meanwhile
+	rates := rateSet()
+	var first *wallet
+	var firstValue Money
+	var firstConversion conversion
+	for _, w := range wallets {
+		if w == sameCurrency {
+			continue
+		}
+		conv, err := rates.conversion(value.Currency, w.currency)
+		if err != nil {
+			return nil, Money{}, conversion{}, fmt.Errorf("currency convert: %w", err)
+		}
+		convertRate := conv.rate
+		if buffered {
+			convertRate = convertRate.Mul(d.conversionBuffer(value.Currency, w.currency))
+		}
+		// constb: round right away, so that balances and ledger entries move by exactly the same amount
+		converted := value.Convert(convertRate, w.currency, d.roundingPolicy)
+		if !converted.GreaterThan(w.spendable(charge)) {
+			return w, converted, conv, nil
+		}
+		if first == nil {
+			first, firstValue, firstConversion = w, converted, conv
+		}
+	}
+	if sameCurrency != nil {
+		return sameCurrency, value, conversion{}, nil
+	}
+	return first, firstValue, firstConversion, nil
+}
+
+// idempotencyParams describe operation being retried, empty fields are not checked (except pending of top-ups)
+type idempotencyParams struct {
+	kind        string
+	senderID    string
+	recipientID string
+	value       Money // currency and value, zero value is not checked
+	orderID     string
+	itemID      string
+	pending     bool // top-up was made pending, to be settled later
+}
+
+// findIdempotentTransaction looks up transaction made earlier with the same idempotency key. Returns zero id if key
+// is not used yet, IdempotencyConflictError if transaction was made with different parameters.
+func findIdempotentTransaction(ctx context.Context, tx pgx.Tx, idempotencyKey string, params idempotencyParams) (snowflake.ID, error) {
+	var txID snowflake.ID
+	var kind, currency string
+	var senderID, recipientID, orderID, itemID *string
+	var value decimal.Decimal
+	var pending bool
+
+	row := tx.QueryRow(ctx, `
+SELECT id, kind, sender_id, recipient_id, transaction_currency, transaction_value,
+       (order_data ->> 'order_id'), (order_data ->> 'item_id'), pending_top_up
+FROM transaction
+WHERE idempotency_key = $1`, idempotencyKey)
+	if err := row.Scan(&txID, &kind, &senderID, &recipientID, &currency, &value, &orderID, &itemID, &pending); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("idempotency check: %w", err)
+	}
+
+	switch {
+	case kind != params.kind:
+		return 0, proto.NewIdempotencyConflictError("idempotency key")
+	case params.senderID != "" && (senderID == nil || *senderID != params.senderID):
+		return 0, proto.NewIdempotencyConflictError("user id")
+	case params.recipientID != "" && (recipientID == nil || *recipientID != params.recipientID):
+		if kind == TransactionKindTransfer {
+			return 0, proto.NewIdempotencyConflictError("recipient id")
+		}
+		if kind == TransactionKindCharge {
+			return 0, proto.NewIdempotencyConflictError("seller id")
+		}
+		return 0, proto.NewIdempotencyConflictError("user id")
+	case params.value.Currency != "" && currency != params.value.Currency:
+		return 0, proto.NewIdempotencyConflictError("currency")
+	case !params.value.IsZero() && !value.Equal(params.value.Amount):
+		return 0, proto.NewIdempotencyConflictError("value")
+	case params.orderID != "" && (orderID == nil || *orderID != params.orderID):
+		return 0, proto.NewIdempotencyConflictError("order id")
+	case params.itemID != "" && (itemID == nil || *itemID != params.itemID):
+		return 0, proto.NewIdempotencyConflictError("item id")
+	case kind == TransactionKindTopUp && pending != params.pending:
+		// constb: settled pending top-up looks like a completed one, so it is told by the flag, not by status
+		return 0, proto.NewIdempotencyConflictError("pending")
+	}
+
+	return txID, nil
+}
+
+func (d *BalanceDatabase) TopUp(ctx context.Context, idempotencyKey, userID, currency, value, merchantData string) (txID snowflake.ID, err error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	return d.topUp(ctx, tx, idempotencyKey, userID, currency, value, merchantData, false)
+}
 
+// TopUpPending is TopUp of funds that are not settled yet: they are shown as pending and can't be spent until
+// SettleTopUp is called, or are dropped by FailTopUp.
+func (d *BalanceDatabase) TopUpPending(ctx context.Context, idempotencyKey, userID, currency, value, merchantData string) (txID snowflake.ID, err error) {
 	// x) WRAP IN TRANSACTION
 	conn, err := d.db.Acquire(ctx)
 	if err != nil {
@@ -66,84 +321,147 @@ func (d *BalanceDatabase) TopUp(ctx context.Context, idempotencyKey, userID, cur
 		}
 	}()
 
-	// 2) LOAD BALANCE AND LOCK FOR UPDATE
-	var balanceCurrency string
-	var balanceCurrentValue decimal.Decimal
+	return d.topUp(ctx, tx, idempotencyKey, userID, currency, value, merchantData, true)
+}
+
+// topUp is TopUp within an open transaction
+func (d *BalanceDatabase) topUp(ctx context.Context, tx pgx.Tx, idempotencyKey, userID, currency, value, merchantData string, pending bool) (snowflake.ID, error) {
+	if idempotencyKey == "" {
+		return 0, proto.NewBadParameterError("idempotency key")
+	}
+	if userID == "" {
+		return 0, proto.NewBadParameterError("user id")
+	}
+	if !IsCurrencyValid(currency) {
+		return 0, proto.NewBadParameterError("currency")
+	}
+	topUpValue, err := ParseMoney(value, currency)
+	if err != nil || !topUpValue.IsPositive() {
+		return 0, proto.NewBadParameterError("value")
+	}
+	if merchantData != "" && !json.Valid([]byte(merchantData)) {
+		return 0, proto.NewBadParameterError("merchant data")
+	}
+
+	// 1) CREATE ZERO WALLET IF NOT EXISTS
+	// constb: blocked users don't get new wallets. status is checked again below, once wallet is locked
+	if err = checkAccountStatus(ctx, tx, userID, false); err != nil {
+		return 0, err
+	}
+	err = initUserBalance(ctx, tx, userID, currency)
+	if err != nil {
+		return 0, err
+	}
+
+	// 2) LOAD WALLET IN TOP-UP CURRENCY AND LOCK FOR UPDATE
+	// constb: top-ups always land in the wallet of the same currency, nothing to convert
+	var currentValue, pendingValue, creditLimit decimal.Decimal
 
-	row := tx.QueryRow(ctx, "SELECT currency, current_value FROM balance WHERE user_id = $1 FOR UPDATE", userID)
-	if err = row.Scan(&balanceCurrency, &balanceCurrentValue); err != nil {
+	row := tx.QueryRow(ctx, "SELECT current_value, pending_value, credit_limit FROM balance WHERE user_id = $1 AND currency = $2 FOR UPDATE", userID, currency)
+	if err = row.Scan(&currentValue, &pendingValue, &creditLimit); err != nil {
 		return 0, fmt.Errorf("lock balance: %w", err)
 	}
+	balanceCurrentValue := NewMoney(currentValue, currency)
+	balancePendingValue := NewMoney(pendingValue, currency)
+	balanceCreditLimit := NewMoney(creditLimit, currency)
 
 	// x) IDEMPOTENCY CHECK
 	var txID snowflake.ID
-	row = tx.QueryRow(ctx, `SELECT id FROM transaction WHERE idempotency_key = $1`, idempotencyKey)
-	if err = row.Scan(&txID); err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		return 0, fmt.Errorf("idempotency check: %w", err)
+	txID, err = findIdempotentTransaction(ctx, tx, idempotencyKey, idempotencyParams{
+		kind:        TransactionKindTopUp,
+		recipientID: userID,
+		value:       topUpValue,
+		pending:     pending,
+	})
+	if err != nil {
+		return 0, err
 	}
 	if txID != 0 {
 		// constb: transaction already was processed earlier, continue as if we have applied it now
 		return txID, nil
 	}
 
-	// 3) CONVERT CURRENCIES IF NEEDED
-	var topUpInUserCurrency decimal.Decimal
-	if currency == balanceCurrency {
-		topUpInUserCurrency = topUpValue
-	} else {
-		topUpInUserCurrency, err = ConvertCurrency(topUpValue, currency, balanceCurrency)
-		if err != nil {
-			return 0, fmt.Errorf("currency convert: %w", err)
-		}
+	// x) CHECK ACCOUNT STATUS
+	if err = checkAccountStatus(ctx, tx, userID, false); err != nil {
+		return 0, err
 	}
 
-	balanceNewValue := balanceCurrentValue.Add(topUpInUserCurrency)
+	balanceNewValue := balanceCurrentValue.Add(topUpValue)
+	status := TransactionStatusCompleted
+	if pending {
+		// constb: balance doesn't change until settled, balance before and after are updated then
+		balanceNewValue = balanceCurrentValue
+		status = TransactionStatusPending
+	}
 
-	// 4) CREATE TRANSACTION RECORD AND TOP-UP BALANCE
+	// 3) CREATE TRANSACTION RECORD AND TOP-UP BALANCE (or pending funds)
 	txID = utils.GenerateID()
 	var merchantDataParam any
 	if merchantData != "" {
 		merchantDataParam = merchantData
 	}
 	_, err = tx.Exec(ctx, `
-INSERT INTO transaction (id, transaction_currency, transaction_value, recipient_id, recipient_currency, recipient_value,
-                         recipient_balance_before, recipient_balance_after, merchant_data, idempotency_key)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
-		txID.Int64(), currency, topUpValue, userID, balanceCurrency, topUpInUserCurrency,
-		balanceCurrentValue, balanceNewValue, merchantDataParam, idempotencyKey,
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, recipient_id, recipient_currency, recipient_value,
+                         recipient_balance_before, recipient_balance_after, merchant_data, idempotency_key, status,
+                         pending_top_up)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		txID.Int64(), TransactionKindTopUp, currency, topUpValue.Amount, userID, currency, topUpValue.Amount,
+		balanceCurrentValue.Amount, balanceNewValue.Amount, merchantDataParam, idempotencyKey, status,
+		pending,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("save user tx: %w", err)
 	}
-	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $2 WHERE user_id = $1`,
-		userID, balanceNewValue,
+	if pending {
+		_, err = tx.Exec(ctx, `UPDATE balance SET pending_value = $3 WHERE user_id = $1 AND currency = $2`,
+			userID, currency, balancePendingValue.Add(topUpValue).Amount,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("update balance: %w", err)
+		}
+		// constb: nothing has moved yet, ledger entries are posted on settlement
+		return txID, nil
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+		userID, currency, balanceNewValue.Amount,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("update balance: %w", err)
 	}
 
+	// 4) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountCashIn, "", topUpValue.Neg())
+	entries.add(LedgerAccountUser, userID, topUpValue)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, err
+	}
+
+	// 5) COLLECT DEBT
+	if _, err = collectDebt(ctx, tx, userID, balanceCreditLimit, balanceNewValue); err != nil {
+		return 0, err
+	}
+
 	return txID, nil
 }
 
-func (d *BalanceDatabase) Reserve(ctx context.Context, userID, currency, value, orderID, itemID string) error {
+// SettleTopUp moves funds of a pending top-up to user balance. Settling a settled top-up is a no-op.
+func (d *BalanceDatabase) SettleTopUp(ctx context.Context, userID, idempotencyKey string) error {
+	return d.finishPendingTopUp(ctx, userID, idempotencyKey, TransactionStatusCompleted)
+}
+
+// FailTopUp drops funds of a pending top-up. Failing a failed top-up is a no-op.
+func (d *BalanceDatabase) FailTopUp(ctx context.Context, userID, idempotencyKey string) error {
+	return d.finishPendingTopUp(ctx, userID, idempotencyKey, TransactionStatusFailed)
+}
+
+// finishPendingTopUp moves pending top-up into its final status
+func (d *BalanceDatabase) finishPendingTopUp(ctx context.Context, userID, idempotencyKey, status string) (err error) {
 	if userID == "" {
 		return proto.NewBadParameterError("user id")
 	}
-	if !IsCurrencyValid(currency) {
-		return proto.NewBadParameterError("currency")
-	}
-	reserveValue, err := decimal.NewFromString(value)
-	if err != nil || reserveValue.LessThanOrEqual(decimal.Zero) {
-		return proto.NewBadParameterError("value")
-	}
-	if orderID == "" {
-		return proto.NewBadParameterError("order id")
-	}
-
-	// 1) CREATE ZERO BALANCE IF NOT EXISTS
-	err = d.initUserBalance(ctx, userID, currency)
-	if err != nil {
-		return err
+	if idempotencyKey == "" {
+		return proto.NewBadParameterError("idempotency key")
 	}
 
 	// x) WRAP IN TRANSACTION
@@ -164,111 +482,105 @@ func (d *BalanceDatabase) Reserve(ctx context.Context, userID, currency, value,
 		}
 	}()
 
-	// 2) LOAD BALANCE AND LOCK FOR UPDATE
-	var balanceCurrency string
-	var balanceCurrentValue decimal.Decimal
-
-	row := tx.QueryRow(ctx, "SELECT currency, current_value FROM balance WHERE user_id = $1 FOR UPDATE", userID)
-	if err = row.Scan(&balanceCurrency, &balanceCurrentValue); err != nil {
-		return fmt.Errorf("lock balance: %w", err)
+	// 1) FIND TOP-UP
+	var txID snowflake.ID
+	var currency string
+	row := tx.QueryRow(ctx, `
+SELECT id, recipient_currency FROM transaction WHERE idempotency_key = $1 AND kind = $2 AND recipient_id = $3 AND pending_top_up`,
+		idempotencyKey, TransactionKindTopUp, userID)
+	if err = row.Scan(&txID, &currency); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = proto.NewBadParameterError("idempotency key")
+			return err
+		}
+		return fmt.Errorf("find top-up: %w", err)
 	}
 
-	// 3) SUM EXISTING USER RESERVES
-	var userAlreadyReserved decimal.NullDecimal
-	row = tx.QueryRow(ctx, "SELECT SUM(user_currency_value) FROM balance_reserve WHERE user_id = $1", userID)
-	if err = row.Scan(&userAlreadyReserved); err != nil {
-		return fmt.Errorf("read reserve: %w", err)
+	// 2) LOCK WALLET, THEN TOP-UP
+	// constb: same order as every other operation, wallet first
+	var currentValue, pendingValue, creditLimit decimal.Decimal
+	row = tx.QueryRow(ctx, "SELECT current_value, pending_value, credit_limit FROM balance WHERE user_id = $1 AND currency = $2 FOR UPDATE", userID, currency)
+	if err = row.Scan(&currentValue, &pendingValue, &creditLimit); err != nil {
+		return fmt.Errorf("lock balance: %w", err)
 	}
-
-	// x) IDEMPOTENCY CHECK
-	var orderReserve, orderTx int
-	row = tx.QueryRow(ctx, "SELECT COUNT(*) FROM balance_reserve WHERE user_id = $1 AND order_id = $2", userID, orderID)
-	if err = row.Scan(&orderReserve); err != nil {
-		return fmt.Errorf("read reserve: %w", err)
+	balanceCurrentValue := NewMoney(currentValue, currency)
+	balancePendingValue := NewMoney(pendingValue, currency)
+	balanceCreditLimit := NewMoney(creditLimit, currency)
+	var currentStatus string
+	var topUpValue decimal.Decimal
+	row = tx.QueryRow(ctx, "SELECT status, recipient_value FROM transaction WHERE id = $1 FOR UPDATE", txID.Int64())
+	if err = row.Scan(&currentStatus, &topUpValue); err != nil {
+		return fmt.Errorf("lock top-up: %w", err)
 	}
-	if orderReserve > 0 {
-		// constb: pretend we have successfully processed this reservation
-		// do we need to check other parameters too? like item id? reserved value?
+	value := NewMoney(topUpValue, currency)
+	if currentStatus == status {
 		return nil
 	}
-	row = tx.QueryRow(ctx, "SELECT COUNT(*) FROM transaction WHERE order_data->>'order_id' = $1", orderID)
-	if err = row.Scan(&orderTx); err != nil {
-		return fmt.Errorf("read tx: %w", err)
-	}
-	if orderTx > 0 {
-		// constb: reserving money for already committed transaction? definitely an error!
-		// important: set err to Rollback transaction
+	if currentStatus != TransactionStatusPending {
 		err = proto.NewInvalidStateError()
 		return err
 	}
 
-	// 4) CONVERT CURRENCIES IF NEEDED
-	var reserveInUserCurrency decimal.Decimal
-	if currency == balanceCurrency {
-		reserveInUserCurrency = reserveValue
-	} else {
-		reserveInUserCurrency, err = ConvertCurrency(
-			// constb: reserve extra 6% to compensate for possible rate changes
-			reserveValue.Mul(decimal.NewFromFloat(1.06)),
-			currency,
-			balanceCurrency,
-		)
-		if err != nil {
-			return fmt.Errorf("currency convert: %w", err)
+	// x) CHECK ACCOUNT STATUS (funds can't land in a blocked account, failing top-up moves nothing)
+	if status == TransactionStatusCompleted {
+		if err = checkAccountStatus(ctx, tx, userID, false); err != nil {
+			return err
 		}
 	}
 
-	// 5) CHECK IF USER HAS ENOUGH MONEY
-	if userAlreadyReserved.Valid {
-		balanceCurrentValue = balanceCurrentValue.Sub(userAlreadyReserved.Decimal)
-	}
-	if reserveInUserCurrency.GreaterThan(balanceCurrentValue) {
-		return proto.NewNotEnoughMoneyError()
+	// 3) UPDATE TRANSACTION STATUS AND BALANCE
+	balanceNewValue := balanceCurrentValue
+	if status == TransactionStatusCompleted {
+		balanceNewValue = balanceCurrentValue.Add(value)
 	}
-
-	// 6) CREATE RESERVATION
 	_, err = tx.Exec(ctx, `
-INSERT INTO balance_reserve (order_id, user_id, item_id, currency, "value", user_currency_value)
-VALUES ($1, $2, $3, $4, $5, $6)`,
-		orderID, userID, itemID, currency, reserveValue, reserveInUserCurrency,
+UPDATE transaction SET status = $2, recipient_balance_before = $3, recipient_balance_after = $4 WHERE id = $1`,
+		txID.Int64(), status, balanceCurrentValue.Amount, balanceNewValue.Amount,
 	)
 	if err != nil {
-		return fmt.Errorf("save reservation: %w", err)
-	}
-
-	return nil
-}
-
-func (d *BalanceDatabase) CommitReservation(ctx context.Context, userID, currency, value, orderID, itemID string) (snowflake.ID, error) {
-	if userID == "" {
-		return 0, proto.NewBadParameterError("user id")
+		return fmt.Errorf("update user tx: %w", err)
 	}
-	if !IsCurrencyValid(currency) {
-		return 0, proto.NewBadParameterError("currency")
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3, pending_value = $4 WHERE user_id = $1 AND currency = $2`,
+		userID, currency, balanceNewValue.Amount, balancePendingValue.Sub(value).Amount,
+	)
+	if err != nil {
+		return fmt.Errorf("update balance: %w", err)
 	}
-	commitValue, err := decimal.NewFromString(value)
-	if err != nil || commitValue.LessThanOrEqual(decimal.Zero) {
-		return 0, proto.NewBadParameterError("value")
+	if status != TransactionStatusCompleted {
+		return nil
 	}
-	if orderID == "" {
-		return 0, proto.NewBadParameterError("order id")
+
+	// 4) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountCashIn, "", value.Neg())
+	entries.add(LedgerAccountUser, userID, value)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return err
 	}
 
-	// 1) CREATE ZERO BALANCE IF NOT EXISTS
-	err = d.initUserBalance(ctx, userID, currency)
-	if err != nil {
-		return 0, err
+	// 5) COLLECT DEBT
+	_, err = collectDebt(ctx, tx, userID, balanceCreditLimit, balanceNewValue)
+	return err
+}
+
+// Reverse takes back completed top-up found by its id or, if id is zero, by its idempotency key. Reversal is never
+// rejected for lack of funds: wallet goes below zero and whatever available funds (reserved cash counts as spent) go
+// beyond credit limit is user's debt. Reversing a reversed top-up returns the existing reversal. Returns reversal
+// transaction id and id of the user.
+func (d *BalanceDatabase) Reverse(ctx context.Context, topUpID snowflake.ID, idempotencyKey string) (txID snowflake.ID, userID string, err error) {
+	if topUpID == 0 && idempotencyKey == "" {
+		return 0, "", proto.NewBadParameterError("transaction id")
 	}
 
 	// x) WRAP IN TRANSACTION
 	conn, err := d.db.Acquire(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("acquire connection: %w", err)
+		return 0, "", fmt.Errorf("acquire connection: %w", err)
 	}
 	defer conn.Release()
 	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return 0, fmt.Errorf("begin tx: %w", err)
+		return 0, "", fmt.Errorf("begin tx: %w", err)
 	}
 	defer func() {
 		if err != nil {
@@ -278,90 +590,103 @@ func (d *BalanceDatabase) CommitReservation(ctx context.Context, userID, currenc
 		}
 	}()
 
-	// 2) LOAD BALANCE AND LOCK FOR UPDATE
-	var balanceCurrency string
-	var balanceCurrentValue decimal.Decimal
-
-	row := tx.QueryRow(ctx, "SELECT currency, current_value FROM balance WHERE user_id = $1 FOR UPDATE", userID)
-	if err = row.Scan(&balanceCurrency, &balanceCurrentValue); err != nil {
-		return 0, fmt.Errorf("lock balance: %w", err)
-	}
-
-	// x) IDEMPOTENCY CHECK
-	var txID snowflake.ID
-	row = tx.QueryRow(ctx, "SELECT id FROM transaction WHERE order_data->>'order_id' = $1", orderID)
-	if err = row.Scan(&txID); err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		return 0, fmt.Errorf("locate transaction: %w", err)
+	// 1) FIND TOP-UP
+	var kind, currency string
+	var recipientID *string
+	row := tx.QueryRow(ctx, `
+SELECT id, kind, recipient_id, recipient_currency FROM transaction WHERE ($1 <> 0 AND id = $1) OR ($1 = 0 AND idempotency_key = $2)`,
+		topUpID.Int64(), idempotencyKey)
+	if err = row.Scan(&topUpID, &kind, &recipientID, &currency); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = proto.NewBadParameterError("transaction id")
+			return 0, "", err
+		}
+		return 0, "", fmt.Errorf("find top-up: %w", err)
 	}
-	if txID > 0 {
-		// constb: pretend we have successfully committed this reservation
-		// do we need to check other parameters too? like user id? currency and value?
-		return txID, nil
+	if kind != TransactionKindTopUp || recipientID == nil {
+		err = proto.NewBadParameterError("transaction id")
+		return 0, "", err
 	}
+	userID = *recipientID
 
-	// 3) DELETE RESERVATION IF WAS PREVIOUSLY MADE
-	var res pgconn.CommandTag
-	res, err = tx.Exec(ctx, `DELETE FROM balance_reserve WHERE order_id = $1`, orderID)
+	// 2) LOCK WALLETS, THEN TOP-UP
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, userID)
 	if err != nil {
-		return 0, fmt.Errorf("delete reservation: %w", err)
+		return 0, "", err
+	}
+	userWallet := findWallet(wallets[userID], currency)
+	if userWallet == nil {
+		return 0, "", fmt.Errorf("top-up %d wallet %s not found", topUpID.Int64(), currency)
 	}
-	previouslyReserved := res.RowsAffected() > 0
+	var status string
+	var topUpValue decimal.Decimal
+	row = tx.QueryRow(ctx, "SELECT status, recipient_value FROM transaction WHERE id = $1 FOR UPDATE", topUpID.Int64())
+	if err = row.Scan(&status, &topUpValue); err != nil {
+		return 0, "", fmt.Errorf("lock top-up: %w", err)
+	}
+	value := NewMoney(topUpValue, currency)
 
-	// 4) CALCULATE ACTUAL TRANSACTION VALUE
-	var commitInUserCurrency decimal.Decimal
-	if currency == balanceCurrency {
-		commitInUserCurrency = commitValue
-	} else {
-		commitInUserCurrency, err = ConvertCurrency(commitValue, currency, balanceCurrency)
-		if err != nil {
-			return 0, fmt.Errorf("currency convert: %w", err)
+	// x) IDEMPOTENCY CHECK
+	switch status {
+	case TransactionStatusReversed:
+		// constb: top-up already was reversed earlier, continue as if we have reversed it now
+		row = tx.QueryRow(ctx, "SELECT id FROM transaction WHERE reversal_of = $1", topUpID.Int64())
+		if err = row.Scan(&txID); err != nil {
+			return 0, "", fmt.Errorf("find reversal: %w", err)
 		}
+		return txID, userID, nil
+	case TransactionStatusCompleted:
+	default:
+		// constb: pending top-up is failed, not reversed
+		err = proto.NewInvalidStateError()
+		return 0, "", err
 	}
 
-	balanceNewValue := balanceCurrentValue.Sub(commitInUserCurrency)
-
-	if balanceNewValue.LessThan(decimal.Zero) && (currency == balanceCurrency || !previouslyReserved) {
-		// constb only allow overdraft on reservations in different currency, otherwise generate error
-		// important: set err to Rollback transaction
-		err = proto.NewNotEnoughMoneyError()
-		return 0, err
-	}
+	// constb: no funds check, whatever goes below zero is user's debt (reserved money is still owed to the merchant)
+	balanceNewValue := userWallet.value.Sub(value)
 
-	// 5) CREATE TRANSACTION RECORD AND CHARGE FROM BALANCE
+	// 3) CREATE REVERSAL RECORD, MARK TOP-UP REVERSED AND CHARGE FROM BALANCE
 	txID = utils.GenerateID()
-	var orderDataParam []byte
-	orderDataParam, err = json.Marshal(struct {
-		OrderID string `json:"order_id"`
-		ItemID  string `json:"item_id,omitempty"`
-	}{orderID, itemID})
 	_, err = tx.Exec(ctx, `
-INSERT INTO transaction (id, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
-                         sender_balance_before, sender_balance_after, order_data)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
-		txID.Int64(), currency, commitValue, userID, balanceCurrency, commitInUserCurrency,
-		balanceCurrentValue, balanceNewValue, orderDataParam,
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
+                         sender_balance_before, sender_balance_after, reversal_of)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		txID.Int64(), TransactionKindReversal, currency, value.Amount, userID, currency, value.Amount,
+		userWallet.value.Amount, balanceNewValue.Amount, topUpID.Int64(),
 	)
 	if err != nil {
-		return 0, fmt.Errorf("save user tx: %w", err)
+		return 0, "", fmt.Errorf("save user tx: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE transaction SET status = $2 WHERE id = $1`, topUpID.Int64(), TransactionStatusReversed)
+	if err != nil {
+		return 0, "", fmt.Errorf("update user tx: %w", err)
 	}
-	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $2 WHERE user_id = $1`,
-		userID, balanceNewValue,
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+		userID, currency, balanceNewValue.Amount,
 	)
 	if err != nil {
-		return 0, fmt.Errorf("update balance: %w", err)
+		return 0, "", fmt.Errorf("update balance: %w", err)
 	}
 
-	return txID, nil
-}
-
-func (d *BalanceDatabase) CancelReservation(ctx context.Context, userID, orderID, itemID string) error {
-	if userID == "" {
-		return proto.NewBadParameterError("user id")
+	// 4) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountUser, userID, value.Neg())
+	entries.add(LedgerAccountCashIn, "", value)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, "", err
 	}
-	if orderID == "" {
-		return proto.NewBadParameterError("order id")
+
+	// 5) TRACK DEBT
+	if err = recordDebt(ctx, tx, txID, userID, userWallet.creditLimit, userWallet.available(), userWallet.available().Sub(value), "", ""); err != nil {
+		return 0, "", err
 	}
 
+	return txID, userID, nil
+}
+
+// Reserve holds funds for an order. Zero expiresAt means reservation never expires.
+func (d *BalanceDatabase) Reserve(ctx context.Context, userID, currency, value, orderID, itemID string, expiresAt time.Time) (err error) {
 	// x) WRAP IN TRANSACTION
 	conn, err := d.db.Acquire(ctx)
 	if err != nil {
@@ -380,54 +705,1660 @@ func (d *BalanceDatabase) CancelReservation(ctx context.Context, userID, orderID
 		}
 	}()
 
-	// 1) LOAD BALANCE AND LOCK FOR UPDATE
-	var balanceCurrency string
-	var balanceCurrentValue decimal.Decimal
+	return d.reserve(ctx, tx, userID, currency, value, orderID, itemID, expiresAt)
+}
 
-	row := tx.QueryRow(ctx, "SELECT currency, current_value FROM balance WHERE user_id = $1 FOR UPDATE", userID)
-	if err = row.Scan(&balanceCurrency, &balanceCurrentValue); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// must set err to trigger Rollback
-			err = proto.NewUserNotFoundError()
-			return err
-		}
-		return fmt.Errorf("lock balance: %w", err)
+// reserve is Reserve within an open transaction
+func (d *BalanceDatabase) reserve(ctx context.Context, tx pgx.Tx, userID, currency, value, orderID, itemID string, expiresAt time.Time) error {
+	if userID == "" {
+		return proto.NewBadParameterError("user id")
 	}
-
-	// 2) FIND RESERVATION
-	var reservationUserID string
-
-	row = tx.QueryRow(ctx, "SELECT user_id FROM balance_reserve WHERE order_id = $1", orderID)
-	if err = row.Scan(&reservationUserID); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// no reservation
-			var orderTxCount int
-			row = tx.QueryRow(ctx, "SELECT COUNT(*) FROM transaction WHERE (order_data->>'order_id') = $1", orderID)
-			if err = row.Scan(&orderTxCount); err != nil {
-				return fmt.Errorf("locate order tx: %w", err)
+	if !IsCurrencyValid(currency) {
+		return proto.NewBadParameterError("currency")
+	}
+	reserveValue, err := ParseMoney(value, currency)
+	if err != nil || !reserveValue.IsPositive() {
+		return proto.NewBadParameterError("value")
+	}
+	if orderID == "" {
+		return proto.NewBadParameterError("order id")
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		return proto.NewBadParameterError("expires at")
+	}
+
+	// 1) LOAD WALLETS WITH EXISTING RESERVES AND LOCK FOR UPDATE
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	// x) IDEMPOTENCY CHECK (each item of the order is reserved separately)
+	var orderTx int
+	var reservedUserID, reservedCurrency string
+	var reservedValue decimal.Decimal
+	row := tx.QueryRow(ctx, `SELECT user_id, currency, "value" FROM balance_reserve WHERE order_id = $1 AND item_id = $2`, orderID, itemID)
+	if err = row.Scan(&reservedUserID, &reservedCurrency, &reservedValue); err == nil {
+		// constb: pretend we have successfully processed this reservation, but only if it is the same reservation
+		// important: set err to Rollback transaction
+		switch {
+		case reservedUserID != userID:
+			err = proto.NewIdempotencyConflictError("user id")
+		case reservedCurrency != currency:
+			err = proto.NewIdempotencyConflictError("currency")
+		case !reservedValue.Equal(reserveValue.Amount):
+			err = proto.NewIdempotencyConflictError("value")
+		}
+		return err
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("read reserve: %w", err)
+	}
+	row = tx.QueryRow(ctx, "SELECT COUNT(*) FROM transaction WHERE order_data->>'order_id' = $1 AND coalesce(order_data->>'item_id', '') = $2",
+		orderID, itemID,
+	)
+	if err = row.Scan(&orderTx); err != nil {
+		return fmt.Errorf("read tx: %w", err)
+	}
+	if orderTx > 0 {
+		// constb: reserving money for already committed transaction? definitely an error!
+		// important: set err to Rollback transaction
+		err = proto.NewInvalidStateError()
+		return err
+	}
+
+	// x) CHECK ACCOUNT STATUS
+	if err = checkAccountStatus(ctx, tx, userID, true); err != nil {
+		return err
+	}
+
+	// 2) CHOOSE WALLET, CONVERT CURRENCIES IF NEEDED
+	// constb: reserve extra (CURRENCY_CONVERSION_BUFFER) when converting to compensate for possible rate changes
+	var userWallet *wallet
+	var reserveInUserCurrency Money
+	var conv conversion
+	userWallet, reserveInUserCurrency, conv, err = d.pickWallet(wallets[userID], reserveValue, true, true)
+	if err != nil {
+		return err
+	}
+
+	// 3) CHECK IF USER HAS ENOUGH MONEY (including bonus and credit limit)
+	if userWallet == nil || reserveInUserCurrency.GreaterThan(userWallet.spendable(true)) {
+		return proto.NewNotEnoughMoneyError()
+	}
+
+	// 4) CREATE RESERVATION, HOLD BONUS ACCORDING TO PRIORITY, LOCK EXCHANGE RATE IF CONVERTED
+	reserveBonus := d.bonusPart(reserveInUserCurrency, userWallet.bonusAvailable(), userWallet.available())
+	var expiresAtParam, rateExpiresAtParam any
+	if !expiresAt.IsZero() {
+		expiresAtParam = expiresAt
+	}
+	rateIDParam, rateParam := conv.params()
+	if rateParam != nil && d.rateLockTTL > 0 {
+		rateExpiresAtParam = time.Now().Add(d.rateLockTTL)
+	}
+	_, err = tx.Exec(ctx, `
+INSERT INTO balance_reserve (order_id, user_id, item_id, currency, "value", wallet_currency, user_currency_value, bonus_value,
+                             expires_at, rate, rate_expires_at, exchange_rate_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		orderID, userID, itemID, currency, reserveValue.Amount, userWallet.currency, reserveInUserCurrency.Amount, reserveBonus.Amount,
+		expiresAtParam, rateParam, rateExpiresAtParam, rateIDParam,
+	)
+	if err != nil {
+		return fmt.Errorf("save reservation: %w", err)
+	}
+
+	return nil
+}
+
+// CommitReservation charges user for an order. If order has a reservation, value is captured from it and the rest is
+// released, unless keepRemainder is set: then reservation may be captured again until it is used up. Captures that
+// keep the remainder require idempotency key, a plain retry would capture twice.
+func (d *BalanceDatabase) CommitReservation(ctx context.Context, idempotencyKey, userID, currency, value, orderID, itemID string, keepRemainder bool) (txID snowflake.ID, err error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	return d.commitReservation(ctx, tx, idempotencyKey, userID, currency, value, orderID, itemID, keepRemainder, "", Commission{})
+}
+
+// Commission is platform fee on marketplace sales: percent of value plus fixed amount in commit currency.
+type Commission struct {
+	Percent string
+	Fixed   string
+}
+
+// CommitSale is CommitReservation of a marketplace order: buyer is charged, seller is credited with value minus
+// commission in commit currency, commission is booked as platform revenue.
+func (d *BalanceDatabase) CommitSale(ctx context.Context, idempotencyKey, userID, sellerID, currency, value, orderID, itemID string, keepRemainder bool, commission Commission) (txID snowflake.ID, err error) {
+	if sellerID == "" {
+		return 0, proto.NewBadParameterError("seller id")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	return d.commitReservation(ctx, tx, idempotencyKey, userID, currency, value, orderID, itemID, keepRemainder, sellerID, commission)
+}
+
+// commissionValue calculates commission for a sale of given value, rounded to minor units of value currency
+func (d *BalanceDatabase) commissionValue(value Money, commission Commission) (Money, error) {
+	result := NewMoney(decimal.Zero, value.Currency)
+	if commission.Percent != "" {
+		percent, err := decimal.NewFromString(commission.Percent)
+		if err != nil || percent.IsNegative() || percent.GreaterThan(decimal.NewFromInt(100)) {
+			return Money{}, proto.NewBadParameterError("commission percent")
+		}
+		result = value.Share(percent, decimal.NewFromInt(100), d.roundingPolicy)
+	}
+	if commission.Fixed != "" {
+		fixed, err := ParseMoney(commission.Fixed, value.Currency)
+		if err != nil || fixed.IsNegative() {
+			return Money{}, proto.NewBadParameterError("commission fixed")
+		}
+		result = result.Add(fixed)
+	}
+	if result.GreaterThan(value) {
+		return Money{}, proto.NewBadParameterError("commission")
+	}
+	return result, nil
+}
+
+// commitReservation is CommitReservation within an open transaction. Non-empty sellerID makes it a marketplace sale.
+func (d *BalanceDatabase) commitReservation(ctx context.Context, tx pgx.Tx, idempotencyKey, userID, currency, value, orderID, itemID string, keepRemainder bool, sellerID string, commission Commission) (snowflake.ID, error) {
+	if userID == "" {
+		return 0, proto.NewBadParameterError("user id")
+	}
+	if !IsCurrencyValid(currency) {
+		return 0, proto.NewBadParameterError("currency")
+	}
+	commitValue, err := ParseMoney(value, currency)
+	if err != nil || !commitValue.IsPositive() {
+		return 0, proto.NewBadParameterError("value")
+	}
+	if orderID == "" {
+		return 0, proto.NewBadParameterError("order id")
+	}
+	if keepRemainder && idempotencyKey == "" {
+		// constb: reservation stays open, retry without a key can't be told from the next capture
+		return 0, proto.NewBadParameterError("idempotency key")
+	}
+	if sellerID == userID {
+		return 0, proto.NewBadParameterError("seller id")
+	}
+	var saleCommission Money
+	if sellerID != "" {
+		if saleCommission, err = d.commissionValue(commitValue, commission); err != nil {
+			return 0, err
+		}
+
+		// 1.0) CREATE ZERO SELLER WALLET IF NOT EXISTS
+		if err = initUserBalance(ctx, tx, sellerID, currency); err != nil {
+			return 0, err
+		}
+	}
+
+	// 1) LOAD WALLETS (buyer and seller, if any) AND LOCK FOR UPDATE
+	var wallets map[string][]*wallet
+	if sellerID != "" {
+		wallets, err = lockUserWallets(ctx, tx, userID, sellerID)
+	} else {
+		wallets, err = lockUserWallets(ctx, tx, userID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// x) IDEMPOTENCY CHECK
+	var txID snowflake.ID
+	if idempotencyKey != "" {
+		txID, err = findIdempotentTransaction(ctx, tx, idempotencyKey, idempotencyParams{
+			kind:        TransactionKindCharge,
+			senderID:    userID,
+			recipientID: sellerID,
+			value:       commitValue,
+			orderID:     orderID,
+			itemID:      itemID,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if txID != 0 {
+			// constb: capture already was processed earlier, continue as if we have applied it now
+			return txID, nil
+		}
+	}
+
+	// 2) LOAD RESERVATION IF WAS PREVIOUSLY MADE
+	var reservationUserID, reservationCurrency, reservationWalletCurrency string
+	var reservedValue, capturedValue, reservedInUserCurrency, reservedBonus decimal.Decimal
+	var reservationValue, reservationCaptured, reservationInUserCurrency, reservationBonus Money
+	var reservationRate decimal.NullDecimal
+	var reservationRateID *int64
+	var reservationRateExpiresAt *time.Time
+	var previouslyReserved, reservationKept bool
+	var reservationNewInUserCurrency Money
+	row := tx.QueryRow(ctx, `
+SELECT user_id, currency, "value", captured_value, wallet_currency, user_currency_value, bonus_value, rate, rate_expires_at,
+       exchange_rate_id
+FROM balance_reserve
+WHERE order_id = $1 AND item_id = $2
+FOR UPDATE`, orderID, itemID)
+	if err = row.Scan(&reservationUserID, &reservationCurrency, &reservedValue, &capturedValue, &reservationWalletCurrency, &reservedInUserCurrency, &reservedBonus, &reservationRate, &reservationRateExpiresAt, &reservationRateID); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("locate reservation: %w", err)
+		}
+	} else {
+		previouslyReserved = true
+		reservationValue = NewMoney(reservedValue, reservationCurrency)
+		reservationCaptured = NewMoney(capturedValue, reservationCurrency)
+		reservationInUserCurrency = NewMoney(reservedInUserCurrency, reservationWalletCurrency)
+		reservationBonus = NewMoney(reservedBonus, reservationWalletCurrency)
+	}
+
+	if !previouslyReserved {
+		// x) IDEMPOTENCY CHECK (no reservation – is this order item already charged?)
+		var chargedUserID, chargedSellerID, chargedCurrency string
+		var chargedValue decimal.Decimal
+		row = tx.QueryRow(ctx, `
+SELECT id, sender_id, coalesce(recipient_id, ''), transaction_currency, transaction_value
+FROM transaction
+WHERE order_data->>'order_id' = $1 AND coalesce(order_data->>'item_id', '') = $2 AND kind = $3
+ORDER BY id DESC
+LIMIT 1`, orderID, itemID, TransactionKindCharge)
+		if err = row.Scan(&txID, &chargedUserID, &chargedSellerID, &chargedCurrency, &chargedValue); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("locate transaction: %w", err)
+		}
+		if txID > 0 {
+			// important: set err to Rollback transaction
+			switch {
+			case idempotencyKey != "":
+				// constb: reservation is used up or released, nothing left to capture
+				err = proto.NewInvalidStateError()
+			case chargedUserID != userID:
+				err = proto.NewIdempotencyConflictError("user id")
+			case chargedSellerID != sellerID:
+				err = proto.NewIdempotencyConflictError("seller id")
+			case chargedCurrency != currency:
+				err = proto.NewIdempotencyConflictError("currency")
+			case !chargedValue.Equal(commitValue.Amount):
+				err = proto.NewIdempotencyConflictError("value")
+			default:
+				// constb: pretend we have successfully committed this reservation
+				return txID, nil
+			}
+			return 0, err
+		}
+		err = nil
+	} else {
+		if reservationUserID != userID {
+			// must set err to trigger Rollback
+			err = proto.NewBadParameterError("user id")
+			return 0, err
+		}
+		if reservationCurrency != currency {
+			// constb: captures are counted in reservation currency. must set err to trigger Rollback
+			err = proto.NewBadParameterError("currency")
+			return 0, err
+		}
+		reservationRemaining := reservationValue.Sub(reservationCaptured)
+		if commitValue.GreaterThan(reservationRemaining) {
+			// must set err to trigger Rollback
+			err = proto.NewBadParameterError("value")
+			return 0, err
+		}
+
+		// 2.1) CAPTURE FROM RESERVATION, RELEASE THE REST IF REQUESTED OR NOTHING LEFT
+		newCaptured := reservationCaptured.Add(commitValue)
+		if !keepRemainder || newCaptured.Equal(reservationValue) {
+			_, err = tx.Exec(ctx, `DELETE FROM balance_reserve WHERE order_id = $1 AND item_id = $2`, orderID, itemID)
+			if err != nil {
+				return 0, fmt.Errorf("delete reservation: %w", err)
+			}
+		} else {
+			// constb: keep holding proportional part of the reservation (including currency rate buffer)
+			reservationKept = true
+			reservationNewInUserCurrency = reservationInUserCurrency.
+				Share(reservationValue.Sub(newCaptured).Amount, reservationRemaining.Amount, d.roundingPolicy)
+			_, err = tx.Exec(ctx, `
+UPDATE balance_reserve
+SET captured_value = $3, user_currency_value = $4
+WHERE order_id = $1 AND item_id = $2`,
+				orderID, itemID, newCaptured.Amount, reservationNewInUserCurrency.Amount,
+			)
+			if err != nil {
+				return 0, fmt.Errorf("update reservation: %w", err)
+			}
+		}
+	}
+
+	// x) CHECK ACCOUNT STATUS (of seller as well)
+	if err = checkAccountStatus(ctx, tx, userID, true); err != nil {
+		return 0, err
+	}
+	if sellerID != "" {
+		if err = checkAccountStatus(ctx, tx, sellerID, false); err != nil {
+			return 0, err
+		}
+	}
+
+	// 3) CHOOSE WALLET (the one holding reservation, if any) AND CALCULATE ACTUAL TRANSACTION VALUE
+	var userWallet *wallet
+	var commitInUserCurrency Money
+	var conv conversion
+	if previouslyReserved {
+		userWallet = findWallet(wallets[userID], reservationWalletCurrency)
+		rateExpired := reservationRateExpiresAt != nil && !reservationRateExpiresAt.After(time.Now())
+		switch {
+		case currency == reservationWalletCurrency:
+			commitInUserCurrency = commitValue
+		case reservationRate.Valid && !rateExpired:
+			// constb: use exchange rate locked at reservation time, so that buffer covers the whole capture
+			conv.rate = reservationRate.Decimal
+			if reservationRateID != nil {
+				conv.rateID = snowflake.ID(*reservationRateID)
+			}
+			commitInUserCurrency = commitValue.Convert(conv.rate, reservationWalletCurrency, d.roundingPolicy)
+		case reservationRate.Valid && d.rateExpiryPolicy == RateExpiryPolicyReject:
+			// must set err to trigger Rollback
+			err = proto.NewInvalidStateError()
+			return 0, err
+		default:
+			// constb: reservations made before rates were locked, or locked rate expired
+			conv, err = rateSet().conversion(currency, reservationWalletCurrency)
+			if err != nil {
+				return 0, fmt.Errorf("currency convert: %w", err)
+			}
+			commitInUserCurrency = commitValue.Convert(conv.rate, reservationWalletCurrency, d.roundingPolicy)
+		}
+	} else {
+		userWallet, commitInUserCurrency, conv, err = d.pickWallet(wallets[userID], commitValue, false, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if userWallet == nil {
+		// important: set err to Rollback transaction
+		err = proto.NewNotEnoughMoneyError()
+		return 0, err
+	}
+
+	// 3.1) SPLIT CHARGE INTO CASH AND BONUS (reserved bonus is spent the same way it was held)
+	var commitBonus Money
+	if previouslyReserved {
+		commitBonus = d.bonusPart(commitInUserCurrency, reservationBonus, reservationInUserCurrency.Sub(reservationBonus))
+		if reservationKept {
+			_, err = tx.Exec(ctx, `UPDATE balance_reserve SET bonus_value = $3 WHERE order_id = $1 AND item_id = $2`,
+				orderID, itemID, reservationBonus.Sub(commitBonus).Min(reservationNewInUserCurrency).Amount,
+			)
+			if err != nil {
+				return 0, fmt.Errorf("update reservation: %w", err)
+			}
+		}
+	} else {
+		commitBonus = d.bonusPart(commitInUserCurrency, userWallet.bonusAvailable(), userWallet.available())
+	}
+	commitCash := commitInUserCurrency.Sub(commitBonus)
+	var bonusExpiresAt time.Time
+	if bonusExpiresAt, err = spendBonus(ctx, tx, userID, commitBonus); err != nil {
+		return 0, err
+	}
+
+	balanceNewValue := userWallet.value.Sub(commitCash)
+
+	// constb: capture releases reserved cash, so available funds after it are read back once reservation is updated
+	var reservedAfter Money
+	if reservedAfter, err = reservedCash(ctx, tx, userID, userWallet.currency); err != nil {
+		return 0, err
+	}
+	availableNewValue := balanceNewValue.Sub(reservedAfter)
+
+	if overLimit(availableNewValue, userWallet.creditLimit).GreaterThan(overLimit(userWallet.available(), userWallet.creditLimit)) &&
+		(currency == userWallet.currency || !previouslyReserved) {
+		// constb only allow overdraft (beyond credit limit) on reservations in different currency, otherwise generate error
+		// important: set err to Rollback transaction
+		err = proto.NewNotEnoughMoneyError()
+		return 0, err
+	}
+
+	// 4) CREATE TRANSACTION RECORD AND CHARGE FROM BALANCE
+	txID = utils.GenerateID()
+	var orderDataParam []byte
+	orderDataParam, err = json.Marshal(struct {
+		OrderID string `json:"order_id"`
+		ItemID  string `json:"item_id,omitempty"`
+	}{orderID, itemID})
+	var idempotencyKeyParam any
+	if idempotencyKey != "" {
+		idempotencyKeyParam = idempotencyKey
+	}
+	var bonusParam, bonusExpiresAtParam any
+	if commitBonus.IsPositive() {
+		bonusParam, bonusExpiresAtParam = commitBonus.Amount, bonusExpiresAt
+	}
+	rateIDParam, rateParam := conv.params()
+	var sellerWallet *wallet
+	sellerValue := NewMoney(decimal.Zero, currency)
+	var sellerNewValue Money
+	if sellerID == "" {
+		_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
+                         sender_balance_before, sender_balance_after, bonus_value, bonus_expires_at, order_data,
+                         idempotency_key, exchange_rate_id, exchange_rate)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+			txID.Int64(), TransactionKindCharge, currency, commitValue.Amount, userID, userWallet.currency, commitInUserCurrency.Amount,
+			userWallet.value.Amount, balanceNewValue.Amount, bonusParam, bonusExpiresAtParam, orderDataParam,
+			idempotencyKeyParam, rateIDParam, rateParam,
+		)
+	} else {
+		// constb: seller gets the rest after commission in commit currency, commission stays with the platform
+		sellerWallet = findWallet(wallets[sellerID], currency)
+		sellerValue = commitValue.Sub(saleCommission)
+		sellerNewValue = sellerWallet.value.Add(sellerValue)
+		_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
+                         sender_balance_before, sender_balance_after, recipient_id, recipient_currency, recipient_value,
+                         recipient_balance_before, recipient_balance_after, commission_value, bonus_value,
+                         bonus_expires_at, order_data, idempotency_key, exchange_rate_id, exchange_rate)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)`,
+			txID.Int64(), TransactionKindCharge, currency, commitValue.Amount, userID, userWallet.currency, commitInUserCurrency.Amount,
+			userWallet.value.Amount, balanceNewValue.Amount, sellerID, currency, sellerValue.Amount,
+			sellerWallet.value.Amount, sellerNewValue.Amount, saleCommission.Amount, bonusParam,
+			bonusExpiresAtParam, orderDataParam, idempotencyKeyParam, rateIDParam, rateParam,
+		)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("save user tx: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+		userID, userWallet.currency, balanceNewValue.Amount,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("update balance: %w", err)
+	}
+	if sellerWallet != nil {
+		_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+			sellerID, currency, sellerNewValue.Amount,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("update seller balance: %w", err)
+		}
+	}
+	if err = recordDebt(ctx, tx, txID, userID, userWallet.creditLimit, userWallet.available(), availableNewValue, orderID, itemID); err != nil {
+		return 0, err
+	}
+
+	// 5) POST LEDGER ENTRIES (seller's share of a sale doesn't count as revenue)
+	var entries ledger
+	entries.add(LedgerAccountUser, userID, commitCash.Neg())
+	entries.add(LedgerAccountUserBonus, userID, commitBonus.Neg())
+	entries.exchange(commitInUserCurrency, commitValue)
+	entries.add(LedgerAccountRevenue, "", commitValue.Sub(sellerValue))
+	if sellerID != "" {
+		entries.add(LedgerAccountUser, sellerID, sellerValue)
+	}
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, err
+	}
+
+	// 6) COLLECT DEBT (released currency rate buffer goes to user's debt) AND DEBT OF SELLER
+	if _, err = collectDebt(ctx, tx, userID, userWallet.creditLimit, balanceNewValue); err != nil {
+		return 0, err
+	}
+	if sellerWallet != nil {
+		if _, err = collectDebt(ctx, tx, sellerID, sellerWallet.creditLimit, sellerNewValue); err != nil {
+			return 0, err
+		}
+	}
+
+	return txID, nil
+}
+
+func (d *BalanceDatabase) CancelReservation(ctx context.Context, userID, orderID, itemID string) (err error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	return d.cancelReservation(ctx, tx, userID, orderID, itemID)
+}
+
+// cancelReservation is CancelReservation within an open transaction
+func (d *BalanceDatabase) cancelReservation(ctx context.Context, tx pgx.Tx, userID, orderID, itemID string) (err error) {
+	if userID == "" {
+		return proto.NewBadParameterError("user id")
+	}
+	if orderID == "" {
+		return proto.NewBadParameterError("order id")
+	}
+
+	// 1) LOAD WALLETS AND LOCK FOR UPDATE
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if len(wallets[userID]) == 0 {
+		// must set err to trigger Rollback
+		err = proto.NewUserNotFoundError()
+		return err
+	}
+
+	// x) CHECK ACCOUNT STATUS
+	if err = checkAccountStatus(ctx, tx, userID, false); err != nil {
+		return err
+	}
+
+	// 2) FIND RESERVATION (all items of the order if item id is empty)
+	var reservationCount, otherUserCount int
+
+	row := tx.QueryRow(ctx, `
+SELECT COUNT(*), COUNT(*) FILTER (WHERE user_id <> $3)
+FROM balance_reserve
+WHERE order_id = $1 AND ($2 = '' OR item_id = $2)`,
+		orderID, itemID, userID,
+	)
+	if err = row.Scan(&reservationCount, &otherUserCount); err != nil {
+		return fmt.Errorf("locate reservation: %w", err)
+	}
+	if reservationCount == 0 {
+		// no reservation
+		var orderTxCount int
+		row = tx.QueryRow(ctx, `
+SELECT COUNT(*)
+FROM transaction
+WHERE (order_data->>'order_id') = $1 AND ($2 = '' OR coalesce(order_data->>'item_id', '') = $2)`,
+			orderID, itemID,
+		)
+		if err = row.Scan(&orderTxCount); err != nil {
+			return fmt.Errorf("locate order tx: %w", err)
+		}
+		// constb: if we don't have a transaction for this order – cancel call is duplicate
+		// pretend we have cancelled just now
+		if orderTxCount == 0 {
+			return nil
+		}
+		// …otherwise this order is already committed. must set err to trigger Rollback
+		err = proto.NewInvalidStateError()
+		return err
+	}
+	if otherUserCount > 0 {
+		// must set err to trigger Rollback
+		err = proto.NewBadParameterError("user id")
+		return err
+	}
+
+	// 3) REMOVE RESERVATION
+	_, err = tx.Exec(ctx, "DELETE FROM balance_reserve WHERE order_id = $1 AND ($2 = '' OR item_id = $2)", orderID, itemID)
+	if err != nil {
+		return fmt.Errorf("remove reservation: %w", err)
+	}
+
+	// 4) COLLECT DEBT (released cash is available again)
+	return collectWalletsDebt(ctx, tx, userID, wallets[userID])
+}
+
+// AdjustReservation changes reserved value of an existing reservation, value is the new total in reservation
+// currency including what was already captured.
+func (d *BalanceDatabase) AdjustReservation(ctx context.Context, userID, currency, value, orderID, itemID string) (err error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	return d.adjustReservation(ctx, tx, userID, currency, value, orderID, itemID)
+}
+
+// adjustReservation is AdjustReservation within an open transaction
+func (d *BalanceDatabase) adjustReservation(ctx context.Context, tx pgx.Tx, userID, currency, value, orderID, itemID string) error {
+	if userID == "" {
+		return proto.NewBadParameterError("user id")
+	}
+	if !IsCurrencyValid(currency) {
+		return proto.NewBadParameterError("currency")
+	}
+	newValue, err := ParseMoney(value, currency)
+	if err != nil || !newValue.IsPositive() {
+		return proto.NewBadParameterError("value")
+	}
+	if orderID == "" {
+		return proto.NewBadParameterError("order id")
+	}
+
+	// 1) LOAD WALLETS WITH EXISTING RESERVES AND LOCK FOR UPDATE (same lock as Reserve takes)
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	// 2) LOAD RESERVATION
+	var reservationUserID, reservationCurrency, reservationWalletCurrency string
+	var reservedValue, capturedValue, reservedInUserCurrency, reservedBonus decimal.Decimal
+	var reservationRate decimal.NullDecimal
+	var reservationRateID *int64
+	var reservationRateExpiresAt *time.Time
+	row := tx.QueryRow(ctx, `
+SELECT user_id, currency, "value", captured_value, wallet_currency, user_currency_value, bonus_value, rate, rate_expires_at,
+       exchange_rate_id
+FROM balance_reserve
+WHERE order_id = $1 AND item_id = $2
+FOR UPDATE`, orderID, itemID)
+	err = row.Scan(&reservationUserID, &reservationCurrency, &reservedValue, &capturedValue, &reservationWalletCurrency, &reservedInUserCurrency, &reservedBonus, &reservationRate, &reservationRateExpiresAt, &reservationRateID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// constb: nothing to adjust – reservation is committed, cancelled or never existed
+		return proto.NewInvalidStateError()
+	}
+	if err != nil {
+		return fmt.Errorf("locate reservation: %w", err)
+	}
+	if reservationUserID != userID {
+		return proto.NewBadParameterError("user id")
+	}
+	if reservationCurrency != currency {
+		return proto.NewBadParameterError("currency")
+	}
+	reservationValue := NewMoney(reservedValue, currency)
+	reservationCaptured := NewMoney(capturedValue, currency)
+	reservationInUserCurrency := NewMoney(reservedInUserCurrency, reservationWalletCurrency)
+	reservationBonus := NewMoney(reservedBonus, reservationWalletCurrency)
+	if !newValue.GreaterThan(reservationCaptured) {
+		// constb: can't go below what is already captured, commit without keeping remainder releases the rest
+		return proto.NewBadParameterError("value")
+	}
+	if newValue.Equal(reservationValue) {
+		// constb: already adjusted, pretend we have done it now
+		return nil
+	}
+
+	// x) CHECK ACCOUNT STATUS (lowering the reservation only releases money)
+	raise := newValue.GreaterThan(reservationValue)
+	if err = checkAccountStatus(ctx, tx, userID, raise); err != nil {
+		return err
+	}
+
+	// 3) CALCULATE NEW HELD VALUE IN WALLET CURRENCY
+	// constb: keep using the locked rate while it is valid, otherwise lock current one
+	remaining := newValue.Sub(reservationCaptured)
+	newInUserCurrency := remaining
+	conv := conversion{rate: reservationRate.Decimal}
+	if reservationRateID != nil {
+		conv.rateID = snowflake.ID(*reservationRateID)
+	}
+	rateExpiresAt := reservationRateExpiresAt
+	if currency != reservationWalletCurrency {
+		if !reservationRate.Valid || (rateExpiresAt != nil && !rateExpiresAt.After(time.Now())) {
+			conv, err = rateSet().conversion(currency, reservationWalletCurrency)
+			if err != nil {
+				return fmt.Errorf("currency convert: %w", err)
 			}
-			// constb: if we don't have a transaction for this order – cancel call is duplicate
-			// pretend we have cancelled just now
-			if orderTxCount == 0 {
-				return nil
+			rateExpiresAt = nil
+			if d.rateLockTTL > 0 {
+				expiresAt := time.Now().Add(d.rateLockTTL)
+				rateExpiresAt = &expiresAt
 			}
-			// …otherwise this order is already committed. must set err to trigger Rollback
+		}
+		newInUserCurrency = remaining.Convert(conv.rate.Mul(d.conversionBuffer(currency, reservationWalletCurrency)), reservationWalletCurrency, d.roundingPolicy)
+	}
+
+	// 4) CHECK IF USER HAS ENOUGH MONEY FOR THE RAISE (including bonus and credit limit)
+	userWallet := findWallet(wallets[userID], reservationWalletCurrency)
+	delta := newInUserCurrency.Sub(reservationInUserCurrency)
+	if delta.IsPositive() && (userWallet == nil || delta.GreaterThan(userWallet.spendable(true))) {
+		return proto.NewNotEnoughMoneyError()
+	}
+
+	// 5) SPLIT HELD VALUE INTO CASH AND BONUS (raise holds bonus by priority, lowered reservation keeps the part it
+	// would hold if it was made for the new value)
+	var newBonus Money
+	if delta.IsPositive() {
+		newBonus = reservationBonus.Add(d.bonusPart(delta, userWallet.bonusAvailable(), userWallet.available()))
+	} else {
+		newBonus = d.bonusPart(newInUserCurrency, reservationBonus, reservationInUserCurrency.Sub(reservationBonus))
+	}
+
+	// 6) UPDATE RESERVATION
+	rateIDParam, rateParam := conv.params()
+	_, err = tx.Exec(ctx, `
+UPDATE balance_reserve
+SET "value" = $3, user_currency_value = $4, bonus_value = $5, rate = $6, rate_expires_at = $7, exchange_rate_id = $8
+WHERE order_id = $1 AND item_id = $2`,
+		orderID, itemID, newValue.Amount, newInUserCurrency.Amount, newBonus.Amount, rateParam, rateExpiresAt, rateIDParam,
+	)
+	if err != nil {
+		return fmt.Errorf("update reservation: %w", err)
+	}
+
+	// 7) COLLECT DEBT (lowered reservation releases cash)
+	if !delta.IsPositive() && userWallet != nil {
+		if _, err = collectDebt(ctx, tx, userID, userWallet.creditLimit, userWallet.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExpireReservations cancels up to limit reservations that have expired by now. Returns number of cancelled
+// reservations.
+func (d *BalanceDatabase) ExpireReservations(ctx context.Context, limit int) (int, error) {
+	now := time.Now()
+
+	// 1) FIND EXPIRED RESERVATIONS, OLDEST FIRST
+	// constb: expires_at is always after created_at, so created_at index narrows the scan. created_at has no time zone,
+	// the cast makes it compare in session time zone it was written in
+	rows, err := d.db.Query(ctx, `
+SELECT order_id, item_id, user_id
+FROM balance_reserve
+WHERE created_at <= $1::timestamptz
+  AND expires_at <= $1
+ORDER BY created_at
+LIMIT $2`,
+		now, limit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("find expired reservations: %w", err)
+	}
+	type expiredReservation struct{ orderID, itemID, userID string }
+	var expired []expiredReservation
+	for rows.Next() {
+		var next expiredReservation
+		if err = rows.Scan(&next.orderID, &next.itemID, &next.userID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("find expired reservations: %w", err)
+		}
+		expired = append(expired, next)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("find expired reservations: %w", err)
+	}
+
+	// 2) CANCEL EACH ONE IN ITS OWN TRANSACTION
+	var count int
+	for _, reservation := range expired {
+		var ok bool
+		ok, err = d.expireReservation(ctx, reservation.userID, reservation.orderID, reservation.itemID, now)
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (d *BalanceDatabase) expireReservation(ctx context.Context, userID, orderID, itemID string, now time.Time) (bool, error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) LOCK BALANCE FOR UPDATE (same lock order as reserve/commit/cancel)
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	// 2) REMOVE RESERVATION IF IT IS STILL THERE AND STILL EXPIRED
+	res, err := tx.Exec(ctx, "DELETE FROM balance_reserve WHERE order_id = $1 AND item_id = $2 AND expires_at <= $3", orderID, itemID, now)
+	if err != nil {
+		return false, fmt.Errorf("remove reservation: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	// 3) COLLECT DEBT (released cash is available again)
+	if err = collectWalletsDebt(ctx, tx, userID, wallets[userID]); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (d *BalanceDatabase) Transfer(ctx context.Context, idempotencyKey, senderID, recipientID, currency, value string) (snowflake.ID, error) {
+	if idempotencyKey == "" {
+		return 0, proto.NewBadParameterError("idempotency key")
+	}
+	if senderID == "" {
+		return 0, proto.NewBadParameterError("user id")
+	}
+	if recipientID == "" || recipientID == senderID {
+		return 0, proto.NewBadParameterError("recipient id")
+	}
+	if !IsCurrencyValid(currency) {
+		return 0, proto.NewBadParameterError("currency")
+	}
+	transferValue, err := ParseMoney(value, currency)
+	if err != nil || !transferValue.IsPositive() {
+		return 0, proto.NewBadParameterError("value")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) CREATE ZERO RECIPIENT WALLET IF NOT EXISTS
+	// constb: blocked users don't get new wallets. status is checked again below, once wallets are locked
+	if err = checkAccountStatus(ctx, tx, recipientID, false); err != nil {
+		return 0, err
+	}
+	err = initUserBalance(ctx, tx, recipientID, currency)
+	if err != nil {
+		return 0, err
+	}
+
+	// 2) LOAD WALLETS OF BOTH USERS AND LOCK FOR UPDATE
+	// constb: rows are locked in user id order, so two opposite transfers can't deadlock each other
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, senderID, recipientID)
+	if err != nil {
+		return 0, err
+	}
+	if len(wallets[senderID]) == 0 {
+		// must set err to trigger Rollback
+		err = proto.NewUserNotFoundError()
+		return 0, err
+	}
+
+	// x) IDEMPOTENCY CHECK
+	var txID snowflake.ID
+	txID, err = findIdempotentTransaction(ctx, tx, idempotencyKey, idempotencyParams{
+		kind:        TransactionKindTransfer,
+		senderID:    senderID,
+		recipientID: recipientID,
+		value:       transferValue,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if txID != 0 {
+		// constb: transfer already was processed earlier, continue as if we have applied it now
+		return txID, nil
+	}
+
+	// x) CHECK ACCOUNT STATUS OF BOTH USERS
+	if err = checkAccountStatus(ctx, tx, senderID, true); err != nil {
+		return 0, err
+	}
+	if err = checkAccountStatus(ctx, tx, recipientID, false); err != nil {
+		return 0, err
+	}
+
+	// 3) CHOOSE SENDER WALLET, CONVERT CURRENCIES IF NEEDED
+	// constb: recipient always gets money in the wallet of transfer currency
+	var senderWallet *wallet
+	var transferInSenderCurrency Money
+	var conv conversion
+	senderWallet, transferInSenderCurrency, conv, err = d.pickWallet(wallets[senderID], transferValue, false, false)
+	if err != nil {
+		return 0, err
+	}
+	recipientWallet := findWallet(wallets[recipientID], currency)
+
+	// 4) CHECK IF SENDER HAS ENOUGH MONEY (reserved funds are not transferable)
+	if senderWallet == nil || transferInSenderCurrency.GreaterThan(senderWallet.available()) {
+		// important: set err to Rollback transaction
+		err = proto.NewNotEnoughMoneyError()
+		return 0, err
+	}
+
+	senderNewValue := senderWallet.value.Sub(transferInSenderCurrency)
+	recipientNewValue := recipientWallet.value.Add(transferValue)
+
+	// 5) CREATE TRANSACTION RECORD AND MOVE MONEY
+	txID = utils.GenerateID()
+	rateIDParam, rateParam := conv.params()
+	_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value,
+                         sender_id, sender_currency, sender_value, sender_balance_before, sender_balance_after,
+                         recipient_id, recipient_currency, recipient_value, recipient_balance_before, recipient_balance_after,
+                         idempotency_key, exchange_rate_id, exchange_rate)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`,
+		txID.Int64(), TransactionKindTransfer, currency, transferValue.Amount,
+		senderID, senderWallet.currency, transferInSenderCurrency.Amount, senderWallet.value.Amount, senderNewValue.Amount,
+		recipientID, currency, transferValue.Amount, recipientWallet.value.Amount, recipientNewValue.Amount,
+		idempotencyKey, rateIDParam, rateParam,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("save user tx: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+		senderID, senderWallet.currency, senderNewValue.Amount,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("update balance: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+		recipientID, currency, recipientNewValue.Amount,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("update balance: %w", err)
+	}
+
+	// 6) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountUser, senderID, transferInSenderCurrency.Neg())
+	entries.exchange(transferInSenderCurrency, transferValue)
+	entries.add(LedgerAccountUser, recipientID, transferValue)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, err
+	}
+
+	// 7) COLLECT DEBT OF RECIPIENT
+	if _, err = collectDebt(ctx, tx, recipientID, recipientWallet.creditLimit, recipientNewValue); err != nil {
+		return 0, err
+	}
+
+	return txID, nil
+}
+
+func (d *BalanceDatabase) Refund(ctx context.Context, idempotencyKey, userID, currency, value, orderID, itemID string) (snowflake.ID, error) {
+	if idempotencyKey == "" {
+		return 0, proto.NewBadParameterError("idempotency key")
+	}
+	if userID == "" {
+		return 0, proto.NewBadParameterError("user id")
+	}
+	if currency != "" && !IsCurrencyValid(currency) {
+		return 0, proto.NewBadParameterError("currency")
+	}
+	// constb: empty value means "refund everything that is left"
+	var refundAmount decimal.Decimal
+	var err error
+	if value != "" {
+		refundAmount, err = decimal.NewFromString(value)
+		if err != nil || refundAmount.LessThanOrEqual(decimal.Zero) {
+			return 0, proto.NewBadParameterError("value")
+		}
+	}
+	if orderID == "" {
+		return 0, proto.NewBadParameterError("order id")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) LOAD WALLETS AND LOCK FOR UPDATE (seller's as well if order was sold on marketplace)
+	// constb: charges never change, seller is looked up before locking so that both users are locked in one go
+	var sellerID string
+	row := tx.QueryRow(ctx, `
+SELECT coalesce(recipient_id, '')
+FROM transaction
+WHERE order_data->>'order_id' = $1 AND ($2 = '' OR coalesce(order_data->>'item_id', '') = $2) AND kind = $3
+ORDER BY id
+LIMIT 1`, orderID, itemID, TransactionKindCharge)
+	if err = row.Scan(&sellerID); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("locate order tx: %w", err)
+	}
+	lockIDs := []string{userID}
+	if sellerID != "" {
+		lockIDs = append(lockIDs, sellerID)
+	}
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, lockIDs...)
+	if err != nil {
+		return 0, err
+	}
+	if len(wallets[userID]) == 0 {
+		// must set err to trigger Rollback
+		err = proto.NewUserNotFoundError()
+		return 0, err
+	}
+
+	// x) IDEMPOTENCY CHECK
+	var txID snowflake.ID
+	txID, err = findIdempotentTransaction(ctx, tx, idempotencyKey, idempotencyParams{
+		kind:        TransactionKindRefund,
+		recipientID: userID,
+		value:       NewMoney(refundAmount, currency),
+		orderID:     orderID,
+		itemID:      itemID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if txID != 0 {
+		// constb: refund already was processed earlier, continue as if we have applied it now
+		return txID, nil
+	}
+
+	// x) CHECK ACCOUNT STATUS
+	if err = checkAccountStatus(ctx, tx, userID, false); err != nil {
+		return 0, err
+	}
+
+	// 2) FIND ORIGINAL CHARGES (reservation may have been captured several times)
+	var chargeID snowflake.ID
+	var chargeUserID, chargeCurrency, chargeWalletCurrency, chargeItemID, chargeSellerID string
+	var chargeValue, chargeUserValue, chargeBonus, chargeSellerValue Money
+	var chargeBonusExpiresAt time.Time
+	var chargeRate decimal.NullDecimal
+	var chargeRateID *int64
+	var chargeRateMixed bool
+	var orderData []byte
+	var rows pgx.Rows
+	rows, err = tx.Query(ctx, `
+SELECT id, sender_id, transaction_currency, transaction_value, sender_currency, sender_value, order_data, coalesce(order_data->>'item_id', ''),
+       coalesce(recipient_id, ''), coalesce(recipient_value, 0), coalesce(bonus_value, 0), bonus_expires_at, exchange_rate,
+       exchange_rate_id
+FROM transaction
+WHERE order_data->>'order_id' = $1 AND ($2 = '' OR coalesce(order_data->>'item_id', '') = $2) AND kind = $3
+ORDER BY id`,
+		orderID, itemID, TransactionKindCharge,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("locate order tx: %w", err)
+	}
+	for rows.Next() {
+		var rowID snowflake.ID
+		var rowItemID string
+		var rowValue, rowUserValue, rowSellerValue, rowBonus decimal.Decimal
+		var rowBonusExpiresAt *time.Time
+		var rowRate decimal.NullDecimal
+		var rowRateID *int64
+		if err = rows.Scan(&rowID, &chargeUserID, &chargeCurrency, &rowValue, &chargeWalletCurrency, &rowUserValue, &orderData, &rowItemID, &chargeSellerID, &rowSellerValue, &rowBonus, &rowBonusExpiresAt, &rowRate, &rowRateID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("locate order tx: %w", err)
+		}
+		if chargeID == 0 {
+			// constb: refunds are linked to the first charge of the order item. all captures of it are in the same
+			// currencies, reservation doesn't change them
+			chargeID, chargeItemID, chargeRate, chargeRateID = rowID, rowItemID, rowRate, rowRateID
+			chargeValue = NewMoney(decimal.Zero, chargeCurrency)
+			chargeUserValue = NewMoney(decimal.Zero, chargeWalletCurrency)
+			chargeSellerValue = NewMoney(decimal.Zero, chargeCurrency)
+			chargeBonus = NewMoney(decimal.Zero, chargeWalletCurrency)
+		} else if rowItemID != chargeItemID {
+			// constb: order has several items, caller must tell which one to refund. must set err to trigger Rollback
+			rows.Close()
+			err = proto.NewBadParameterError("item id")
+			return 0, err
+		} else if rowRate.Valid != chargeRate.Valid || !rowRate.Decimal.Equal(chargeRate.Decimal) ||
+			(rowRateID == nil) != (chargeRateID == nil) || (rowRateID != nil && *rowRateID != *chargeRateID) {
+			// constb: locked rate expired between captures, they were converted at different rates
+			chargeRateMixed = true
+		}
+		if chargeSellerID != sellerID {
+			// constb: item was captured after seller lookup or by another seller. must set err to trigger Rollback
+			rows.Close()
 			err = proto.NewInvalidStateError()
-			return err
+			return 0, err
+		}
+		chargeValue = chargeValue.Add(NewMoney(rowValue, chargeCurrency))
+		chargeUserValue = chargeUserValue.Add(NewMoney(rowUserValue, chargeWalletCurrency))
+		chargeSellerValue = chargeSellerValue.Add(NewMoney(rowSellerValue, chargeCurrency))
+		chargeBonus = chargeBonus.Add(NewMoney(rowBonus, chargeWalletCurrency))
+		if rowBonusExpiresAt != nil && rowBonusExpiresAt.After(chargeBonusExpiresAt) {
+			chargeBonusExpiresAt = *rowBonusExpiresAt
 		}
-		return fmt.Errorf("locate reservation: %w", err)
 	}
-	if reservationUserID != userID {
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("locate order tx: %w", err)
+	}
+	if chargeID == 0 {
+		// constb: nothing was charged for this order, nothing to refund. must set err to trigger Rollback
+		err = proto.NewInvalidStateError()
+		return 0, err
+	}
+	if chargeUserID != userID {
 		// must set err to trigger Rollback
 		err = proto.NewBadParameterError("user id")
+		return 0, err
+	}
+	if sellerID != "" {
+		// constb: refund of a sale takes money back from seller, blocked seller stops it. frozen one can still be
+		// debited, it is the buyer's money
+		if err = checkAccountStatus(ctx, tx, sellerID, false); err != nil {
+			return 0, err
+		}
+	}
+	if currency != "" && currency != chargeCurrency {
+		// constb: refunds are always made in the currency of the original charge
+		err = proto.NewBadParameterError("currency")
+		return 0, err
+	}
+	refundValue := NewMoney(refundAmount, chargeCurrency)
+	if !refundValue.IsMinorUnits() {
+		// constb: currency may be omitted, so value precision is checked once charge currency is known
+		err = proto.NewBadParameterError("value")
+		return 0, err
+	}
+
+	// 3) SUM PREVIOUS REFUNDS
+	var alreadyRefunded, alreadyRefundedUserValue, alreadyRefundedBonus, alreadyRefundedSellerValue decimal.NullDecimal
+	row = tx.QueryRow(ctx, "SELECT SUM(transaction_value), SUM(recipient_value), SUM(bonus_value), SUM(sender_value) FROM transaction WHERE refund_of = $1", chargeID.Int64())
+	if err = row.Scan(&alreadyRefunded, &alreadyRefundedUserValue, &alreadyRefundedBonus, &alreadyRefundedSellerValue); err != nil {
+		return 0, fmt.Errorf("read refunds: %w", err)
+	}
+	remainingValue := chargeValue.Sub(NewMoney(alreadyRefunded.Decimal, chargeCurrency))
+	remainingUserValue := chargeUserValue.Sub(NewMoney(alreadyRefundedUserValue.Decimal, chargeWalletCurrency))
+	remainingBonus := chargeBonus.Sub(NewMoney(alreadyRefundedBonus.Decimal, chargeWalletCurrency))
+	remainingSellerValue := chargeSellerValue.Sub(NewMoney(alreadyRefundedSellerValue.Decimal, chargeCurrency))
+	if value == "" {
+		refundValue = remainingValue
+	}
+	if !remainingValue.IsPositive() {
+		// constb: order is already refunded completely. must set err to trigger Rollback
+		err = proto.NewInvalidStateError()
+		return 0, err
+	}
+	if refundValue.GreaterThan(remainingValue) {
+		// must set err to trigger Rollback
+		err = proto.NewBadParameterError("value")
+		return 0, err
+	}
+
+	// 4) CALCULATE REFUND IN USER CURRENCY
+	// constb: use the rate of the original charge, not the current one. last refund takes exactly what is left
+	// bonus part and seller's share are refunded in the same proportion as they were charged, commission covers the rest
+	var refundInUserCurrency, refundBonus, refundSellerValue Money
+	if refundValue.Equal(remainingValue) {
+		refundInUserCurrency = remainingUserValue
+		refundBonus = remainingBonus
+		refundSellerValue = remainingSellerValue
+	} else {
+		refundInUserCurrency = chargeUserValue.Share(refundValue.Amount, chargeValue.Amount, d.roundingPolicy)
+		refundBonus = chargeBonus.Share(refundValue.Amount, chargeValue.Amount, d.roundingPolicy).Min(remainingBonus)
+		refundSellerValue = chargeSellerValue.Share(refundValue.Amount, chargeValue.Amount, d.roundingPolicy).Min(remainingSellerValue)
+	}
+	refundCash := refundInUserCurrency.Sub(refundBonus)
+	refundCommission := refundValue.Sub(refundSellerValue)
+	var conv conversion
+	switch {
+	case chargeWalletCurrency == chargeCurrency:
+	case chargeRate.Valid && !chargeRateMixed:
+		conv.rate = chargeRate.Decimal
+		if chargeRateID != nil {
+			conv.rateID = snowflake.ID(*chargeRateID)
+		}
+	default:
+		// constb: refund rate is the average of capture rates. it is not any stored rate set, so none is referenced
+		conv.rate = chargeUserValue.Amount.Div(chargeValue.Amount)
+	}
+
+	// constb: money goes back to the wallet it was charged from
+	userWallet := findWallet(wallets[userID], chargeWalletCurrency)
+	balanceNewValue := userWallet.value.Add(refundCash)
+
+	// 5) CREATE TRANSACTION RECORD AND RETURN MONEY TO BALANCE
+	txID = utils.GenerateID()
+	var bonusParam, bonusExpiresAtParam any
+	if refundBonus.IsPositive() {
+		bonusParam, bonusExpiresAtParam = refundBonus.Amount, chargeBonusExpiresAt
+	}
+	rateIDParam, rateParam := conv.params()
+	var sellerWallet *wallet
+	var sellerNewValue Money
+	if sellerID == "" {
+		_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, recipient_id, recipient_currency, recipient_value,
+                         recipient_balance_before, recipient_balance_after, bonus_value, bonus_expires_at, order_data,
+                         idempotency_key, refund_of, exchange_rate_id, exchange_rate)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+			txID.Int64(), TransactionKindRefund, chargeCurrency, refundValue.Amount, userID, userWallet.currency, refundInUserCurrency.Amount,
+			userWallet.value.Amount, balanceNewValue.Amount, bonusParam, bonusExpiresAtParam, orderData,
+			idempotencyKey, chargeID.Int64(), rateIDParam, rateParam,
+		)
+	} else {
+		// constb: seller gives back their share in charge currency, even if it takes the wallet below zero. returned
+		// commission is stored as commission value of the refund
+		sellerWallet = findWallet(wallets[sellerID], chargeCurrency)
+		sellerNewValue = sellerWallet.value.Sub(refundSellerValue)
+		_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
+                         sender_balance_before, sender_balance_after, recipient_id, recipient_currency, recipient_value,
+                         recipient_balance_before, recipient_balance_after, commission_value, bonus_value,
+                         bonus_expires_at, order_data, idempotency_key, refund_of, exchange_rate_id, exchange_rate)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)`,
+			txID.Int64(), TransactionKindRefund, chargeCurrency, refundValue.Amount, sellerID, chargeCurrency, refundSellerValue.Amount,
+			sellerWallet.value.Amount, sellerNewValue.Amount, userID, userWallet.currency, refundInUserCurrency.Amount,
+			userWallet.value.Amount, balanceNewValue.Amount, refundCommission.Amount, bonusParam,
+			bonusExpiresAtParam, orderData, idempotencyKey, chargeID.Int64(), rateIDParam, rateParam,
+		)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("save user tx: %w", err)
+	}
+	if refundBonus.IsPositive() {
+		// constb: refunded bonus expires when the spent one would, if that is already past it is written off soon
+		if err = addBonus(ctx, tx, txID, userID, refundBonus, chargeBonusExpiresAt); err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+		userID, userWallet.currency, balanceNewValue.Amount,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("update balance: %w", err)
+	}
+	if sellerWallet != nil {
+		_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+			sellerID, chargeCurrency, sellerNewValue.Amount,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("update seller balance: %w", err)
+		}
+		if err = recordDebt(ctx, tx, txID, sellerID, sellerWallet.creditLimit, sellerWallet.available(), sellerWallet.available().Sub(refundSellerValue), orderID, chargeItemID); err != nil {
+			return 0, err
+		}
+	}
+
+	// 6) POST LEDGER ENTRIES (seller's share comes back from seller, only commission is taken from revenue)
+	var entries ledger
+	entries.add(LedgerAccountRevenue, "", refundCommission.Neg())
+	if sellerID != "" {
+		entries.add(LedgerAccountUser, sellerID, refundSellerValue.Neg())
+	}
+	entries.exchange(refundValue, refundInUserCurrency)
+	entries.add(LedgerAccountUser, userID, refundCash)
+	entries.add(LedgerAccountUserBonus, userID, refundBonus)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, err
+	}
+
+	// 7) COLLECT DEBT
+	if _, err = collectDebt(ctx, tx, userID, userWallet.creditLimit, balanceNewValue); err != nil {
+		return 0, err
+	}
+
+	return txID, nil
+}
+
+// Withdraw pays out available (not reserved) funds to external destination described by payoutData.
+func (d *BalanceDatabase) Withdraw(ctx context.Context, idempotencyKey, userID, currency, value, payoutData string) (snowflake.ID, error) {
+	if idempotencyKey == "" {
+		return 0, proto.NewBadParameterError("idempotency key")
+	}
+	if userID == "" {
+		return 0, proto.NewBadParameterError("user id")
+	}
+	if !IsCurrencyValid(currency) {
+		return 0, proto.NewBadParameterError("currency")
+	}
+	withdrawValue, err := ParseMoney(value, currency)
+	if err != nil || !withdrawValue.IsPositive() {
+		return 0, proto.NewBadParameterError("value")
+	}
+	if payoutData != "" && !json.Valid([]byte(payoutData)) {
+		return 0, proto.NewBadParameterError("payout data")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) LOAD WALLETS WITH EXISTING RESERVES AND LOCK FOR UPDATE
+	var wallets map[string][]*wallet
+	wallets, err = lockUserWallets(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if len(wallets[userID]) == 0 {
+		// must set err to trigger Rollback
+		err = proto.NewUserNotFoundError()
+		return 0, err
+	}
+
+	// x) IDEMPOTENCY CHECK
+	var txID snowflake.ID
+	txID, err = findIdempotentTransaction(ctx, tx, idempotencyKey, idempotencyParams{
+		kind:     TransactionKindWithdrawal,
+		senderID: userID,
+		value:    withdrawValue,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if txID != 0 {
+		// constb: payout already was processed earlier, continue as if we have applied it now
+		return txID, nil
+	}
+
+	// x) CHECK ACCOUNT STATUS
+	if err = checkAccountStatus(ctx, tx, userID, true); err != nil {
+		return 0, err
+	}
+
+	// 2) CHOOSE WALLET, CONVERT CURRENCIES IF NEEDED
+	var userWallet *wallet
+	var withdrawInUserCurrency Money
+	var conv conversion
+	userWallet, withdrawInUserCurrency, conv, err = d.pickWallet(wallets[userID], withdrawValue, false, false)
+	if err != nil {
+		return 0, err
+	}
+
+	// 3) CHECK IF USER HAS ENOUGH MONEY (reserved funds can't be paid out, overdraft is never allowed)
+	if userWallet == nil || withdrawInUserCurrency.GreaterThan(userWallet.available()) {
+		// important: set err to Rollback transaction
+		err = proto.NewNotEnoughMoneyError()
+		return 0, err
+	}
+
+	balanceNewValue := userWallet.value.Sub(withdrawInUserCurrency)
+
+	// 4) CREATE TRANSACTION RECORD AND CHARGE FROM BALANCE
+	txID = utils.GenerateID()
+	var payoutDataParam any
+	if payoutData != "" {
+		payoutDataParam = payoutData
+	}
+	rateIDParam, rateParam := conv.params()
+	_, err = tx.Exec(ctx, `
+INSERT INTO transaction (id, kind, transaction_currency, transaction_value, sender_id, sender_currency, sender_value,
+                         sender_balance_before, sender_balance_after, payout_data, idempotency_key, exchange_rate_id,
+                         exchange_rate)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		txID.Int64(), TransactionKindWithdrawal, currency, withdrawValue.Amount, userID, userWallet.currency, withdrawInUserCurrency.Amount,
+		userWallet.value.Amount, balanceNewValue.Amount, payoutDataParam, idempotencyKey, rateIDParam,
+		rateParam,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("save user tx: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE balance SET current_value = $3 WHERE user_id = $1 AND currency = $2`,
+		userID, userWallet.currency, balanceNewValue.Amount,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("update balance: %w", err)
+	}
+
+	// 5) POST LEDGER ENTRIES
+	var entries ledger
+	entries.add(LedgerAccountUser, userID, withdrawInUserCurrency.Neg())
+	entries.exchange(withdrawInUserCurrency, withdrawValue)
+	entries.add(LedgerAccountCashOut, "", withdrawValue)
+	if err = entries.post(ctx, tx, txID); err != nil {
+		return 0, err
+	}
+
+	return txID, nil
+}
+
+// SetCreditLimit sets how far below zero user wallet in given currency may go on reservations and charges. Creates
+// the wallet if it does not exist yet.
+func (d *BalanceDatabase) SetCreditLimit(ctx context.Context, userID, currency, creditLimit string) error {
+	if userID == "" {
+		return proto.NewBadParameterError("user id")
+	}
+	if !IsCurrencyValid(currency) {
+		return proto.NewBadParameterError("currency")
+	}
+	limitValue, err := ParseMoney(creditLimit, currency)
+	if err != nil || limitValue.IsNegative() {
+		return proto.NewBadParameterError("credit limit")
+	}
+
+	// 1) CREATE ZERO WALLET IF NOT EXISTS
+	err = initUserBalance(ctx, d.db, userID, currency)
+	if err != nil {
 		return err
 	}
 
-	// 3) REMOVE RESERVATION
-	_, err = tx.Exec(ctx, "DELETE FROM balance_reserve WHERE order_id = $1", orderID)
+	// 2) UPDATE LIMIT
+	// constb: lowering the limit below what is already used is fine, user just can't spend more until they top up
+	_, err = d.db.Exec(ctx, `UPDATE balance SET credit_limit = $3 WHERE user_id = $1 AND currency = $2`,
+		userID, currency, limitValue.Amount,
+	)
 	if err != nil {
-		return fmt.Errorf("remove reservation: %w", err)
+		return fmt.Errorf("update credit limit: %w", err)
+	}
+
+	return nil
+}
+
+// SetAccountStatus changes user account status. Every change is kept in account_status table with its reason.
+func (d *BalanceDatabase) SetAccountStatus(ctx context.Context, userID, status, reason string) error {
+	if userID == "" {
+		return proto.NewBadParameterError("user id")
+	}
+	if status != AccountStatusActive && status != AccountStatusFrozen && status != AccountStatusBlocked {
+		return proto.NewBadParameterError("status")
+	}
+	if reason == "" {
+		return proto.NewBadParameterError("reason")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) LOCK WALLETS FOR UPDATE (wait for operations in progress)
+	_, err = tx.Exec(ctx, "SELECT 1 FROM balance WHERE user_id = $1 ORDER BY currency FOR UPDATE", userID)
+	if err != nil {
+		return fmt.Errorf("lock balance: %w", err)
+	}
+
+	// 2) SAVE NEW STATUS
+	_, err = tx.Exec(ctx, `INSERT INTO account_status (id, user_id, status, reason) VALUES ($1, $2, $3, $4)`,
+		utils.GenerateID().Int64(), userID, status, reason,
+	)
+	if err != nil {
+		return fmt.Errorf("save account status: %w", err)
 	}
 
 	return nil
 }
+
+// batch operation kinds
+const (
+	BatchOperationTopUp   = "top_up"
+	BatchOperationReserve = "reserve"
+	BatchOperationCommit  = "commit"
+	BatchOperationCancel  = "cancel"
+	BatchOperationAdjust  = "adjust"
+)
+
+const MaxBatchOperations = 1000
+
+// BatchOperation holds parameters of a single batch operation, only those used by its kind are read.
+type BatchOperation struct {
+	Kind           string
+	IdempotencyKey string
+	UserID         string
+	Currency       string
+	Value          string
+	OrderID        string
+	ItemID         string
+	MerchantData   string
+	Pending        bool
+	ExpiresAt      time.Time
+	KeepRemainder  bool
+	SellerID       string
+	Commission     Commission
+}
+
+type BatchResult struct {
+	TxID snowflake.ID
+	Err  error
+}
+
+// Batch applies operations in given order within a single transaction: either all of them are applied or none.
+// Results are returned for operations up to the first failed one, its error is returned as well.
+func (d *BalanceDatabase) Batch(ctx context.Context, operations []BatchOperation) (results []BatchResult, err error) {
+	if len(operations) == 0 || len(operations) > MaxBatchOperations {
+		return nil, proto.NewBadParameterError("operations")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) APPLY OPERATIONS ONE BY ONE, STOP AT FIRST FAILURE
+	// constb: wallets stay locked until the whole batch is committed, concurrent batches touching the same users
+	// in different order may deadlock – postgres aborts one of them and it can simply be retried
+	results = make([]BatchResult, 0, len(operations))
+	for _, op := range operations {
+		var txID snowflake.ID
+		switch op.Kind {
+		case BatchOperationTopUp:
+			txID, err = d.topUp(ctx, tx, op.IdempotencyKey, op.UserID, op.Currency, op.Value, op.MerchantData, op.Pending)
+		case BatchOperationReserve:
+			err = d.reserve(ctx, tx, op.UserID, op.Currency, op.Value, op.OrderID, op.ItemID, op.ExpiresAt)
+		case BatchOperationCommit:
+			txID, err = d.commitReservation(ctx, tx, op.IdempotencyKey, op.UserID, op.Currency, op.Value, op.OrderID, op.ItemID, op.KeepRemainder, op.SellerID, op.Commission)
+		case BatchOperationCancel:
+			err = d.cancelReservation(ctx, tx, op.UserID, op.OrderID, op.ItemID)
+		case BatchOperationAdjust:
+			err = d.adjustReservation(ctx, tx, op.UserID, op.Currency, op.Value, op.OrderID, op.ItemID)
+		default:
+			err = proto.NewBadParameterError("operation")
+		}
+		results = append(results, BatchResult{TxID: txID, Err: err})
+		if err != nil {
+			// constb: nothing is applied, don't report transactions that are about to be rolled back
+			for i := range results {
+				results[i].TxID = 0
+			}
+			return results, err
+		}
+	}
+
+	return results, nil
+}
@@ -6,7 +6,9 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/bwmarrin/snowflake"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
@@ -37,21 +39,50 @@ func balanceDatabaseCleanup(t *testing.T) (*BalanceDatabase, bool) {
 		t.Fatal(err)
 	}
 	//goland:noinspection SqlWithoutWhere
+	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "ledger_entry"`)
+	//goland:noinspection SqlWithoutWhere
+	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "bonus"`)
+	//goland:noinspection SqlWithoutWhere
+	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "debt"`)
+	//goland:noinspection SqlWithoutWhere
 	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "transaction"`)
 	//goland:noinspection SqlWithoutWhere
 	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "balance_reserve"`)
 	//goland:noinspection SqlWithoutWhere
 	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "balance"`)
+	//goland:noinspection SqlWithoutWhere
+	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "account_status"`)
+	//goland:noinspection SqlWithoutWhere
+	_, _ = db.db.Exec(context.TODO(), `DELETE FROM "subscription"`)
 
 	return db, true
 }
 
+// fetchWallet returns available and reserved funds of user wallet in given currency, zeroes if there is no such wallet
+func fetchWallet(t *testing.T, db *BalanceDatabase, userID, currency string) (available, reserved decimal.Decimal) {
+	t.Helper()
+	wallets, err := db.FetchUserBalance(context.TODO(), userID)
+	if err == nil || !strings.Contains(err.Error(), "user not found") {
+		assert.NoErrorf(t, err, "FetchUserBalance(%v)", userID)
+	}
+	for _, w := range wallets {
+		if w.Currency == currency {
+			return w.Available, w.Reserved
+		}
+	}
+	return decimal.Zero, decimal.Zero
+}
+
 func TestBalanceDatabase_TopUp(t *testing.T) {
 	db, ok := balanceDatabaseCleanup(t)
 	if !ok {
 		return
 	}
 
+	errIdempotencyConflictError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "idempotency conflict", "not an idempotency conflict error %v", err)
+	})
+
 	type args struct {
 		idempotencyKey string
 		userID         string
@@ -76,9 +107,11 @@ func TestBalanceDatabase_TopUp(t *testing.T) {
 		// actual top-up
 		{"good top-up", args{"id2", "kwa", "USD", "20.00", `{"test":true}`}, true, assert.NoError, "USD", decimal.NewFromInt(20)},
 		{"second top-up", args{"id3", "kwa", "USD", "30.00", ``}, true, assert.NoError, "USD", decimal.NewFromInt(50)},
-		{"another currency top-up", args{"id4", "kwa", "TRY", "500.00", ``}, true, assert.NoError, "USD", decimal.NewFromFloat(76.85)},
+		{"another currency top-up", args{"id4", "kwa", "TRY", "500.00", ``}, true, assert.NoError, "TRY", decimal.NewFromInt(500)},
 		{"another user top-up", args{"id5", "meow", "TRY", "200.00", ``}, true, assert.NoError, "TRY", decimal.NewFromInt(200)},
 		{"duplicate top-up", args{"id5", "meow", "TRY", "200.00", ``}, true, assert.NoError, "TRY", decimal.NewFromInt(200)},
+		{"conflicting duplicate top-up", args{"id5", "meow", "TRY", "300.00", ``}, false, errIdempotencyConflictError, "", decimal.Zero},
+		{"duplicate key of another user", args{"id5", "kwa", "TRY", "200.00", ``}, false, errIdempotencyConflictError, "", decimal.Zero},
 	}
 
 	for _, tt := range tests {
@@ -92,7 +125,7 @@ func TestBalanceDatabase_TopUp(t *testing.T) {
 
 				var gotCurrency string
 				var gotBalance decimal.Decimal
-				row := db.db.QueryRow(context.TODO(), `SELECT currency, current_value FROM balance WHERE user_id = $1`, tt.args.userID)
+				row := db.db.QueryRow(context.TODO(), `SELECT currency, current_value FROM balance WHERE user_id = $1 AND currency = $2`, tt.args.userID, tt.args.currency)
 				_ = row.Scan(&gotCurrency, &gotBalance)
 				assert.Equalf(t, tt.wantCurrency, gotCurrency, "currency %s/%s", tt.wantCurrency, gotCurrency)
 				assert.Truef(t, tt.wantBalance.Equal(gotBalance), "balance %s/%s", tt.wantBalance.String(), gotBalance.String())
@@ -110,6 +143,271 @@ func TestBalanceDatabase_TopUp(t *testing.T) {
 	}
 }
 
+func TestBalanceDatabase_PendingTopUp(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, err := db.TopUp(context.TODO(), "pending_Test_1", "pete", "USD", "10.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "pending_Test_1")
+	_, err = db.TopUpPending(context.TODO(), "pending_Test_2", "pete", "USD", "50.00", "")
+	assert.NoErrorf(t, err, "TopUpPending(%v)", "pending_Test_2")
+	_, err = db.TopUpPending(context.TODO(), "pending_Test_3", "pete", "USD", "30.00", "")
+	assert.NoErrorf(t, err, "TopUpPending(%v)", "pending_Test_3")
+
+	wallets, err := db.FetchUserBalance(context.TODO(), "pete")
+	assert.NoErrorf(t, err, "FetchUserBalance(%v)", "pete")
+	assert.Equal(t, "10.00", wallets[0].Available.StringFixed(2))
+	assert.Equal(t, "80.00", wallets[0].Pending.StringFixed(2))
+
+	// pending funds can't be spent
+	err = db.Reserve(context.TODO(), "pete", "USD", "20.00", "order1", "item", time.Time{})
+	assert.ErrorContainsf(t, err, "not enough money", "Reserve(%v)", "order1")
+
+	tests := []struct {
+		name        string
+		settle      bool
+		key         string
+		wantErr     assert.ErrorAssertionFunc
+		wantValue   string
+		wantPending string
+	}{
+		{"settle", true, "pending_Test_2", assert.NoError, "60.00", "30.00"},
+		{"settle again", true, "pending_Test_2", assert.NoError, "60.00", "30.00"},
+		{"fail settled", false, "pending_Test_2", assert.Error, "60.00", "30.00"},
+		{"not pending", true, "pending_Test_1", assert.Error, "60.00", "30.00"},
+		{"unknown key", true, "pending_Test_4", assert.Error, "60.00", "30.00"},
+		{"fail", false, "pending_Test_3", assert.NoError, "60.00", "0.00"},
+		{"fail again", false, "pending_Test_3", assert.NoError, "60.00", "0.00"},
+		{"settle failed", true, "pending_Test_3", assert.Error, "60.00", "0.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.settle {
+				err = db.SettleTopUp(context.TODO(), "pete", tt.key)
+			} else {
+				err = db.FailTopUp(context.TODO(), "pete", tt.key)
+			}
+			tt.wantErr(t, err, fmt.Sprintf("settle %v: %v", tt.settle, tt.key))
+
+			wallets, err := db.FetchUserBalance(context.TODO(), "pete")
+			assert.NoErrorf(t, err, "FetchUserBalance(%v)", "pete")
+			assert.Equal(t, tt.wantValue, wallets[0].Available.StringFixed(2))
+			assert.Equal(t, tt.wantPending, wallets[0].Pending.StringFixed(2))
+		})
+	}
+
+	items, _, _, err := db.FetchUserTransactions(context.TODO(), "pete", 10, 0, time.Time{}, time.Time{})
+	assert.NoErrorf(t, err, "FetchUserTransactions(%v)", "pete")
+	if assert.Len(t, items, 3) {
+		assert.Equal(t, TransactionStatusFailed, items[0].Status)
+		assert.Equal(t, TransactionStatusCompleted, items[1].Status)
+		assert.Equal(t, TransactionStatusCompleted, items[2].Status)
+	}
+
+	// retry must be pending if the original top-up was, and vice versa
+	_, err = db.TopUp(context.TODO(), "pending_Test_2", "pete", "USD", "50.00", "")
+	assert.ErrorContainsf(t, err, "idempotency conflict", "TopUp(%v)", "pending_Test_2")
+	_, err = db.TopUpPending(context.TODO(), "pending_Test_1", "pete", "USD", "10.00", "")
+	assert.ErrorContainsf(t, err, "idempotency conflict", "TopUpPending(%v)", "pending_Test_1")
+
+	// blocked account can't get funds settled
+	_, err = db.TopUpPending(context.TODO(), "pending_Test_5", "pete", "USD", "5.00", "")
+	assert.NoErrorf(t, err, "TopUpPending(%v)", "pending_Test_5")
+	assert.NoError(t, db.SetAccountStatus(context.TODO(), "pete", AccountStatusBlocked, "test"))
+	err = db.SettleTopUp(context.TODO(), "pete", "pending_Test_5")
+	assert.ErrorContainsf(t, err, "account is blocked", "SettleTopUp(%v)", "pending_Test_5")
+	assert.NoError(t, db.SetAccountStatus(context.TODO(), "pete", AccountStatusActive, "test"))
+	err = db.SettleTopUp(context.TODO(), "pete", "pending_Test_5")
+	assert.NoErrorf(t, err, "SettleTopUp(%v)", "pending_Test_5")
+}
+
+func TestBalanceDatabase_Reverse(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	topUpID, _ := db.TopUp(context.TODO(), "reverse_Test_1", "rita", "EUR", "30.00", "")
+	_, _ = db.TopUp(context.TODO(), "reverse_Test_2", "rita", "EUR", "50.00", "")
+	_, _ = db.TopUpPending(context.TODO(), "reverse_Test_3", "rita", "EUR", "10.00", "")
+	_, _ = db.Withdraw(context.TODO(), "reverse_Test_4", "rita", "EUR", "60.00", "")
+	_, _ = db.Transfer(context.TODO(), "reverse_Test_5", "rita", "sam", "EUR", "5.00")
+
+	tests := []struct {
+		name      string
+		topUpID   snowflake.ID
+		key       string
+		wantErr   assert.ErrorAssertionFunc
+		wantValue decimal.Decimal
+	}{
+		{"nothing", 0, "", assert.Error, decimal.NewFromInt(15)},
+		{"unknown key", 0, "reverse_Test_6", assert.Error, decimal.NewFromInt(15)},
+		{"not a top-up", 0, "reverse_Test_4", assert.Error, decimal.NewFromInt(15)},
+		{"pending", 0, "reverse_Test_3", assert.Error, decimal.NewFromInt(15)},
+		{"by id", topUpID, "", assert.NoError, decimal.NewFromInt(-15)},
+		{"by id again", topUpID, "", assert.NoError, decimal.NewFromInt(-15)},
+		{"by key into debt", 0, "reverse_Test_2", assert.NoError, decimal.NewFromInt(-65)},
+		{"by key again", 0, "reverse_Test_2", assert.NoError, decimal.NewFromInt(-65)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, userID, err := db.Reverse(context.TODO(), tt.topUpID, tt.key)
+			if tt.wantErr(t, err, fmt.Sprintf("Reverse(%v, %v)", tt.topUpID, tt.key)) && err == nil {
+				assert.Equal(t, "rita", userID)
+			}
+
+			available, _ := fetchWallet(t, db, "rita", "EUR")
+			assert.Truef(t, available.Equal(tt.wantValue), "got: %v want: %v", available.String(), tt.wantValue.String())
+		})
+	}
+
+	items, _, _, err := db.FetchUserTransactions(context.TODO(), "rita", 10, 0, time.Time{}, time.Time{})
+	assert.NoErrorf(t, err, "FetchUserTransactions(%v)", "rita")
+	var reversals, reversed int
+	for _, item := range items {
+		if item.Kind == TransactionKindReversal {
+			reversals++
+		}
+		if item.Status == TransactionStatusReversed {
+			reversed++
+		}
+	}
+	assert.Equal(t, 2, reversals, "reversals")
+	assert.Equal(t, 2, reversed, "reversed top-ups")
+
+	// whatever went below zero is tracked as debt
+	var debt decimal.Decimal
+	err = db.db.QueryRow(context.TODO(), `SELECT coalesce(SUM(remaining_value), 0) FROM debt WHERE user_id = $1`, "rita").Scan(&debt)
+	assert.NoError(t, err)
+	assert.Truef(t, debt.Equal(decimal.NewFromInt(65)), "debt got: %v want: %v", debt.String(), "65")
+}
+
+func TestBalanceDatabase_Debt(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	// reserve in another currency, take everything else out, then reverse the top-up and commit the reservation:
+	// reserved money is owed to the merchant, so the whole top-up is user's debt, released rate buffer repays some
+	topUpID, err := db.TopUp(context.TODO(), "debt_Test_1", "tina", "EUR", "100.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "debt_Test_1")
+	err = db.Reserve(context.TODO(), "tina", "USD", "50.00", "order1", "item", time.Time{})
+	assert.NoErrorf(t, err, "Reserve(%v)", "order1")
+	available, _ := fetchWallet(t, db, "tina", "EUR")
+	_, err = db.Withdraw(context.TODO(), "debt_Test_2", "tina", "EUR", available.StringFixed(2), "")
+	assert.NoErrorf(t, err, "Withdraw(%v)", "debt_Test_2")
+	reversalID, _, err := db.Reverse(context.TODO(), topUpID, "")
+	assert.NoErrorf(t, err, "Reverse(%v)", topUpID)
+	_, err = db.CommitReservation(context.TODO(), "", "tina", "USD", "50.00", "order1", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation(%v)", "order1")
+
+	available, _ = fetchWallet(t, db, "tina", "EUR")
+	overdrafts, err := db.FetchOverdrafts(context.TODO())
+	assert.NoError(t, err, "FetchOverdrafts()")
+	if assert.Len(t, overdrafts, 1) && assert.Len(t, overdrafts[0].Debts, 1) {
+		assert.Equal(t, "tina", overdrafts[0].UserID)
+		assert.Equal(t, available.StringFixed(2), overdrafts[0].Available.StringFixed(2))
+		debts := overdrafts[0].Debts
+		assert.Equal(t, "100.00", debts[0].Value.StringFixed(2))
+		assert.Equal(t, reversalID, debts[0].TransactionID)
+		assert.Empty(t, debts[0].OrderID)
+		assert.Equal(t, available.Neg().StringFixed(2), debts[0].Remaining.StringFixed(2))
+		assert.True(t, debts[0].Remaining.LessThan(debts[0].Value), "rate buffer repaid")
+	}
+
+	// partial repayment leaves the rest owed
+	_, err = db.TopUp(context.TODO(), "debt_Test_3", "tina", "EUR", "20.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "debt_Test_3")
+	overdrafts, err = db.FetchOverdrafts(context.TODO())
+	assert.NoError(t, err, "FetchOverdrafts()")
+	if assert.Len(t, overdrafts, 1) && assert.Len(t, overdrafts[0].Debts, 1) {
+		assert.Equal(t, available.Neg().Sub(decimal.NewFromInt(20)).StringFixed(2), overdrafts[0].Debts[0].Remaining.StringFixed(2))
+	}
+
+	// pending top-up repays the rest once settled
+	_, err = db.TopUpPending(context.TODO(), "debt_Test_4", "tina", "EUR", "1000.00", "")
+	assert.NoErrorf(t, err, "TopUpPending(%v)", "debt_Test_4")
+	overdrafts, _ = db.FetchOverdrafts(context.TODO())
+	assert.Len(t, overdrafts, 1)
+	err = db.SettleTopUp(context.TODO(), "tina", "debt_Test_4")
+	assert.NoErrorf(t, err, "SettleTopUp(%v)", "debt_Test_4")
+	overdrafts, _ = db.FetchOverdrafts(context.TODO())
+	assert.Len(t, overdrafts, 0)
+
+	var outstanding int
+	err = db.db.QueryRow(context.TODO(), `SELECT COUNT(*) FROM debt WHERE user_id = $1 AND (remaining_value > 0 OR repaid_at IS NULL)`, "tina").Scan(&outstanding)
+	assert.NoError(t, err)
+	assert.Zero(t, outstanding, "outstanding debts")
+
+	items, _, _, err := db.FetchUserTransactions(context.TODO(), "tina", 20, 0, time.Time{}, time.Time{})
+	assert.NoErrorf(t, err, "FetchUserTransactions(%v)", "tina")
+	var repayments int
+	for _, item := range items {
+		if item.Kind == TransactionKindRepayment {
+			repayments++
+		}
+	}
+	assert.Equal(t, 3, repayments, "repayments") // released rate buffer, partial and settled top-ups
+
+	// spending within credit limit is not a debt, incoming transfer repays what is beyond it
+	topUpID, err = db.TopUp(context.TODO(), "debt_Test_5", "uma", "EUR", "30.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "debt_Test_5")
+	assert.NoError(t, db.SetCreditLimit(context.TODO(), "uma", "EUR", "20.00"))
+	_, err = db.Withdraw(context.TODO(), "debt_Test_6", "uma", "EUR", "30.00", "")
+	assert.NoErrorf(t, err, "Withdraw(%v)", "debt_Test_6")
+	_, _, err = db.Reverse(context.TODO(), topUpID, "")
+	assert.NoErrorf(t, err, "Reverse(%v)", topUpID)
+	_, err = db.Transfer(context.TODO(), "debt_Test_7", "tina", "uma", "EUR", "5.00")
+	assert.NoErrorf(t, err, "Transfer(%v)", "debt_Test_7")
+	overdrafts, _ = db.FetchOverdrafts(context.TODO())
+	if assert.Len(t, overdrafts, 1) && assert.Len(t, overdrafts[0].Debts, 1) {
+		assert.Equal(t, "uma", overdrafts[0].UserID)
+		assert.Equal(t, "10.00", overdrafts[0].Debts[0].Value.StringFixed(2))
+		assert.Equal(t, "5.00", overdrafts[0].Debts[0].Remaining.StringFixed(2))
+	}
+
+	// reversing reserved money is a debt, commit of the reservation still goes through and doesn't add to it
+	topUpID, err = db.TopUp(context.TODO(), "debt_Test_8", "vera", "EUR", "100.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "debt_Test_8")
+	err = db.Reserve(context.TODO(), "vera", "EUR", "80.00", "order2", "item", time.Time{})
+	assert.NoErrorf(t, err, "Reserve(%v)", "order2")
+	reversalID, _, err = db.Reverse(context.TODO(), topUpID, "")
+	assert.NoErrorf(t, err, "Reverse(%v)", topUpID)
+	_, err = db.CommitReservation(context.TODO(), "", "vera", "EUR", "80.00", "order2", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation(%v)", "order2")
+	available, reserved := fetchWallet(t, db, "vera", "EUR")
+	assert.Truef(t, available.Equal(decimal.NewFromInt(-80)), "available got: %v want: %v", available.String(), "-80")
+	assert.Truef(t, reserved.IsZero(), "reserved got: %v want: %v", reserved.String(), "0")
+	overdrafts, _ = db.FetchOverdrafts(context.TODO())
+	if assert.Len(t, overdrafts, 2) && assert.Len(t, overdrafts[1].Debts, 1) {
+		assert.Equal(t, "vera", overdrafts[1].UserID)
+		assert.Equal(t, reversalID, overdrafts[1].Debts[0].TransactionID)
+		assert.Equal(t, "80.00", overdrafts[1].Debts[0].Remaining.StringFixed(2))
+	}
+
+	// cancelled reservation releases cash that repays the debt
+	topUpID, err = db.TopUp(context.TODO(), "debt_Test_9", "wren", "EUR", "100.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "debt_Test_9")
+	err = db.Reserve(context.TODO(), "wren", "EUR", "80.00", "order3", "item", time.Time{})
+	assert.NoErrorf(t, err, "Reserve(%v)", "order3")
+	_, _, err = db.Reverse(context.TODO(), topUpID, "")
+	assert.NoErrorf(t, err, "Reverse(%v)", topUpID)
+	err = db.CancelReservation(context.TODO(), "wren", "order3", "item")
+	assert.NoErrorf(t, err, "CancelReservation(%v)", "order3")
+	err = db.db.QueryRow(context.TODO(), `SELECT COUNT(*) FROM debt WHERE user_id = $1 AND remaining_value > 0`, "wren").Scan(&outstanding)
+	assert.NoError(t, err)
+	assert.Zero(t, outstanding, "outstanding debts")
+
+	// ledger debt account holds what is still owed
+	var booked decimal.Decimal
+	err = db.db.QueryRow(context.TODO(), `SELECT coalesce(SUM(amount), 0) FROM ledger_entry WHERE account = $1`, LedgerAccountDebt).Scan(&booked)
+	assert.NoError(t, err)
+	assert.Truef(t, booked.Equal(decimal.NewFromInt(85)), "debt account got: %v want: %v", booked.String(), "85")
+}
+
 func TestBalanceDatabase_Reserve(t *testing.T) {
 	db, ok := balanceDatabaseCleanup(t)
 	if !ok {
@@ -122,6 +420,9 @@ func TestBalanceDatabase_Reserve(t *testing.T) {
 	errNoMoneyError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
 		return assert.ErrorContainsf(t, err, "not enough money", "not a money error %v", err)
 	})
+	errIdempotencyConflictError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "idempotency conflict", "not an idempotency conflict error %v", err)
+	})
 
 	type args struct {
 		userID   string
@@ -141,6 +442,8 @@ func TestBalanceDatabase_Reserve(t *testing.T) {
 
 		{"success, same currency", args{"orlando", "EUR", "100.00", "order002", "item"}, assert.NoError, decimal.NewFromFloat(100)},
 		{"success, duplicate", args{"orlando", "EUR", "100.00", "order002", "item"}, assert.NoError, decimal.NewFromFloat(100)},
+		{"fail, duplicate with another value", args{"orlando", "EUR", "120.00", "order002", "item"}, errIdempotencyConflictError, decimal.NewFromFloat(100)},
+		{"fail, duplicate with another user", args{"miguel", "EUR", "10.00", "order002", "item"}, errIdempotencyConflictError, decimal.Zero},
 		{"success, diff currency", args{"orlando", "USD", "50.00", "order003", "item"}, assert.NoError, decimal.NewFromFloat(151.23)},
 		{"fail, diff currency, no extra 6%", args{"orlando", "USD", "50.00", "order004", "item"}, errNoMoneyError, decimal.NewFromFloat(151.23)},
 		{"fail, no money", args{"miguel", "EUR", "100.00", "order005", "item"}, errNoMoneyError, decimal.Zero},
@@ -149,11 +452,10 @@ func TestBalanceDatabase_Reserve(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := db.Reserve(context.TODO(), tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID)
+			err := db.Reserve(context.TODO(), tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID, time.Time{})
 			tt.wantErr(t, err, fmt.Sprintf("Reserve(%v, %v, %v, %v, %v, %v)", "ctx", tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID))
 			if tt.args.userID != "" {
-				_, _, reserve, err := db.FetchUserBalance(context.TODO(), tt.args.userID)
-				assert.NoErrorf(t, err, "FetchUserBalance(%v)", tt.args.userID)
+				_, reserve := fetchWallet(t, db, tt.args.userID, "EUR")
 				assert.Truef(t, reserve.Equal(tt.wantReserve), "reserve got: %v want: %v", reserve.String(), tt.wantReserve.String())
 			}
 		})
@@ -172,6 +474,9 @@ func TestBalanceDatabase_CommitReservation(t *testing.T) {
 	errNoMoneyError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
 		return assert.ErrorContainsf(t, err, "not enough money", "not a money error %v", err)
 	})
+	errIdempotencyConflictError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "idempotency conflict", "not an idempotency conflict error %v", err)
+	})
 
 	type args struct {
 		userID   string
@@ -190,6 +495,8 @@ func TestBalanceDatabase_CommitReservation(t *testing.T) {
 	}{
 		{"success, same currency, no reserve", false, args{"orlando", "EUR", "10.00", "order1", ""}, assert.NoError, decimal.NewFromInt(190), decimal.Zero},
 		{"success, duplicate, no reserve", false, args{"orlando", "EUR", "10.00", "order1", ""}, assert.NoError, decimal.NewFromInt(190), decimal.Zero},
+		{"fail, duplicate with another value", false, args{"orlando", "EUR", "20.00", "order1", ""}, errIdempotencyConflictError, decimal.NewFromInt(190), decimal.Zero},
+		{"fail, duplicate with another currency", false, args{"orlando", "USD", "10.00", "order1", ""}, errIdempotencyConflictError, decimal.NewFromInt(190), decimal.Zero},
 		{"success, same currency, with reserve", true, args{"orlando", "EUR", "10.00", "order2", ""}, assert.NoError, decimal.NewFromInt(180), decimal.Zero},
 		{"success, diff currency, no reserve", false, args{"orlando", "TRY", "50.00", "order3", ""}, assert.NoError, decimal.NewFromFloat(177.4), decimal.Zero},
 		{"success, diff currency, with reserve", true, args{"orlando", "TRY", "50.00", "order4", ""}, assert.NoError, decimal.NewFromFloat(174.8), decimal.Zero},
@@ -199,22 +506,19 @@ func TestBalanceDatabase_CommitReservation(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if tt.reserve {
-				_, _, reserve, err := db.FetchUserBalance(context.TODO(), tt.args.userID)
-				assert.NoErrorf(t, err, "FetchUserBalance(%v)", tt.args.userID)
+				_, reserve := fetchWallet(t, db, tt.args.userID, "EUR")
 				assert.Falsef(t, reserve.GreaterThan(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "0")
 
-				err = db.Reserve(context.TODO(), tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID)
+				err := db.Reserve(context.TODO(), tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID, time.Time{})
 				assert.NoErrorf(t, err, "Reserve(%v, %v, %v, %v, %v, %v)", "ctx", tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID)
 
-				_, _, reserve, err = db.FetchUserBalance(context.TODO(), tt.args.userID)
-				assert.NoErrorf(t, err, "FetchUserBalance(%v)", tt.args.userID)
+				_, reserve = fetchWallet(t, db, tt.args.userID, "EUR")
 				assert.Truef(t, reserve.GreaterThan(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "> 0")
 			}
-			_, err := db.CommitReservation(context.TODO(), tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID)
+			_, err := db.CommitReservation(context.TODO(), "", tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID, false)
 			tt.wantErr(t, err, fmt.Sprintf("CommitReservation(%v, %v, %v, %v, %v, %v)", "ctx", tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID))
 			if tt.args.userID != "" {
-				_, available, reserve, err := db.FetchUserBalance(context.TODO(), tt.args.userID)
-				assert.NoErrorf(t, err, "FetchUserBalance(%v)", tt.args.userID)
+				available, reserve := fetchWallet(t, db, tt.args.userID, "EUR")
 				assert.Truef(t, available.Equal(tt.wantBalance), "available got: %v want: %v", available.String(), tt.wantBalance.String())
 				assert.Truef(t, reserve.Equal(tt.wantReserve), "reserve got: %v want: %v", reserve.String(), tt.wantReserve.String())
 			}
@@ -237,34 +541,91 @@ func TestBalanceDatabase_CommitReservation(t *testing.T) {
 		secondCommit = secondCommit.Div(secondUsdRate).RoundBank(2)
 
 		// ensure no reserve
-		_, _, reserve, err := db.FetchUserBalance(context.TODO(), userID)
-		assert.NoErrorf(t, err, "FetchUserBalance(%v)", userID)
+		_, reserve := fetchWallet(t, db, userID, "EUR")
 		assert.Falsef(t, reserve.GreaterThan(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "0")
 
 		// reserve with first currency rate + 6%
-		rates["USD"] = firstUsdRate
+		setRate("USD", firstUsdRate)
 
-		err = db.Reserve(context.TODO(), userID, currency, value, orderID, itemID)
+		err := db.Reserve(context.TODO(), userID, currency, value, orderID, itemID, time.Time{})
 		assert.NoErrorf(t, err, "Reserve(%v, %v, %v, %v, %v, %v)", "ctx", userID, currency, value, orderID, itemID)
 
 		// ensure reserved
-		_, available, reserve, err := db.FetchUserBalance(context.TODO(), userID)
-		assert.NoErrorf(t, err, "FetchUserBalance(%v)", userID)
+		available, reserve := fetchWallet(t, db, userID, "EUR")
 		assert.Truef(t, available.Equal(decimal.NewFromInt(50).Sub(firstReserve)), "available got: %v want: %v", available.String(), decimal.NewFromInt(50).Sub(firstReserve).String())
 		assert.Truef(t, reserve.Equal(firstReserve), "reserve got: %v want: %v", reserve.String(), firstReserve.String())
 
 		// commit with second currency rate precisely, rate makes user go above balance, cause overdraft
-		rates["USD"] = secondUsdRate
-		txID, err := db.CommitReservation(context.TODO(), userID, currency, value, orderID, itemID)
+		setRate("USD", secondUsdRate)
+		txID, err := db.CommitReservation(context.TODO(), "", userID, currency, value, orderID, itemID, false)
 		assert.NoErrorf(t, err, "CommitReservation(%v, %v, %v, %v, %v, %v)", "ctx", userID, currency, value, orderID, itemID)
 		assert.Greaterf(t, txID.Int64(), int64(0), "txID %v > 0", txID)
 
 		// ensure overdraft is allowed, balance becomes negative
-		_, available, reserve, err = db.FetchUserBalance(context.TODO(), userID)
-		assert.NoErrorf(t, err, "FetchUserBalance(%v)", userID)
+		available, reserve = fetchWallet(t, db, userID, "EUR")
 		assert.Truef(t, available.Equal(decimal.NewFromInt(50).Sub(secondCommit)), "available got: %v want: %v", available.String(), decimal.NewFromInt(50).Sub(secondCommit).String())
 		assert.Truef(t, reserve.Equal(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "0")
 	})
+
+	t.Run("partial captures scenario", func(t *testing.T) {
+		userID := "masal"
+		currency := "TRY"
+		orderID := "orderP"
+		itemID := "item"
+
+		_, err := db.TopUp(context.TODO(), "commit_Test_3", userID, currency, "100.00", "")
+		assert.NoErrorf(t, err, "TopUp(%v)", userID)
+		err = db.Reserve(context.TODO(), userID, currency, "60.00", orderID, itemID, time.Time{})
+		assert.NoErrorf(t, err, "Reserve(%v)", orderID)
+
+		steps := []struct {
+			name           string
+			idempotencyKey string
+			value          string
+			keepRemainder  bool
+			wantErr        assert.ErrorAssertionFunc
+			wantAvailable  decimal.Decimal
+			wantReserve    decimal.Decimal
+		}{
+			{"first capture", "cap1", "20.00", true, assert.NoError, decimal.NewFromInt(40), decimal.NewFromInt(40)},
+			{"first capture retry", "cap1", "20.00", true, assert.NoError, decimal.NewFromInt(40), decimal.NewFromInt(40)},
+			{"keep remainder without key", "", "10.00", true, assert.Error, decimal.NewFromInt(40), decimal.NewFromInt(40)},
+			{"capture more than left", "cap2", "50.00", true, assert.Error, decimal.NewFromInt(40), decimal.NewFromInt(40)},
+			{"last capture releases the rest", "cap3", "10.00", false, assert.NoError, decimal.NewFromInt(70), decimal.Zero},
+			{"capture after release", "cap4", "10.00", true, assert.Error, decimal.NewFromInt(70), decimal.Zero},
+		}
+		for _, step := range steps {
+			_, err = db.CommitReservation(context.TODO(), step.idempotencyKey, userID, currency, step.value, orderID, itemID, step.keepRemainder)
+			step.wantErr(t, err, "%s: CommitReservation(%v, %v, %v)", step.name, step.idempotencyKey, step.value, step.keepRemainder)
+
+			available, reserve := fetchWallet(t, db, userID, currency)
+			assert.Truef(t, available.Equal(step.wantAvailable), "%s: available got: %v want: %v", step.name, available.String(), step.wantAvailable.String())
+			assert.Truef(t, reserve.Equal(step.wantReserve), "%s: reserve got: %v want: %v", step.name, reserve.String(), step.wantReserve.String())
+		}
+	})
+
+	t.Run("capture releases the rest by default", func(t *testing.T) {
+		userID := "masal"
+		currency := "TRY"
+		orderID := "orderD"
+		itemID := "item"
+
+		err := db.Reserve(context.TODO(), userID, currency, "30.00", orderID, itemID, time.Time{})
+		assert.NoErrorf(t, err, "Reserve(%v)", orderID)
+		_, err = db.CommitReservation(context.TODO(), "", userID, currency, "10.00", orderID, itemID, false)
+		assert.NoErrorf(t, err, "CommitReservation(%v)", orderID)
+
+		available, reserve := fetchWallet(t, db, userID, currency)
+		assert.Truef(t, available.Equal(decimal.NewFromInt(60)), "available got: %v want: %v", available.String(), "60")
+		assert.Truef(t, reserve.Equal(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "0")
+
+		// keyless retry is matched with the charge, the released rest is not captured
+		_, err = db.CommitReservation(context.TODO(), "", userID, currency, "10.00", orderID, itemID, false)
+		assert.NoErrorf(t, err, "CommitReservation(%v)", orderID)
+		available, reserve = fetchWallet(t, db, userID, currency)
+		assert.Truef(t, available.Equal(decimal.NewFromInt(60)), "available got: %v want: %v", available.String(), "60")
+		assert.Truef(t, reserve.Equal(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "0")
+	})
 }
 
 func TestBalanceDatabase_CancelReservation(t *testing.T) {
@@ -274,9 +635,9 @@ func TestBalanceDatabase_CancelReservation(t *testing.T) {
 	}
 
 	_, _ = db.TopUp(context.TODO(), "cancel_Test_1", "masal", "TRY", "50.00", "")
-	_, _ = db.CommitReservation(context.TODO(), "masal", "TRY", "13.00", "order1", "item")
-	_ = db.Reserve(context.TODO(), "masal", "TRY", "20.00", "order2", "item")
-	_ = db.Reserve(context.TODO(), "masal", "TRY", "17.00", "order3", "item")
+	_, _ = db.CommitReservation(context.TODO(), "", "masal", "TRY", "13.00", "order1", "item", false)
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "20.00", "order2", "item", time.Time{})
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "17.00", "order3", "item", time.Time{})
 
 	errUserNotFoundError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
 		return assert.ErrorContainsf(t, err, "user not found", "not a user error %v", err)
@@ -308,11 +669,874 @@ func TestBalanceDatabase_CancelReservation(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.wantErr(t, db.CancelReservation(context.TODO(), tt.args.userID, tt.args.orderID, tt.args.itemID), fmt.Sprintf("CancelReservation(%v, %v, %v, %v)", "ctx", tt.args.userID, tt.args.orderID, tt.args.itemID))
 			if tt.checkBalance {
-				_, available, reserve, err := db.FetchUserBalance(context.TODO(), tt.args.userID)
-				assert.NoErrorf(t, err, "FetchUserBalance(%v)", tt.args.userID)
+				available, reserve := fetchWallet(t, db, tt.args.userID, "TRY")
 				assert.Truef(t, available.Equal(tt.wantAvailable), "available got: %v want: %v", available.String(), tt.wantAvailable.String())
 				assert.Truef(t, reserve.Equal(tt.wantReserve), "reserve got: %v want: %v", reserve.String(), tt.wantReserve.String())
 			}
 		})
 	}
+
+	t.Run("several items of one order", func(t *testing.T) {
+		userID := "masal"
+		orderID := "order9"
+
+		for _, item := range []struct{ itemID, value string }{{"itemA", "5.00"}, {"itemB", "6.00"}, {"itemC", "7.00"}} {
+			err := db.Reserve(context.TODO(), userID, "TRY", item.value, orderID, item.itemID, time.Time{})
+			assert.NoErrorf(t, err, "Reserve(%v, %v)", orderID, item.itemID)
+		}
+		_, reserve := fetchWallet(t, db, userID, "TRY")
+		assert.Truef(t, reserve.Equal(decimal.NewFromInt(18)), "reserve got: %v want: %v", reserve.String(), "18")
+
+		_, err := db.CommitReservation(context.TODO(), "", userID, "TRY", "5.00", orderID, "itemA", false)
+		assert.NoErrorf(t, err, "CommitReservation(%v, %v)", orderID, "itemA")
+		err = db.Reserve(context.TODO(), userID, "TRY", "5.00", orderID, "itemA", time.Time{})
+		errInvalidStateError(t, err, "Reserve(%v, %v) after commit", orderID, "itemA")
+
+		err = db.CancelReservation(context.TODO(), userID, orderID, "itemB")
+		assert.NoErrorf(t, err, "CancelReservation(%v, %v)", orderID, "itemB")
+		available, reserve := fetchWallet(t, db, userID, "TRY")
+		assert.Truef(t, available.Equal(decimal.NewFromInt(25)), "available got: %v want: %v", available.String(), "25")
+		assert.Truef(t, reserve.Equal(decimal.NewFromInt(7)), "reserve got: %v want: %v", reserve.String(), "7")
+
+		err = db.CancelReservation(context.TODO(), userID, orderID, "")
+		assert.NoErrorf(t, err, "CancelReservation(%v)", orderID)
+		available, reserve = fetchWallet(t, db, userID, "TRY")
+		assert.Truef(t, available.Equal(decimal.NewFromInt(32)), "available got: %v want: %v", available.String(), "32")
+		assert.Truef(t, reserve.Equal(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "0")
+	})
+}
+
+func TestBalanceDatabase_CommitSale(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, _ = db.TopUp(context.TODO(), "sale_Test_1", "masal", "TRY", "100.00", "")
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "40.00", "order1", "item", time.Time{})
+
+	errIdempotencyConflictError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "idempotency conflict", "not an idempotency conflict error %v", err)
+	})
+
+	type args struct {
+		sellerID   string
+		value      string
+		orderID    string
+		commission Commission
+	}
+	tests := []struct {
+		name            string
+		args            args
+		wantErr         assert.ErrorAssertionFunc
+		wantBuyerValue  decimal.Decimal
+		wantSellerValue decimal.Decimal
+	}{
+		{"no seller", args{"", "10.00", "order2", Commission{}}, assert.Error, decimal.NewFromInt(60), decimal.Zero},
+		{"seller is buyer", args{"masal", "10.00", "order2", Commission{}}, assert.Error, decimal.NewFromInt(60), decimal.Zero},
+		{"bad commission", args{"lara", "10.00", "order2", Commission{Percent: "120"}}, assert.Error, decimal.NewFromInt(60), decimal.Zero},
+		{"commission above value", args{"lara", "10.00", "order2", Commission{Percent: "50", Fixed: "6.00"}}, assert.Error, decimal.NewFromInt(60), decimal.Zero},
+
+		{"success, reserved", args{"lara", "40.00", "order1", Commission{Percent: "5", Fixed: "0.50"}}, assert.NoError, decimal.NewFromInt(60), decimal.NewFromFloat(37.5)},
+		{"success, not reserved", args{"lara", "10.00", "order2", Commission{Percent: "2.5"}}, assert.NoError, decimal.NewFromInt(50), decimal.NewFromFloat(47.25)},
+		{"success, duplicate", args{"lara", "10.00", "order2", Commission{Percent: "2.5"}}, assert.NoError, decimal.NewFromInt(50), decimal.NewFromFloat(47.25)},
+		{"fail, duplicate with another seller", args{"ivan", "10.00", "order2", Commission{Percent: "2.5"}}, errIdempotencyConflictError, decimal.NewFromInt(50), decimal.NewFromFloat(47.25)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := db.CommitSale(context.TODO(), "", "masal", tt.args.sellerID, "TRY", tt.args.value, tt.args.orderID, "item", false, tt.args.commission)
+			tt.wantErr(t, err, fmt.Sprintf("CommitSale(%v, %v, %v, %v)", tt.args.sellerID, tt.args.value, tt.args.orderID, tt.args.commission))
+
+			available, _ := fetchWallet(t, db, "masal", "TRY")
+			assert.Truef(t, available.Equal(tt.wantBuyerValue), "buyer got: %v want: %v", available.String(), tt.wantBuyerValue.String())
+			available, _ = fetchWallet(t, db, "lara", "TRY")
+			assert.Truef(t, available.Equal(tt.wantSellerValue), "seller got: %v want: %v", available.String(), tt.wantSellerValue.String())
+		})
+	}
+
+	// refunds take seller's share back from seller, commission from the platform
+	refunds := []struct {
+		name            string
+		idempotencyKey  string
+		value           string
+		wantErr         assert.ErrorAssertionFunc
+		wantBuyerValue  decimal.Decimal
+		wantSellerValue decimal.Decimal
+	}{
+		{"partial refund", "sale_Test_2", "8.00", assert.NoError, decimal.NewFromInt(58), decimal.NewFromFloat(39.75)},
+		{"partial refund retry", "sale_Test_2", "8.00", assert.NoError, decimal.NewFromInt(58), decimal.NewFromFloat(39.75)},
+		{"refund the rest", "sale_Test_3", "", assert.NoError, decimal.NewFromInt(90), decimal.NewFromFloat(9.75)},
+		{"nothing left", "sale_Test_4", "", assert.Error, decimal.NewFromInt(90), decimal.NewFromFloat(9.75)},
+	}
+	for _, step := range refunds {
+		_, err := db.Refund(context.TODO(), step.idempotencyKey, "masal", "", step.value, "order1", "item")
+		step.wantErr(t, err, "%s: Refund(%v, %v)", step.name, step.idempotencyKey, step.value)
+
+		available, _ := fetchWallet(t, db, "masal", "TRY")
+		assert.Truef(t, available.Equal(step.wantBuyerValue), "%s: buyer got: %v want: %v", step.name, available.String(), step.wantBuyerValue.String())
+		available, _ = fetchWallet(t, db, "lara", "TRY")
+		assert.Truef(t, available.Equal(step.wantSellerValue), "%s: seller got: %v want: %v", step.name, available.String(), step.wantSellerValue.String())
+	}
+
+	var commission decimal.Decimal
+	err := db.db.QueryRow(context.TODO(), `SELECT SUM(commission_value) FROM transaction WHERE kind = $1`, TransactionKindRefund).Scan(&commission)
+	assert.NoError(t, err)
+	assert.Truef(t, commission.Equal(decimal.NewFromFloat(2.5)), "refunded commission got: %v want: %v", commission.String(), "2.5")
+}
+
+func TestBalanceDatabase_AdjustReservation(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, _ = db.TopUp(context.TODO(), "adjust_Test_1", "masal", "TRY", "100.00", "")
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "40.00", "order1", "item", time.Time{})
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "20.00", "order2", "item", time.Time{})
+	_, _ = db.CommitReservation(context.TODO(), "adjust_Test_2", "masal", "TRY", "5.00", "order2", "item", true)
+	_, _ = db.CommitReservation(context.TODO(), "", "masal", "TRY", "10.00", "order3", "item", false)
+
+	errNoMoneyError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "not enough money", "not a money error %v", err)
+	})
+	errInvalidStateError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "invalid state", "not an invalid state error %v", err)
+	})
+
+	type args struct {
+		userID   string
+		currency string
+		value    string
+		orderID  string
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantErr     assert.ErrorAssertionFunc
+		wantReserve decimal.Decimal
+	}{
+		{"no reservation", args{"masal", "TRY", "10.00", "order3"}, errInvalidStateError, decimal.NewFromInt(55)},
+		{"another user", args{"lara", "TRY", "10.00", "order1"}, assert.Error, decimal.NewFromInt(55)},
+		{"another currency", args{"masal", "USD", "10.00", "order1"}, assert.Error, decimal.NewFromInt(55)},
+		{"below captured", args{"masal", "TRY", "5.00", "order2"}, assert.Error, decimal.NewFromInt(55)},
+
+		{"lower", args{"masal", "TRY", "30.00", "order1"}, assert.NoError, decimal.NewFromInt(45)},
+		{"lower partially captured", args{"masal", "TRY", "10.00", "order2"}, assert.NoError, decimal.NewFromInt(35)},
+		{"raise", args{"masal", "TRY", "70.00", "order1"}, assert.NoError, decimal.NewFromInt(75)},
+		{"raise, duplicate", args{"masal", "TRY", "70.00", "order1"}, assert.NoError, decimal.NewFromInt(75)},
+		{"raise above available", args{"masal", "TRY", "81.00", "order1"}, errNoMoneyError, decimal.NewFromInt(75)},
+		{"raise up to available", args{"masal", "TRY", "80.00", "order1"}, assert.NoError, decimal.NewFromInt(85)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.AdjustReservation(context.TODO(), tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, "item")
+			tt.wantErr(t, err, fmt.Sprintf("AdjustReservation(%v, %v, %v, %v)", tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID))
+
+			available, reserve := fetchWallet(t, db, "masal", "TRY")
+			assert.Truef(t, reserve.Equal(tt.wantReserve), "reserve got: %v want: %v", reserve.String(), tt.wantReserve.String())
+			assert.Truef(t, available.Add(reserve).Equal(decimal.NewFromInt(85)), "balance got: %v want: %v", available.Add(reserve).String(), "85")
+		})
+	}
+}
+
+func TestBalanceDatabase_Transfer(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, _ = db.TopUp(context.TODO(), "transfer_Test_1", "miguel", "EUR", "50.00", "")
+	_, _ = db.TopUp(context.TODO(), "transfer_Test_2", "orlando", "EUR", "200.00", "")
+	_ = db.Reserve(context.TODO(), "orlando", "EUR", "100.00", "order1", "item", time.Time{})
+
+	errNoMoneyError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "not enough money", "not a money error %v", err)
+	})
+	errUserNotFoundError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "user not found", "not a user error %v", err)
+	})
+
+	type args struct {
+		idempotencyKey string
+		senderID       string
+		recipientID    string
+		currency       string
+		value          string
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantErr       assert.ErrorAssertionFunc
+		checkBalance  bool
+		wantSender    decimal.Decimal
+		wantRecipient decimal.Decimal
+	}{
+		{"no idempotency key", args{"", "orlando", "miguel", "EUR", "10.00"}, assert.Error, false, decimal.Zero, decimal.Zero},
+		{"same user", args{"tr1", "orlando", "orlando", "EUR", "10.00"}, assert.Error, false, decimal.Zero, decimal.Zero},
+		{"unknown sender", args{"tr1", "sammy", "miguel", "EUR", "10.00"}, errUserNotFoundError, false, decimal.Zero, decimal.Zero},
+
+		{"success, same currency", args{"tr2", "orlando", "miguel", "EUR", "50.00"}, assert.NoError, true, decimal.NewFromInt(50), decimal.NewFromInt(100)},
+		{"success, duplicate", args{"tr2", "orlando", "miguel", "EUR", "50.00"}, assert.NoError, true, decimal.NewFromInt(50), decimal.NewFromInt(100)},
+		{"fail, reserved money", args{"tr3", "orlando", "miguel", "EUR", "60.00"}, errNoMoneyError, true, decimal.NewFromInt(50), decimal.NewFromInt(100)},
+		{"success, new recipient", args{"tr4", "orlando", "masal", "TRY", "100.00"}, assert.NoError, true, decimal.NewFromFloat(44.81), decimal.NewFromInt(100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := db.Transfer(context.TODO(), tt.args.idempotencyKey, tt.args.senderID, tt.args.recipientID, tt.args.currency, tt.args.value)
+			tt.wantErr(t, err, fmt.Sprintf("Transfer(%v, %v, %v, %v, %v, %v)", "ctx", tt.args.idempotencyKey, tt.args.senderID, tt.args.recipientID, tt.args.currency, tt.args.value))
+			if tt.checkBalance {
+				available, _ := fetchWallet(t, db, tt.args.senderID, "EUR")
+				assert.Truef(t, available.Equal(tt.wantSender), "sender available got: %v want: %v", available.String(), tt.wantSender.String())
+
+				available, _ = fetchWallet(t, db, tt.args.recipientID, tt.args.currency)
+				assert.Truef(t, available.Equal(tt.wantRecipient), "recipient available got: %v want: %v", available.String(), tt.wantRecipient.String())
+			}
+		})
+	}
+}
+
+func TestBalanceDatabase_Refund(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, _ = db.TopUp(context.TODO(), "refund_Test_1", "masal", "TRY", "100.00", "")
+	_, _ = db.TopUp(context.TODO(), "refund_Test_2", "orlando", "EUR", "200.00", "")
+	_, _ = db.CommitReservation(context.TODO(), "", "masal", "TRY", "40.00", "order1", "item", false)
+	_, _ = db.CommitReservation(context.TODO(), "", "orlando", "USD", "50.00", "order2", "item", false)
+	_, _ = db.CommitReservation(context.TODO(), "", "masal", "TRY", "10.00", "order3", "item1", false)
+	_, _ = db.CommitReservation(context.TODO(), "", "masal", "TRY", "10.00", "order3", "item2", false)
+
+	walletCurrency := map[string]string{"masal": "TRY", "orlando": "EUR"}
+
+	errInvalidStateError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "invalid state", "not an invalid state error %v", err)
+	})
+
+	type args struct {
+		idempotencyKey string
+		userID         string
+		currency       string
+		value          string
+		orderID        string
+		itemID         string
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantErr       assert.ErrorAssertionFunc
+		checkBalance  bool
+		wantAvailable decimal.Decimal
+	}{
+		{"no idempotency key", args{"", "masal", "TRY", "10.00", "order1", ""}, assert.Error, false, decimal.Zero},
+		{"unknown order", args{"rf1", "masal", "TRY", "10.00", "order0", ""}, errInvalidStateError, false, decimal.Zero},
+		{"another user order", args{"rf1", "orlando", "TRY", "10.00", "order1", ""}, assert.Error, false, decimal.Zero},
+		{"another currency", args{"rf1", "masal", "USD", "10.00", "order1", ""}, assert.Error, false, decimal.Zero},
+
+		{"success, partial", args{"rf2", "masal", "TRY", "10.00", "order1", ""}, assert.NoError, true, decimal.NewFromInt(50)},
+		{"success, duplicate", args{"rf2", "masal", "TRY", "10.00", "order1", ""}, assert.NoError, true, decimal.NewFromInt(50)},
+		{"fail, more than charged", args{"rf3", "masal", "TRY", "40.00", "order1", ""}, assert.Error, true, decimal.NewFromInt(50)},
+		{"success, everything left", args{"rf4", "masal", "", "", "order1", ""}, assert.NoError, true, decimal.NewFromInt(80)},
+		{"fail, already refunded", args{"rf5", "masal", "", "", "order1", ""}, errInvalidStateError, true, decimal.NewFromInt(80)},
+
+		{"success, diff currency partial", args{"rf6", "orlando", "USD", "25.00", "order2", ""}, assert.NoError, true, decimal.NewFromFloat(175.83)},
+		{"success, diff currency rest", args{"rf7", "orlando", "USD", "25.00", "order2", ""}, assert.NoError, true, decimal.NewFromInt(200)},
+
+		{"fail, several items", args{"rf8", "masal", "TRY", "1.00", "order3", ""}, assert.Error, true, decimal.NewFromInt(80)},
+		{"success, one of several items", args{"rf9", "masal", "TRY", "5.00", "order3", "item2"}, assert.NoError, true, decimal.NewFromInt(85)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := db.Refund(context.TODO(), tt.args.idempotencyKey, tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID)
+			tt.wantErr(t, err, fmt.Sprintf("Refund(%v, %v, %v, %v, %v, %v, %v)", "ctx", tt.args.idempotencyKey, tt.args.userID, tt.args.currency, tt.args.value, tt.args.orderID, tt.args.itemID))
+			if tt.checkBalance {
+				available, _ := fetchWallet(t, db, tt.args.userID, walletCurrency[tt.args.userID])
+				assert.Truef(t, available.Equal(tt.wantAvailable), "available got: %v want: %v", available.String(), tt.wantAvailable.String())
+			}
+		})
+	}
+}
+
+func TestBalanceDatabase_Withdraw(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, _ = db.TopUp(context.TODO(), "withdraw_Test_1", "masal", "TRY", "100.00", "")
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "30.00", "order1", "item", time.Time{})
+
+	errNoMoneyError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "not enough money", "not a money error %v", err)
+	})
+	errUserNotFoundError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "user not found", "not a user not found error %v", err)
+	})
+	errIdempotencyConflictError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "idempotency conflict", "not an idempotency conflict error %v", err)
+	})
+
+	type args struct {
+		idempotencyKey string
+		userID         string
+		currency       string
+		value          string
+		payoutData     string
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantErr       assert.ErrorAssertionFunc
+		checkBalance  bool
+		wantAvailable decimal.Decimal
+	}{
+		{"no idempotency key", args{"", "masal", "TRY", "10.00", ""}, assert.Error, false, decimal.Zero},
+		{"bad payout data", args{"wd1", "masal", "TRY", "10.00", "{"}, assert.Error, false, decimal.Zero},
+		{"unknown user", args{"wd1", "sammy", "TRY", "10.00", ""}, errUserNotFoundError, false, decimal.Zero},
+
+		{"success", args{"wd2", "masal", "TRY", "10.00", `{"card":"1111"}`}, assert.NoError, true, decimal.NewFromInt(60)},
+		{"success, duplicate", args{"wd2", "masal", "TRY", "10.00", `{"card":"1111"}`}, assert.NoError, true, decimal.NewFromInt(60)},
+		{"fail, conflicting duplicate", args{"wd2", "masal", "TRY", "20.00", ""}, errIdempotencyConflictError, true, decimal.NewFromInt(60)},
+		{"fail, reserved funds", args{"wd3", "masal", "TRY", "70.00", ""}, errNoMoneyError, true, decimal.NewFromInt(60)},
+		{"success, everything available", args{"wd4", "masal", "TRY", "60.00", ""}, assert.NoError, true, decimal.Zero},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := db.Withdraw(context.TODO(), tt.args.idempotencyKey, tt.args.userID, tt.args.currency, tt.args.value, tt.args.payoutData)
+			tt.wantErr(t, err, fmt.Sprintf("Withdraw(%v, %v, %v, %v, %v, %v)", "ctx", tt.args.idempotencyKey, tt.args.userID, tt.args.currency, tt.args.value, tt.args.payoutData))
+			if tt.checkBalance {
+				available, _ := fetchWallet(t, db, tt.args.userID, "TRY")
+				assert.Truef(t, available.Equal(tt.wantAvailable), "available got: %v want: %v", available.String(), tt.wantAvailable.String())
+			}
+		})
+	}
+}
+
+func TestBalanceDatabase_Wallets(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, _ = db.TopUp(context.TODO(), "wallets_Test_1", "lara", "EUR", "100.00", "")
+	_, _ = db.TopUp(context.TODO(), "wallets_Test_2", "lara", "USD", "10.00", "")
+
+	errNoMoneyError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "not enough money", "not a money error %v", err)
+	})
+
+	steps := []struct {
+		name       string
+		currency   string
+		value      string
+		orderID    string
+		fallback   bool
+		wantErr    assert.ErrorAssertionFunc
+		wantUsd    decimal.Decimal
+		wantEurRes bool
+	}{
+		{"same currency wallet", "USD", "5.00", "order1", true, assert.NoError, decimal.NewFromInt(5), false},
+		{"fallback disabled", "USD", "20.00", "order2", false, errNoMoneyError, decimal.NewFromInt(5), false},
+		{"fallback to another wallet", "USD", "20.00", "order3", true, assert.NoError, decimal.NewFromInt(5), true},
+	}
+	for _, step := range steps {
+		db.conversionFallback = step.fallback
+		err := db.Reserve(context.TODO(), "lara", step.currency, step.value, step.orderID, "item", time.Time{})
+		step.wantErr(t, err, "%s: Reserve(%v, %v)", step.name, step.currency, step.value)
+
+		available, _ := fetchWallet(t, db, "lara", "USD")
+		assert.Truef(t, available.Equal(step.wantUsd), "%s: USD available got: %v want: %v", step.name, available.String(), step.wantUsd.String())
+		_, reserve := fetchWallet(t, db, "lara", "EUR")
+		assert.Equalf(t, step.wantEurRes, reserve.GreaterThan(decimal.Zero), "%s: EUR reserve got: %v", step.name, reserve.String())
+	}
+	db.conversionFallback = true
+
+	// commit is charged from the wallet holding reservation
+	_, err := db.CommitReservation(context.TODO(), "", "lara", "USD", "5.00", "order1", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation(%v)", "order1")
+	available, reserve := fetchWallet(t, db, "lara", "USD")
+	assert.Truef(t, available.Equal(decimal.NewFromInt(5)), "USD available got: %v want: %v", available.String(), "5")
+	assert.Truef(t, reserve.Equal(decimal.Zero), "USD reserve got: %v want: %v", reserve.String(), "0")
+}
+
+func TestBalanceDatabase_SetCreditLimit(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	errNoMoneyError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "not enough money", "not a money error %v", err)
+	})
+
+	assert.Errorf(t, db.SetCreditLimit(context.TODO(), "ivan", "USD", "-1.00"), "SetCreditLimit(negative)")
+	assert.Errorf(t, db.SetCreditLimit(context.TODO(), "ivan", "xxx", "50.00"), "SetCreditLimit(bad currency)")
+	assert.NoErrorf(t, db.SetCreditLimit(context.TODO(), "ivan", "USD", "50.00"), "SetCreditLimit(%v)", "ivan")
+
+	steps := []struct {
+		name          string
+		commit        bool
+		value         string
+		orderID       string
+		wantErr       assert.ErrorAssertionFunc
+		wantAvailable decimal.Decimal
+	}{
+		{"reserve on credit", false, "30.00", "order1", assert.NoError, decimal.NewFromInt(-30)},
+		{"reserve above credit limit", false, "30.00", "order2", errNoMoneyError, decimal.NewFromInt(-30)},
+		{"commit reservation", true, "30.00", "order1", assert.NoError, decimal.NewFromInt(-30)},
+		{"commit above credit limit", true, "25.00", "order3", errNoMoneyError, decimal.NewFromInt(-30)},
+		{"commit up to credit limit", true, "20.00", "order4", assert.NoError, decimal.NewFromInt(-50)},
+	}
+	for _, step := range steps {
+		var err error
+		if step.commit {
+			_, err = db.CommitReservation(context.TODO(), "", "ivan", "USD", step.value, step.orderID, "item", false)
+		} else {
+			err = db.Reserve(context.TODO(), "ivan", "USD", step.value, step.orderID, "item", time.Time{})
+		}
+		step.wantErr(t, err, "%s: %v %v", step.name, step.orderID, step.value)
+
+		available, _ := fetchWallet(t, db, "ivan", "USD")
+		assert.Truef(t, available.Equal(step.wantAvailable), "%s: available got: %v want: %v", step.name, available.String(), step.wantAvailable.String())
+	}
+
+	// credit is not transferable
+	_, err := db.Withdraw(context.TODO(), "credit_Test_1", "ivan", "USD", "1.00", "")
+	errNoMoneyError(t, err, "Withdraw on credit")
+}
+
+func TestBalanceDatabase_SetAccountStatus(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	errFrozen := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "account is frozen", "not a frozen account error %v", err)
+	})
+	errBlocked := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
+		return assert.ErrorContainsf(t, err, "account is blocked", "not a blocked account error %v", err)
+	})
+
+	assert.Errorf(t, db.SetAccountStatus(context.TODO(), "olga", "deleted", "reason"), "SetAccountStatus(bad status)")
+	assert.Errorf(t, db.SetAccountStatus(context.TODO(), "olga", AccountStatusFrozen, ""), "SetAccountStatus(no reason)")
+
+	_, err := db.TopUp(context.TODO(), "status_Test_0", "olga", "USD", "100.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "olga")
+
+	steps := []struct {
+		name    string
+		status  string
+		op      func(n int) error
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{"frozen top-up", AccountStatusFrozen, func(n int) error {
+			_, err := db.TopUp(context.TODO(), fmt.Sprintf("status_Test_%d", n), "olga", "USD", "10.00", "")
+			return err
+		}, assert.NoError},
+		{"frozen reserve", AccountStatusFrozen, func(n int) error {
+			return db.Reserve(context.TODO(), "olga", "USD", "10.00", fmt.Sprintf("order%d", n), "item", time.Time{})
+		}, errFrozen},
+		{"frozen withdraw", AccountStatusFrozen, func(n int) error {
+			_, err := db.Withdraw(context.TODO(), fmt.Sprintf("status_Test_%d", n), "olga", "USD", "10.00", "")
+			return err
+		}, errFrozen},
+		{"frozen transfer", AccountStatusFrozen, func(n int) error {
+			_, err := db.Transfer(context.TODO(), fmt.Sprintf("status_Test_%d", n), "olga", "pavel", "USD", "10.00")
+			return err
+		}, errFrozen},
+		{"blocked top-up", AccountStatusBlocked, func(n int) error {
+			_, err := db.TopUp(context.TODO(), fmt.Sprintf("status_Test_%d", n), "olga", "USD", "10.00", "")
+			return err
+		}, errBlocked},
+		{"blocked top-up in new currency", AccountStatusBlocked, func(n int) error {
+			_, err := db.TopUp(context.TODO(), fmt.Sprintf("status_Test_%d", n), "olga", "EUR", "10.00", "")
+			return err
+		}, errBlocked},
+		{"blocked transfer recipient", AccountStatusBlocked, func(n int) error {
+			_, err := db.Transfer(context.TODO(), fmt.Sprintf("status_Test_%d", n), "pavel", "olga", "EUR", "10.00")
+			return err
+		}, errBlocked},
+		{"reactivated reserve", AccountStatusActive, func(n int) error {
+			return db.Reserve(context.TODO(), "olga", "USD", "10.00", fmt.Sprintf("order%d", n), "item", time.Time{})
+		}, assert.NoError},
+	}
+	for i, step := range steps {
+		assert.NoErrorf(t, db.SetAccountStatus(context.TODO(), "olga", step.status, step.name), "%s: SetAccountStatus(%v)", step.name, step.status)
+		step.wantErr(t, step.op(i+1), "%s", step.name)
+	}
+
+	available, reserved := fetchWallet(t, db, "olga", "USD")
+	assert.Truef(t, available.Equal(decimal.NewFromInt(100)), "available got: %v want: %v", available.String(), "100")
+	assert.Truef(t, reserved.Equal(decimal.NewFromInt(10)), "reserved got: %v want: %v", reserved.String(), "10")
+
+	// blocked user got no wallet in new currency
+	var wallets int
+	err = db.db.QueryRow(context.TODO(), `SELECT count(*) FROM balance WHERE user_id = $1 AND currency = $2`, "olga", "EUR").Scan(&wallets)
+	assert.NoError(t, err)
+	assert.Zerof(t, wallets, "EUR wallets got: %v want: %v", wallets, 0)
+
+	history, err := db.FetchAccountStatus(context.TODO(), "olga")
+	assert.NoErrorf(t, err, "FetchAccountStatus(%v)", "olga")
+	if assert.Len(t, history, len(steps)) {
+		assert.Equal(t, AccountStatusActive, history[0].Status)
+		assert.Equal(t, "reactivated reserve", history[0].Reason)
+	}
+}
+
+func TestBalanceDatabase_Batch(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	tests := []struct {
+		name          string
+		operations    []BatchOperation
+		wantErr       assert.ErrorAssertionFunc
+		wantResults   int
+		wantAvailable decimal.Decimal
+		wantReserve   decimal.Decimal
+	}{
+		{"empty batch", nil, assert.Error, 0, decimal.Zero, decimal.Zero},
+		{"unknown operation", []BatchOperation{{Kind: "steal", UserID: "rosa"}}, assert.Error, 1, decimal.Zero, decimal.Zero},
+		{"top-up, reserve and commit", []BatchOperation{
+			{Kind: BatchOperationTopUp, IdempotencyKey: "batch_Test_1", UserID: "rosa", Currency: "USD", Value: "100.00"},
+			{Kind: BatchOperationReserve, UserID: "rosa", Currency: "USD", Value: "30.00", OrderID: "order1", ItemID: "item"},
+			{Kind: BatchOperationReserve, UserID: "rosa", Currency: "USD", Value: "20.00", OrderID: "order2", ItemID: "item"},
+			{Kind: BatchOperationCommit, UserID: "rosa", Currency: "USD", Value: "30.00", OrderID: "order1", ItemID: "item"},
+		}, assert.NoError, 4, decimal.NewFromInt(50), decimal.NewFromInt(20)},
+		{"failure in the middle, nothing applied", []BatchOperation{
+			{Kind: BatchOperationTopUp, IdempotencyKey: "batch_Test_2", UserID: "rosa", Currency: "USD", Value: "10.00"},
+			{Kind: BatchOperationCancel, UserID: "rosa", OrderID: "order2"},
+			{Kind: BatchOperationReserve, UserID: "rosa", Currency: "USD", Value: "1000.00", OrderID: "order3", ItemID: "item"},
+			{Kind: BatchOperationTopUp, IdempotencyKey: "batch_Test_3", UserID: "rosa", Currency: "USD", Value: "10.00"},
+		}, assert.Error, 3, decimal.NewFromInt(50), decimal.NewFromInt(20)},
+		{"cancel and retried top-up", []BatchOperation{
+			{Kind: BatchOperationCancel, UserID: "rosa", OrderID: "order2"},
+			{Kind: BatchOperationTopUp, IdempotencyKey: "batch_Test_1", UserID: "rosa", Currency: "USD", Value: "100.00"},
+		}, assert.NoError, 2, decimal.NewFromInt(70), decimal.Zero},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := db.Batch(context.TODO(), tt.operations)
+			tt.wantErr(t, err, "Batch(%v)", tt.name)
+			assert.Len(t, results, tt.wantResults)
+			for i, result := range results {
+				if err != nil {
+					assert.Zerof(t, result.TxID, "result %d of failed batch has tx id", i)
+				} else {
+					assert.NoErrorf(t, result.Err, "result %d", i)
+				}
+			}
+
+			available, reserve := fetchWallet(t, db, "rosa", "USD")
+			assert.Truef(t, available.Equal(tt.wantAvailable), "available got: %v want: %v", available.String(), tt.wantAvailable.String())
+			assert.Truef(t, reserve.Equal(tt.wantReserve), "reserve got: %v want: %v", reserve.String(), tt.wantReserve.String())
+		})
+	}
+}
+
+func TestBalanceDatabase_RateLock(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+	t.Cleanup(loadRatesFromStub)
+
+	var err error
+	db.conversionBuffers, err = parseConversionBuffers("1.06,USD/EUR=1.10", rateSet())
+	assert.NoError(t, err)
+
+	_, err = db.TopUp(context.TODO(), "rate_Test_1", "sven", "EUR", "200.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "sven")
+
+	// per-pair buffer
+	err = db.Reserve(context.TODO(), "sven", "USD", "50.00", "order1", "item", time.Time{})
+	assert.NoErrorf(t, err, "Reserve(%v)", "order1")
+	_, reserve := fetchWallet(t, db, "sven", "EUR")
+	assert.Truef(t, reserve.Equal(decimal.NewFromFloat(53.16)), "reserve got: %v want: %v", reserve.String(), "53.16")
+
+	// rate went up after reservation, commit is charged at locked rate
+	setRate("USD", decimal.NewFromFloat(0.5))
+	_, err = db.CommitReservation(context.TODO(), "", "sven", "USD", "50.00", "order1", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation(%v)", "order1")
+	available, _ := fetchWallet(t, db, "sven", "EUR")
+	assert.Truef(t, available.Equal(decimal.NewFromFloat(151.67)), "available got: %v want: %v", available.String(), "151.67")
+	loadRatesFromStub()
+
+	// locked rate expired
+	db.rateLockTTL = time.Millisecond
+	db.rateExpiryPolicy = RateExpiryPolicyReject
+	err = db.Reserve(context.TODO(), "sven", "USD", "20.00", "order2", "item", time.Time{})
+	assert.NoErrorf(t, err, "Reserve(%v)", "order2")
+	time.Sleep(10 * time.Millisecond)
+	_, err = db.CommitReservation(context.TODO(), "", "sven", "USD", "20.00", "order2", "item", false)
+	assert.ErrorContainsf(t, err, "invalid state", "CommitReservation(%v, reject expired rate)", "order2")
+
+	db.rateExpiryPolicy = RateExpiryPolicyCurrent
+	_, err = db.CommitReservation(context.TODO(), "", "sven", "USD", "20.00", "order2", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation(%v, current rate)", "order2")
+	available, reserve = fetchWallet(t, db, "sven", "EUR")
+	assert.Truef(t, available.Equal(decimal.NewFromFloat(132.34)), "available got: %v want: %v", available.String(), "132.34")
+	assert.Truef(t, reserve.Equal(decimal.Zero), "reserve got: %v want: %v", reserve.String(), "0")
+}
+
+func TestBalanceDatabase_Ledger(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, err := db.TopUp(context.TODO(), "ledger_Test_1", "nina", "EUR", "100.00", "")
+	assert.NoErrorf(t, err, "TopUp(%v)", "nina")
+	_, err = db.CommitReservation(context.TODO(), "", "nina", "USD", "10.00", "order1", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation(%v)", "order1")
+	_, err = db.CommitSale(context.TODO(), "", "nina", "omar", "EUR", "20.00", "order2", "item", false, Commission{Percent: "10"})
+	assert.NoErrorf(t, err, "CommitSale(%v)", "order2")
+	_, err = db.Refund(context.TODO(), "ledger_Test_2", "nina", "", "4.00", "order1", "item")
+	assert.NoErrorf(t, err, "Refund(%v)", "order1")
+	_, err = db.Refund(context.TODO(), "ledger_Test_5", "nina", "", "10.00", "order2", "item")
+	assert.NoErrorf(t, err, "Refund(%v)", "order2")
+	_, err = db.Transfer(context.TODO(), "ledger_Test_3", "nina", "omar", "TRY", "100.00")
+	assert.NoErrorf(t, err, "Transfer(%v)", "omar")
+	_, err = db.Withdraw(context.TODO(), "ledger_Test_4", "omar", "EUR", "5.00", "")
+	assert.NoErrorf(t, err, "Withdraw(%v)", "omar")
+
+	// every transaction is balanced in every currency
+	var unbalanced int
+	err = db.db.QueryRow(context.TODO(), `
+SELECT COUNT(*)
+FROM (SELECT transaction_id FROM ledger_entry GROUP BY transaction_id, currency HAVING SUM(amount) <> 0) t`,
+	).Scan(&unbalanced)
+	assert.NoError(t, err)
+	assert.Zero(t, unbalanced, "unbalanced transactions")
+
+	// user accounts match wallet balances, system accounts hold the rest
+	rows, err := db.db.Query(context.TODO(), `
+SELECT b.user_id, b.currency, b.current_value, COALESCE(SUM(l.amount), 0)
+FROM balance b
+         LEFT JOIN ledger_entry l ON l.account = $1 AND l.user_id = b.user_id AND l.currency = b.currency
+GROUP BY b.user_id, b.currency, b.current_value`, LedgerAccountUser)
+	assert.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var userID, currency string
+		var balance, booked decimal.Decimal
+		assert.NoError(t, rows.Scan(&userID, &currency, &balance, &booked))
+		assert.Truef(t, balance.Equal(booked), "%s %s: balance %v, ledger %v", userID, currency, balance.String(), booked.String())
+	}
+
+	var revenue decimal.Decimal
+	err = db.db.QueryRow(context.TODO(), `SELECT SUM(amount) FROM ledger_entry WHERE account = $1 AND currency = $2`,
+		LedgerAccountRevenue, "EUR",
+	).Scan(&revenue)
+	assert.NoError(t, err)
+	assert.Truef(t, revenue.Equal(decimal.NewFromInt(1)), "EUR revenue got: %v want: %v", revenue.String(), "1")
+}
+
+func TestBalanceDatabase_ExpireReservations(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, _ = db.TopUp(context.TODO(), "expire_Test_1", "masal", "TRY", "100.00", "")
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "10.00", "order1", "item", time.Time{})
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "20.00", "order2", "item", time.Now().Add(time.Hour))
+	_ = db.Reserve(context.TODO(), "masal", "TRY", "30.00", "order3", "item", time.Now().Add(time.Hour))
+
+	err := db.Reserve(context.TODO(), "masal", "TRY", "40.00", "order4", "item", time.Now().Add(-time.Hour))
+	assert.Errorf(t, err, "Reserve with expiry in the past")
+
+	// pretend order3 reservation has expired already
+	_, _ = db.db.Exec(context.TODO(), `UPDATE balance_reserve SET expires_at = $2 WHERE order_id = $1`, "order3", time.Now().Add(-time.Minute))
+
+	count, err := db.ExpireReservations(context.TODO(), 10)
+	assert.NoErrorf(t, err, "ExpireReservations")
+	assert.Equalf(t, 1, count, "expired reservations count")
+
+	available, reserve := fetchWallet(t, db, "masal", "TRY")
+	assert.Truef(t, available.Equal(decimal.NewFromInt(70)), "available got: %v want: %v", available.String(), "70")
+	assert.Truef(t, reserve.Equal(decimal.NewFromInt(30)), "reserve got: %v want: %v", reserve.String(), "30")
+
+	count, err = db.ExpireReservations(context.TODO(), 10)
+	assert.NoErrorf(t, err, "ExpireReservations")
+	assert.Equalf(t, 0, count, "expired reservations count")
+}
+
+func TestBalanceDatabase_Subscriptions(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	_, err := db.CreateSubscription(context.TODO(), "masal", "TRY", "10.00", "premium", "1 fortnight", time.Time{}, 0, "")
+	assert.Errorf(t, err, "CreateSubscription with bad interval")
+
+	_, _ = db.TopUp(context.TODO(), "subscription_Test_1", "masal", "TRY", "25.00", "")
+	subscription, err := db.CreateSubscription(context.TODO(), "masal", "TRY", "10.00", "premium", "1 month", time.Time{}, 1, "1 hour")
+	assert.NoErrorf(t, err, "CreateSubscription")
+
+	// first charge is made right away
+	count, err := db.ChargeDueSubscriptions(context.TODO(), 10)
+	assert.NoErrorf(t, err, "ChargeDueSubscriptions")
+	assert.Equalf(t, 1, count, "charged subscriptions count")
+	available, reserve := fetchWallet(t, db, "masal", "TRY")
+	assert.Truef(t, available.Equal(decimal.NewFromInt(15)), "available got: %v want: %v", available.String(), "15")
+	assert.Truef(t, reserve.IsZero(), "reserve got: %v want: %v", reserve.String(), "0")
+
+	// next one is due in a month
+	count, err = db.ChargeDueSubscriptions(context.TODO(), 10)
+	assert.NoErrorf(t, err, "ChargeDueSubscriptions")
+	assert.Equalf(t, 0, count, "charged subscriptions count")
+
+	// pretend month has passed, twice
+	pastDue := func() {
+		_, _ = db.db.Exec(context.TODO(), `UPDATE subscription SET due_at = $2, next_attempt_at = $2 WHERE id = $1`, subscription.ID.Int64(), time.Now().Add(-time.Minute))
+	}
+	pastDue()
+	_, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	pastDue()
+	_, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	available, _ = fetchWallet(t, db, "masal", "TRY")
+	assert.Truef(t, available.Equal(decimal.NewFromInt(5)), "available got: %v want: %v", available.String(), "5")
+
+	subscriptions, err := db.FetchUserSubscriptions(context.TODO(), "masal")
+	assert.NoErrorf(t, err, "FetchUserSubscriptions")
+	if assert.Len(t, subscriptions, 1) {
+		assert.Equalf(t, 2, subscriptions[0].ChargeCount, "charge count")
+		assert.Equalf(t, 1, subscriptions[0].RetryCount, "retry count")
+		assert.Equalf(t, SubscriptionStatusActive, subscriptions[0].Status, "status")
+	}
+
+	// out of retries
+	pastDue()
+	_, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	subscriptions, _ = db.FetchUserSubscriptions(context.TODO(), "masal")
+	if assert.Len(t, subscriptions, 1) {
+		assert.Equalf(t, SubscriptionStatusPastDue, subscriptions[0].Status, "status")
+	}
+
+	_, _ = db.TopUp(context.TODO(), "subscription_Test_2", "masal", "TRY", "5.00", "")
+	subscription, err = db.ResumeSubscription(context.TODO(), subscription.ID)
+	assert.NoErrorf(t, err, "ResumeSubscription")
+	assert.Equalf(t, 0, subscription.RetryCount, "retry count")
+	count, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	assert.Equalf(t, 1, count, "charged subscriptions count")
+	available, _ = fetchWallet(t, db, "masal", "TRY")
+	assert.Truef(t, available.IsZero(), "available got: %v want: %v", available.String(), "0")
+
+	_, err = db.PauseSubscription(context.TODO(), subscription.ID)
+	assert.NoErrorf(t, err, "PauseSubscription")
+	pastDue()
+	count, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	assert.Equalf(t, 0, count, "charged subscriptions count")
+
+	_, err = db.CancelSubscription(context.TODO(), subscription.ID)
+	assert.NoErrorf(t, err, "CancelSubscription")
+	_, err = db.CancelSubscription(context.TODO(), subscription.ID)
+	assert.NoErrorf(t, err, "CancelSubscription again")
+	_, err = db.ResumeSubscription(context.TODO(), subscription.ID)
+	assert.Errorf(t, err, "ResumeSubscription after cancel")
+
+	// periods missed while charging was not running are skipped, not charged one after another
+	_, _ = db.TopUp(context.TODO(), "subscription_Test_3", "mimas", "TRY", "100.00", "")
+	subscription, err = db.CreateSubscription(context.TODO(), "mimas", "TRY", "10.00", "premium", "1 day", time.Time{}, 0, "")
+	assert.NoErrorf(t, err, "CreateSubscription")
+	missed := time.Now().Add(-5*24*time.Hour - time.Hour)
+	_, _ = db.db.Exec(context.TODO(), `UPDATE subscription SET due_at = $2, next_attempt_at = $2 WHERE id = $1`, subscription.ID.Int64(), missed)
+	count, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	assert.Equalf(t, 1, count, "charged subscriptions count")
+	count, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	assert.Equalf(t, 0, count, "charged subscriptions count")
+	available, _ = fetchWallet(t, db, "mimas", "TRY")
+	assert.Truef(t, available.Equal(decimal.NewFromInt(90)), "available got: %v want: %v", available.String(), "90")
+	subscriptions, _ = db.FetchUserSubscriptions(context.TODO(), "mimas")
+	if assert.Len(t, subscriptions, 1) {
+		assert.Equalf(t, 1, subscriptions[0].ChargeCount, "charge count")
+		assert.Truef(t, subscriptions[0].NextAttemptAt.After(time.Now()), "next attempt at got: %v", subscriptions[0].NextAttemptAt)
+		assert.Truef(t, subscriptions[0].NextAttemptAt.Before(time.Now().Add(24*time.Hour)), "next attempt at got: %v", subscriptions[0].NextAttemptAt)
+	}
+
+	// no retries, first failed charge makes subscription past due
+	subscription, err = db.CreateSubscription(context.TODO(), "masal", "TRY", "10.00", "extra", "1 month", time.Time{}, 0, "")
+	assert.NoErrorf(t, err, "CreateSubscription without retries")
+	_, _ = db.ChargeDueSubscriptions(context.TODO(), 10)
+	subscriptions, _ = db.FetchUserSubscriptions(context.TODO(), "masal")
+	for _, s := range subscriptions {
+		if s.ID == subscription.ID {
+			assert.Equalf(t, SubscriptionStatusPastDue, s.Status, "status")
+			assert.Equalf(t, 0, s.RetryCount, "retry count")
+		}
+	}
+}
+
+func TestBalanceDatabase_Bonus(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	fetchBonus := func() (available, bonus decimal.Decimal) {
+		wallets, err := db.FetchUserBalance(context.TODO(), "berk")
+		assert.NoErrorf(t, err, "FetchUserBalance")
+		for _, w := range wallets {
+			if w.Currency == "USD" {
+				return w.Available, w.BonusAvailable
+			}
+		}
+		return decimal.Zero, decimal.Zero
+	}
+
+	_, err := db.GrantBonus(context.TODO(), "bonus_Test_0", "berk", "USD", "10.00", "", time.Now().Add(-time.Hour))
+	assert.Errorf(t, err, "GrantBonus expired")
+
+	_, _ = db.TopUp(context.TODO(), "bonus_Test_1", "berk", "USD", "20.00", "")
+	_, err = db.GrantBonus(context.TODO(), "bonus_Test_2", "berk", "USD", "10.00", `{"campaign":"welcome"}`, time.Now().Add(time.Hour))
+	assert.NoErrorf(t, err, "GrantBonus")
+
+	// bonus is spent first, cash covers the rest
+	err = db.Reserve(context.TODO(), "berk", "USD", "15.00", "order1", "item", time.Time{})
+	assert.NoErrorf(t, err, "Reserve")
+	available, bonus := fetchBonus()
+	assert.Truef(t, available.Equal(decimal.NewFromInt(15)), "available got: %v want: %v", available.String(), "15")
+	assert.Truef(t, bonus.IsZero(), "bonus got: %v want: %v", bonus.String(), "0")
+
+	// bonus can't be paid out
+	_, err = db.Withdraw(context.TODO(), "bonus_Test_3", "berk", "USD", "16.00", "")
+	assert.Errorf(t, err, "Withdraw bonus")
+
+	_, err = db.CommitReservation(context.TODO(), "", "berk", "USD", "15.00", "order1", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation")
+	items, _, _, _ := db.FetchUserTransactions(context.TODO(), "berk", 1, 0, time.Time{}, time.Time{})
+	if assert.Len(t, items, 1) {
+		assert.Truef(t, items[0].BonusValue.Amount.Equal(decimal.NewFromInt(10)), "charge bonus got: %v want: %v", items[0].BonusValue.String(), "10")
+	}
+
+	// refund returns bonus in proportion
+	_, err = db.Refund(context.TODO(), "bonus_Test_4", "berk", "USD", "6.00", "order1", "item")
+	assert.NoErrorf(t, err, "Refund")
+	available, bonus = fetchBonus()
+	assert.Truef(t, available.Equal(decimal.NewFromInt(17)), "available got: %v want: %v", available.String(), "17")
+	assert.Truef(t, bonus.Equal(decimal.NewFromInt(4)), "bonus got: %v want: %v", bonus.String(), "4")
+
+	// pretend bonus has expired, reserved part is kept
+	_ = db.Reserve(context.TODO(), "berk", "USD", "1.00", "order2", "item", time.Time{})
+	_, _ = db.db.Exec(context.TODO(), `UPDATE bonus SET expires_at = $2 WHERE user_id = $1`, "berk", time.Now().Add(-time.Minute))
+	count, err := db.ExpireBonuses(context.TODO(), 10)
+	assert.NoErrorf(t, err, "ExpireBonuses")
+	assert.Equalf(t, 1, count, "expired bonus count")
+	available, bonus = fetchBonus()
+	assert.Truef(t, available.Equal(decimal.NewFromInt(17)), "available got: %v want: %v", available.String(), "17")
+	assert.Truef(t, bonus.IsZero(), "bonus got: %v want: %v", bonus.String(), "0")
+
+	_, err = db.CommitReservation(context.TODO(), "", "berk", "USD", "1.00", "order2", "item", false)
+	assert.NoErrorf(t, err, "CommitReservation of expired bonus")
+	available, _ = fetchBonus()
+	assert.Truef(t, available.Equal(decimal.NewFromInt(17)), "available got: %v want: %v", available.String(), "17")
+
+	count, _ = db.ExpireBonuses(context.TODO(), 10)
+	assert.Equalf(t, 0, count, "expired bonus count")
 }
@@ -2,7 +2,6 @@ package database
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"time"
 
@@ -12,20 +11,31 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-func (d *BalanceDatabase) FetchUserBalance(ctx context.Context, userID string) (currency string, available, reserved decimal.Decimal, err error) {
+type UserWallet struct {
+	Currency       string
+	Available      decimal.Decimal // cash, not reserved
+	Reserved       decimal.Decimal // cash and bonus
+	CreditLimit    decimal.Decimal
+	BonusAvailable decimal.Decimal // bonus, not reserved
+	BonusReserved  decimal.Decimal
+	Pending        decimal.Decimal // pending top-ups, not spendable until settled
+}
+
+// FetchUserBalance returns all user wallets ordered by currency.
+func (d *BalanceDatabase) FetchUserBalance(ctx context.Context, userID string) (wallets []UserWallet, err error) {
 	if userID == "" {
-		return "", decimal.Zero, decimal.Zero, proto.NewBadParameterError("user id")
+		return nil, proto.NewBadParameterError("user id")
 	}
 
 	// x) WRAP IN TRANSACTION (avoid inconsistent data with balance and reservations)
 	conn, err := d.db.Acquire(ctx)
 	if err != nil {
-		return "", decimal.Zero, decimal.Zero, fmt.Errorf("acquire connection: %w", err)
+		return nil, fmt.Errorf("acquire connection: %w", err)
 	}
 	defer conn.Release()
 	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return "", decimal.Zero, decimal.Zero, fmt.Errorf("begin tx: %w", err)
+		return nil, fmt.Errorf("begin tx: %w", err)
 	}
 	defer func() {
 		if err != nil {
@@ -35,48 +45,114 @@ func (d *BalanceDatabase) FetchUserBalance(ctx context.Context, userID string) (
 		}
 	}()
 
-	// 1) GET CURRENT BALANCE
-	row := tx.QueryRow(ctx, `SELECT currency, current_value FROM balance WHERE user_id = $1`, userID)
-	if err = row.Scan(&currency, &available); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			err = proto.NewUserNotFoundError()
-		} else {
-			err = fmt.Errorf("read balance: %w", err)
+	// 1) GET CURRENT BALANCES
+	var rows pgx.Rows
+	rows, err = tx.Query(ctx, `SELECT currency, current_value, bonus_value, credit_limit, pending_value FROM balance WHERE user_id = $1 ORDER BY currency`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("read balance: %w", err)
+	}
+	var userWallets []*wallet
+	var pending []decimal.Decimal
+	for rows.Next() {
+		var currency string
+		var value, bonus, creditLimit, pendingValue decimal.Decimal
+		if err = rows.Scan(&currency, &value, &bonus, &creditLimit, &pendingValue); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("read balance: %w", err)
 		}
-		return "", decimal.Zero, decimal.Zero, err
+		userWallets = append(userWallets, newWallet(currency, value, bonus, creditLimit))
+		pending = append(pending, pendingValue)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read balance: %w", err)
+	}
+	if len(userWallets) == 0 {
+		err = proto.NewUserNotFoundError()
+		return nil, err
 	}
 
 	// 2) GET RESERVATIONS
-	var reservedRow decimal.Decimal
-	var rows pgx.Rows
-	rows, err = tx.Query(ctx, `SELECT user_currency_value FROM balance_reserve WHERE user_id = $1`, userID)
+	rows, err = tx.Query(ctx, `SELECT wallet_currency, user_currency_value, bonus_value FROM balance_reserve WHERE user_id = $1`, userID)
 	if err != nil {
-		return "", decimal.Zero, decimal.Zero, fmt.Errorf("read reservations: %w", err)
+		return nil, fmt.Errorf("read reservations: %w", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		if err = rows.Scan(&reservedRow); err != nil {
-			return "", decimal.Zero, decimal.Zero, fmt.Errorf("read reservations: %w", err)
+		var walletCurrency string
+		var reservedRow, reservedBonusRow decimal.Decimal
+		if err = rows.Scan(&walletCurrency, &reservedRow, &reservedBonusRow); err != nil {
+			return nil, fmt.Errorf("read reservations: %w", err)
 		}
-		if reservedRow.GreaterThan(decimal.Zero) {
-			reserved = reserved.Add(reservedRow)
+		if w := findWallet(userWallets, walletCurrency); w != nil && reservedRow.IsPositive() {
+			w.reserved = w.reserved.Add(NewMoney(reservedRow, walletCurrency))
+			w.reservedBonus = w.reservedBonus.Add(NewMoney(reservedBonusRow, walletCurrency))
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("read reservations: %w", err)
+	}
 
-	if reserved.GreaterThan(decimal.Zero) {
-		available = available.Sub(reserved)
+	wallets = make([]UserWallet, 0, len(userWallets))
+	for i, w := range userWallets {
+		wallets = append(wallets, UserWallet{
+			Currency:       w.currency,
+			Available:      w.available().Amount,
+			Reserved:       w.reserved.Amount,
+			CreditLimit:    w.creditLimit.Amount,
+			BonusAvailable: w.bonusAvailable().Amount,
+			BonusReserved:  w.reservedBonus.Amount,
+			Pending:        pending[i],
+		})
 	}
 
-	return
+	return wallets, nil
+}
+
+type AccountStatusChange struct {
+	Status    string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// FetchAccountStatus returns account status history, newest first. Empty history means account is active.
+func (d *BalanceDatabase) FetchAccountStatus(ctx context.Context, userID string) ([]AccountStatusChange, error) {
+	if userID == "" {
+		return nil, proto.NewBadParameterError("user id")
+	}
+
+	rows, err := d.db.Query(ctx, `SELECT status, reason, created_at FROM account_status WHERE user_id = $1 ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("load account status: %w", err)
+	}
+	defer rows.Close()
+
+	var history []AccountStatusChange
+	for rows.Next() {
+		var next AccountStatusChange
+		if err = rows.Scan(&next.Status, &next.Reason, &next.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan account status: %w", err)
+		}
+		history = append(history, next)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("load account status: %w", err)
+	}
+
+	return history, nil
 }
 
 type UserTransactionItem struct {
-	Currency           string
-	Value              decimal.Decimal
-	UserCurrencyValue  decimal.Decimal
+	Kind               string
+	Status             string
+	Value              Money
+	UserCurrencyValue  Money
+	Commission         Money // marketplace sales only, in currency of Value
+	BonusValue         Money // part of UserCurrencyValue paid from or to bonus
 	IsTopUpTransaction bool
 	OrderID            string
 	ItemID             string
+	CounterpartyUserID string
 	CreatedAt          time.Time
 }
 
@@ -109,12 +185,18 @@ func (d *BalanceDatabase) FetchUserTransactions(
 
 	rows, err := d.db.Query(ctx, `
 SELECT id,
+       kind,
+       status,
        transaction_currency,
        transaction_value,
        sender_id,
+       sender_currency,
        sender_value,
        recipient_id,
+       recipient_currency,
        recipient_value,
+       commission_value,
+       bonus_value,
        (order_data ->> 'order_id'),
        (order_data ->> 'item_id'),
        created_at
@@ -136,19 +218,42 @@ LIMIT $8`,
 	for rows.Next() {
 		next := UserTransactionItem{}
 		var txID snowflake.ID
-		var senderID, recipientID, orderID, itemID *string
-		var txValue, senderValue, recipientValue decimal.NullDecimal
-		err = rows.Scan(&txID, &next.Currency, &txValue, &senderID, &senderValue, &recipientID, &recipientValue, &orderID, &itemID, &next.CreatedAt)
+		var txCurrency string
+		var senderID, senderCurrency, recipientID, recipientCurrency, orderID, itemID *string
+		var txValue, senderValue, recipientValue, commissionValue, bonusValue decimal.NullDecimal
+		err = rows.Scan(&txID, &next.Kind, &next.Status, &txCurrency, &txValue, &senderID, &senderCurrency, &senderValue, &recipientID, &recipientCurrency, &recipientValue, &commissionValue, &bonusValue, &orderID, &itemID, &next.CreatedAt)
 		if err != nil {
 			return nil, 0, 0, fmt.Errorf("scan user tx: %w", err)
 		}
-		next.Value = txValue.Decimal
+		next.Value = NewMoney(txValue.Decimal, txCurrency)
+		next.Commission = NewMoney(commissionValue.Decimal, txCurrency)
+		var userCurrency string
+		var userValue, userBonus decimal.Decimal
 		if senderID != nil && *senderID == userID {
-			next.UserCurrencyValue = senderValue.Decimal
+			userValue = senderValue.Decimal
+			userBonus = bonusValue.Decimal
+			if senderCurrency != nil {
+				userCurrency = *senderCurrency
+			}
+			if recipientID != nil {
+				next.CounterpartyUserID = *recipientID
+			}
 		} else /*if *recipientID == userID*/ {
-			next.UserCurrencyValue = recipientValue.Decimal
+			userValue = recipientValue.Decimal
+			if next.Kind != TransactionKindCharge {
+				// constb: bonus of a sale is buyer's, seller always gets cash
+				userBonus = bonusValue.Decimal
+			}
+			if recipientCurrency != nil {
+				userCurrency = *recipientCurrency
+			}
 			next.IsTopUpTransaction = true
+			if senderID != nil {
+				next.CounterpartyUserID = *senderID
+			}
 		}
+		next.UserCurrencyValue = NewMoney(userValue, userCurrency)
+		next.BonusValue = NewMoney(userBonus, userCurrency)
 		if orderID != nil {
 			next.OrderID = *orderID
 		}
@@ -178,7 +283,7 @@ WHERE (sender_id = $1 OR recipient_id = $1)
 
 type StatisticsCallbacks struct {
 	OnCurrencies func(currencies []string)
-	OnRecord     func(item string, values map[string]decimal.Decimal)
+	OnRecord     func(item string, values, bonusValues map[string]decimal.Decimal) // bonusValues are part of values funded by bonus
 	OnError      func(err error)
 }
 
@@ -230,16 +335,29 @@ where date_trunc('month', "created_at") = make_date($1, $2, 1)
 
 	callbacks.OnCurrencies(currencies)
 
-	// 2) READ STATISTICS DATA
+	// 2) READ STATISTICS DATA (net revenue: refunds are subtracted in the month they were made, only commission of
+	// marketplace sales and of their refunds is platform revenue; bonus-funded part is in the same proportion as bonus
+	// in user's payment)
 	var currentItem string
-	var data map[string]decimal.Decimal
+	var data, bonusData map[string]decimal.Decimal
 	rows, err = tx.Query(ctx, `
-select order_data ->> 'item_id' as item_id, transaction_currency, sum(transaction_value)
+select order_data ->> 'item_id'                                                   as item_id,
+       transaction_currency,
+       sum(case
+               when kind = $3 then -coalesce(commission_value, transaction_value)
+               when commission_value is not null then commission_value
+               else transaction_value end) as net_value,
+       coalesce(sum(case
+                        when kind = $3 then -coalesce(commission_value, transaction_value)
+                        when commission_value is not null then commission_value
+                        else transaction_value end
+                    * bonus_value
+                    / nullif(case when kind = $3 then recipient_value else sender_value end, 0)), 0) as bonus_net_value
 from "transaction"
 where date_trunc('month', "created_at") = make_date($1, $2, 1)
   and (order_data ->> 'item_id') is not null
 group by item_id, transaction_currency
-order by item_id asc, transaction_currency asc`, year, month)
+order by item_id asc, transaction_currency asc`, year, month, TransactionKindRefund)
 	if err != nil {
 		callbacks.OnError(fmt.Errorf("load statistics: %w", err))
 		return
@@ -249,21 +367,24 @@ order by item_id asc, transaction_currency asc`, year, month)
 	for rows.Next() {
 		var item string
 		var currency string
-		var value decimal.Decimal
-		err = rows.Scan(&item, &currency, &value)
+		var value, bonusValue decimal.Decimal
+		err = rows.Scan(&item, &currency, &value, &bonusValue)
 		if err != nil {
 			callbacks.OnError(fmt.Errorf("load statistics: %w", err))
 			return
 		}
 		if item != currentItem {
 			if currentItem != "" {
-				callbacks.OnRecord(currentItem, data)
+				callbacks.OnRecord(currentItem, data, bonusData)
 			}
 			currentItem = item
 			data = make(map[string]decimal.Decimal)
+			bonusData = make(map[string]decimal.Decimal)
 		}
 		data[currency] = value
+		// constb: bonus share is a proportion of net value, round it to minor units like any other amount
+		bonusData[currency] = NewMoney(bonusValue, currency).Round(d.roundingPolicy).Amount
 	}
 	// flush last
-	callbacks.OnRecord(currentItem, data)
+	callbacks.OnRecord(currentItem, data, bonusData)
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/shopspring/decimal"
@@ -38,18 +39,22 @@ func TestBalanceDatabase_FetchUserBalance(t *testing.T) {
 
 	initData := [][]any{
 		// balance
-		{"andy", "USD", "20.00"},
-		{"danny", "USD", "5.00"},
-		{"jenna", "EUR", "200.00"},
+		{"andy", "USD", "20.00", "0.00", "0.00"},
+		{"danny", "USD", "5.00", "0.00", "0.00"},
+		{"jenna", "EUR", "200.00", "0.00", "0.00"},
+		{"jenna", "TRY", "1000.00", "0.00", "0.00"},
+		{"kate", "USD", "10.00", "5.00", "2.50"},
 		// balance_reserve
-		{"xy", "danny", "", "USD", "6.00", "6.00"},
-		{"xz", "jenna", "", "TRY", "500.00", "25.95"},
+		{"xy", "danny", "", "USD", "6.00", "USD", "6.00", "0.00"},
+		{"xz", "jenna", "", "TRY", "500.00", "EUR", "25.95", "0.00"},
+		{"xw", "jenna", "", "TRY", "100.00", "TRY", "100.00", "0.00"},
+		{"xk", "kate", "", "USD", "7.00", "USD", "7.00", "5.00"},
 	}
-	_, _ = db.db.CopyFrom(context.TODO(), pgx.Identifier{"balance"}, []string{"user_id", "currency", "current_value"}, pgx.CopyFromRows(initData[0:3]))
-	_, _ = db.db.CopyFrom(context.TODO(), pgx.Identifier{"balance_reserve"}, []string{"order_id", "user_id", "item_id", "currency", "value", "user_currency_value"}, pgx.CopyFromRows(initData[3:5]))
+	_, _ = db.db.CopyFrom(context.TODO(), pgx.Identifier{"balance"}, []string{"user_id", "currency", "current_value", "bonus_value", "pending_value"}, pgx.CopyFromRows(initData[0:5]))
+	_, _ = db.db.CopyFrom(context.TODO(), pgx.Identifier{"balance_reserve"}, []string{"order_id", "user_id", "item_id", "currency", "value", "wallet_currency", "user_currency_value", "bonus_value"}, pgx.CopyFromRows(initData[5:9]))
 	t.Cleanup(func() {
-		_, _ = db.db.Exec(context.TODO(), `DELETE FROM balance_reserve WHERE user_id IN($1, $2)`, "danny", "jenna")
-		_, _ = db.db.Exec(context.TODO(), `DELETE FROM balance WHERE user_id IN ($1, $2, $3)`, "andy", "danny", "jenna")
+		_, _ = db.db.Exec(context.TODO(), `DELETE FROM balance_reserve WHERE user_id IN($1, $2, $3)`, "danny", "jenna", "kate")
+		_, _ = db.db.Exec(context.TODO(), `DELETE FROM balance WHERE user_id IN ($1, $2, $3, $4)`, "andy", "danny", "jenna", "kate")
 	})
 
 	errUserNotFoundError := assert.ErrorAssertionFunc(func(t assert.TestingT, err error, i ...interface{}) bool {
@@ -60,29 +65,112 @@ func TestBalanceDatabase_FetchUserBalance(t *testing.T) {
 		userID string
 	}
 	tests := []struct {
-		name          string
-		args          args
-		wantCurrency  string
-		wantAvailable decimal.Decimal
-		wantReserved  decimal.Decimal
-		wantErr       assert.ErrorAssertionFunc
+		name        string
+		args        args
+		wantWallets []UserWallet
+		wantErr     assert.ErrorAssertionFunc
 	}{
-		{"nominal balance", args{"andy"}, "USD", decimal.NewFromInt(20), decimal.Zero, assert.NoError},
-		{"overdraft", args{"danny"}, "USD", decimal.NewFromInt(-1), decimal.NewFromInt(6), assert.NoError},
-		{"reserve", args{"jenna"}, "EUR", decimal.NewFromFloat(174.05), decimal.NewFromFloat(25.95), assert.NoError},
-		{"default", args{"manuela"}, "", decimal.Zero, decimal.Zero, errUserNotFoundError},
+		{"nominal balance", args{"andy"}, []UserWallet{{"USD", decimal.NewFromInt(20), decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero}}, assert.NoError},
+		{"overdraft", args{"danny"}, []UserWallet{{"USD", decimal.NewFromInt(-1), decimal.NewFromInt(6), decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero}}, assert.NoError},
+		{"reserve, several wallets", args{"jenna"}, []UserWallet{
+			{"EUR", decimal.NewFromFloat(174.05), decimal.NewFromFloat(25.95), decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero},
+			{"TRY", decimal.NewFromInt(900), decimal.NewFromInt(100), decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero},
+		}, assert.NoError},
+		{"bonus reserved", args{"kate"}, []UserWallet{{"USD", decimal.NewFromInt(8), decimal.NewFromInt(7), decimal.Zero, decimal.Zero, decimal.NewFromInt(5), decimal.NewFromFloat(2.5)}}, assert.NoError},
+		{"default", args{"manuela"}, nil, errUserNotFoundError},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			gotCurrency, gotAvailable, gotReserved, err := db.FetchUserBalance(context.TODO(), tt.args.userID)
+			gotWallets, err := db.FetchUserBalance(context.TODO(), tt.args.userID)
 			if !tt.wantErr(t, err, fmt.Sprintf("FetchUserBalance(%v, %v)", "ctx", tt.args.userID)) {
 				return
 			}
-			assert.Equalf(t, tt.wantCurrency, gotCurrency, "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
-			assert.Equalf(t, tt.wantAvailable.StringFixed(2), gotAvailable.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
-			assert.Equalf(t, tt.wantReserved.StringFixed(2), gotReserved.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+			if !assert.Lenf(t, gotWallets, len(tt.wantWallets), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID) {
+				return
+			}
+			for i, want := range tt.wantWallets {
+				assert.Equalf(t, want.Currency, gotWallets[i].Currency, "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+				assert.Equalf(t, want.Available.StringFixed(2), gotWallets[i].Available.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+				assert.Equalf(t, want.Reserved.StringFixed(2), gotWallets[i].Reserved.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+				assert.Equalf(t, want.CreditLimit.StringFixed(2), gotWallets[i].CreditLimit.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+				assert.Equalf(t, want.BonusAvailable.StringFixed(2), gotWallets[i].BonusAvailable.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+				assert.Equalf(t, want.BonusReserved.StringFixed(2), gotWallets[i].BonusReserved.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+				assert.Equalf(t, want.Pending.StringFixed(2), gotWallets[i].Pending.StringFixed(2), "FetchUserBalance(%v, %v)", "ctx", tt.args.userID)
+			}
 		})
 	}
 }
+
+func TestBalanceDatabase_FetchStatistics(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+
+	// charge and its partial refund
+	_, err := db.TopUp(context.TODO(), "statistics_Test_1", "sol", "USD", "200.00", "")
+	assert.NoError(t, err)
+	_, err = db.CommitReservation(context.TODO(), "statistics_Test_2", "sol", "USD", "30.00", "order1", "book", false)
+	assert.NoError(t, err)
+	_, err = db.Refund(context.TODO(), "statistics_Test_3", "sol", "USD", "10.00", "order1", "book")
+	assert.NoError(t, err)
+
+	// marketplace sale, only commission is revenue, refund returns part of it
+	_, err = db.CommitSale(context.TODO(), "statistics_Test_4", "sol", "tara", "USD", "50.00", "order2", "lamp", false, Commission{Percent: "10"})
+	assert.NoError(t, err)
+	_, err = db.Refund(context.TODO(), "statistics_Test_5", "sol", "USD", "20.00", "order2", "lamp")
+	assert.NoError(t, err)
+
+	// top-ups and orders without item are not counted
+	_, err = db.CommitReservation(context.TODO(), "statistics_Test_6", "sol", "USD", "7.00", "order3", "", false)
+	assert.NoError(t, err)
+
+	// charge half paid by bonus, refund returns bonus in the same proportion
+	_, err = db.GrantBonus(context.TODO(), "statistics_Test_7", "rhea", "EUR", "20.00", "", time.Now().Add(24*time.Hour))
+	assert.NoError(t, err)
+	_, err = db.TopUp(context.TODO(), "statistics_Test_8", "rhea", "EUR", "80.00", "")
+	assert.NoError(t, err)
+	_, err = db.CommitReservation(context.TODO(), "statistics_Test_9", "rhea", "EUR", "40.00", "order4", "song", false)
+	assert.NoError(t, err)
+	_, err = db.Refund(context.TODO(), "statistics_Test_10", "rhea", "EUR", "10.00", "order4", "song")
+	assert.NoError(t, err)
+
+	// charge in another currency than the wallet, bonus share is taken from wallet amounts
+	_, err = db.GrantBonus(context.TODO(), "statistics_Test_11", "vega", "EUR", "10.00", "", time.Now().Add(24*time.Hour))
+	assert.NoError(t, err)
+	_, err = db.TopUp(context.TODO(), "statistics_Test_12", "vega", "EUR", "90.00", "")
+	assert.NoError(t, err)
+	_, err = db.CommitReservation(context.TODO(), "statistics_Test_13", "vega", "USD", "20.00", "order5", "film", false)
+	assert.NoError(t, err)
+	rate, err := ConversionRate("USD", "EUR")
+	assert.NoError(t, err)
+	filmInEur := NewMoney(decimal.NewFromInt(20), "USD").Convert(rate, "EUR", db.roundingPolicy)
+	filmBonus := NewMoney(decimal.NewFromInt(10), "EUR").Min(filmInEur)
+	wantFilmBonus := NewMoney(decimal.NewFromInt(20), "USD").Share(filmBonus.Amount, filmInEur.Amount, db.roundingPolicy)
+
+	var currencies []string
+	values := map[string]map[string]decimal.Decimal{}
+	bonusValues := map[string]map[string]decimal.Decimal{}
+	now := time.Now()
+	db.FetchStatistics(context.TODO(), now.Year(), int(now.Month()), StatisticsCallbacks{
+		OnCurrencies: func(got []string) { currencies = got },
+		OnRecord: func(item string, itemValues, itemBonusValues map[string]decimal.Decimal) {
+			values[item] = itemValues
+			bonusValues[item] = itemBonusValues
+		},
+		OnError: func(err error) { assert.NoError(t, err) },
+	})
+
+	assert.ElementsMatch(t, []string{"EUR", "USD"}, currencies)
+	assert.Len(t, values, 4)
+	assert.Equal(t, "20.00", values["book"]["USD"].StringFixed(2))
+	assert.Equal(t, "0.00", bonusValues["book"]["USD"].StringFixed(2))
+	assert.Equal(t, "3.00", values["lamp"]["USD"].StringFixed(2))
+	assert.Equal(t, "0.00", bonusValues["lamp"]["USD"].StringFixed(2))
+	assert.Equal(t, "30.00", values["song"]["EUR"].StringFixed(2))
+	assert.Equal(t, "15.00", bonusValues["song"]["EUR"].StringFixed(2))
+	assert.Equal(t, "20.00", values["film"]["USD"].StringFixed(2))
+	assert.Equal(t, wantFilmBonus.String(), bonusValues["film"]["USD"].StringFixed(2))
+}
@@ -0,0 +1,286 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/constb/tt-golang/internal/proto"
+	"github.com/constb/tt-golang/internal/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// RateSet is a snapshot of exchange rates: how much of each currency is one unit of base currency
+type RateSet struct {
+	ID        snowflake.ID // id of stored exchange_rate row, zero if the set was not stored
+	Base      string
+	Rates     map[string]decimal.Decimal
+	Timestamp time.Time // when provider published the rates
+	FetchedAt time.Time // when the service loaded them
+}
+
+// ConversionRate returns how much of currency "to" is one unit of currency "from"
+func (s *RateSet) ConversionRate(from, to string) (decimal.Decimal, error) {
+	fromRate, ok := s.Rates[from]
+	if !ok {
+		return decimal.Zero, proto.NewInvalidCurrencyError(from)
+	}
+	toRate, ok := s.Rates[to]
+	if !ok {
+		return decimal.Zero, proto.NewInvalidCurrencyError(to)
+	}
+	return toRate.Div(fromRate), nil
+}
+
+// conversion is exchange rate applied to an amount and the rate set it comes from, zero if amount wasn't converted
+type conversion struct {
+	rateID snowflake.ID
+	rate   decimal.Decimal
+}
+
+func (s *RateSet) conversion(from, to string) (conversion, error) {
+	rate, err := s.ConversionRate(from, to)
+	if err != nil {
+		return conversion{}, err
+	}
+	return conversion{s.ID, rate}, nil
+}
+
+// params returns rate id and rate as query parameters, NULL if not converted
+func (c conversion) params() (rateID, rate any) {
+	if c.rateID != 0 {
+		rateID = c.rateID.Int64()
+	}
+	if !c.rate.IsZero() {
+		rate = c.rate
+	}
+	return rateID, rate
+}
+
+// RateProvider loads current exchange rates
+type RateProvider interface {
+	Rates(ctx context.Context) (*RateSet, error)
+}
+
+// currentRates is swapped as a whole on refresh, conversions read one snapshot and never see a half updated set
+var currentRates atomic.Pointer[RateSet]
+
+func rateSet() *RateSet {
+	return currentRates.Load()
+}
+
+// CurrentRates returns rates currently used for conversions. The set is shared, it must not be modified.
+func CurrentRates() *RateSet {
+	return rateSet()
+}
+
+func storeRates(set *RateSet) {
+	currentRates.Store(set)
+}
+
+// RefreshRates loads rates from configured provider, stores them and makes them current. Current rates are kept if
+// loading or storing fails, or if loaded rates miss any currency of the current ones.
+func (d *BalanceDatabase) RefreshRates(ctx context.Context) error {
+	set, err := d.rateProvider.Rates(ctx)
+	if err != nil {
+		return err
+	}
+	// constb: wallets, reservations and conversion buffers were accepted against current currencies, they can't go away
+	for currency := range rateSet().Rates {
+		if _, ok := set.Rates[currency]; !ok {
+			return fmt.Errorf("refreshed rates miss currency %s", currency)
+		}
+	}
+	if err = d.saveRates(ctx, set); err != nil {
+		return err
+	}
+	storeRates(set)
+	return nil
+}
+
+// saveRates stores rate set as the one valid from now on and closes validity period of the previous one. If the
+// previous set has the same rates it stays valid, and its id is assigned to set.
+func (d *BalanceDatabase) saveRates(ctx context.Context, set *RateSet) (err error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) FIND CURRENTLY VALID SET (table is locked, so that instances refreshing at once don't both add a set)
+	if _, err = tx.Exec(ctx, `LOCK TABLE exchange_rate IN EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("lock rates: %w", err)
+	}
+	var lastID snowflake.ID
+	var lastBase string
+	var lastRates map[string]decimal.Decimal
+	var lastPublishedAt time.Time
+	err = tx.QueryRow(ctx, `
+SELECT id, base, rates, published_at
+FROM exchange_rate
+WHERE valid_to IS NULL
+ORDER BY valid_from DESC
+LIMIT 1`).Scan(&lastID, &lastBase, &lastRates, &lastPublishedAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("read rates: %w", err)
+	}
+	err = nil
+	// constb: sets without provider timestamp are stamped with fetch time, only base and rates tell if they changed
+	published := !set.Timestamp.Equal(set.FetchedAt)
+	if lastID != 0 && lastBase == set.Base && sameRates(lastRates, set.Rates) &&
+		(!published || lastPublishedAt.Equal(set.Timestamp.Truncate(time.Microsecond))) {
+		set.ID = lastID
+		if !published {
+			set.Timestamp = lastPublishedAt
+		}
+		return nil
+	}
+
+	// 2) CLOSE PREVIOUS SET, ADD NEW ONE
+	id := utils.GenerateID()
+	_, err = tx.Exec(ctx, `UPDATE exchange_rate SET valid_to = CURRENT_TIMESTAMP WHERE valid_to IS NULL`)
+	if err != nil {
+		return fmt.Errorf("update rates: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+INSERT INTO exchange_rate (id, base, rates, published_at)
+VALUES ($1, $2, $3, $4)`,
+		id.Int64(), set.Base, set.Rates, set.Timestamp,
+	)
+	if err != nil {
+		return fmt.Errorf("save rates: %w", err)
+	}
+
+	set.ID = id
+	return nil
+}
+
+func sameRates(a, b map[string]decimal.Decimal) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for currency, rate := range a {
+		if other, ok := b[currency]; !ok || !other.Equal(rate) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRateProvider makes provider from configuration: http(s) URL of fixer-style endpoint, path to a JSON file in the
+// same format, or empty string for built-in stub rates.
+func NewRateProvider(source string) RateProvider {
+	switch {
+	case source == "":
+		return StubRateProvider{}
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return &HTTPRateProvider{URL: source, Client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		return FileRateProvider{Path: source}
+	}
+}
+
+// StubRateProvider returns rates built into the service, they never change
+type StubRateProvider struct{}
+
+func (StubRateProvider) Rates(context.Context) (*RateSet, error) {
+	return parseRates(strings.NewReader(stub))
+}
+
+// FileRateProvider reads rates from a local JSON file in fixer format, the file is read again on every refresh
+type FileRateProvider struct {
+	Path string
+}
+
+func (p FileRateProvider) Rates(context.Context) (*RateSet, error) {
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("open rates: %w", err)
+	}
+	defer f.Close()
+	return parseRates(f)
+}
+
+// HTTPRateProvider fetches rates from fixer-style API endpoint (access key, if any, is part of URL)
+type HTTPRateProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+func (p *HTTPRateProvider) Rates(ctx context.Context) (*RateSet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetch rates: %w", err)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch rates: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch rates: %s", res.Status)
+	}
+	return parseRates(res.Body)
+}
+
+// parseRates reads rates in fixer format: {"success": true, "base": "EUR", "timestamp": 1668963843, "rates": {...}}
+func parseRates(r io.Reader) (*RateSet, error) {
+	var v struct {
+		Success   *bool                      `json:"success"`
+		Error     json.RawMessage            `json:"error"`
+		Base      string                     `json:"base"`
+		Timestamp int64                      `json:"timestamp"`
+		Rates     map[string]decimal.Decimal `json:"rates"`
+	}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode rates: %w", err)
+	}
+	if v.Success != nil && !*v.Success {
+		return nil, fmt.Errorf("rates provider error: %s", v.Error)
+	}
+	if v.Base == "" || len(v.Rates) == 0 {
+		return nil, fmt.Errorf("decode rates: no base currency or rates")
+	}
+	for currency, rate := range v.Rates {
+		if !rate.IsPositive() {
+			return nil, fmt.Errorf("decode rates: bad %s rate %s", currency, rate)
+		}
+	}
+	// constb: base is always convertible even if provider doesn't list it
+	if _, ok := v.Rates[v.Base]; !ok {
+		v.Rates[v.Base] = decimal.NewFromInt(1)
+	}
+
+	set := &RateSet{Base: v.Base, Rates: v.Rates, FetchedAt: time.Now()}
+	if v.Timestamp > 0 {
+		set.Timestamp = time.Unix(v.Timestamp, 0)
+	} else {
+		set.Timestamp = set.FetchedAt
+	}
+	return set, nil
+}
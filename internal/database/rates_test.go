@@ -0,0 +1,249 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// setRate replaces rate of one currency in current rates, restore them with loadRatesFromStub
+func setRate(currency string, rate decimal.Decimal) {
+	set := *rateSet()
+	set.Rates = make(map[string]decimal.Decimal, len(set.Rates))
+	for c, r := range rateSet().Rates {
+		set.Rates[c] = r
+	}
+	set.Rates[currency] = rate
+	storeRates(&set)
+}
+
+// writeRates writes rates file for FileRateProvider with current rates, one of them replaced. Zero timestamp is left
+// out of the file.
+func writeRates(t *testing.T, path string, timestamp int64, currency string, rate decimal.Decimal) {
+	t.Helper()
+	v := struct {
+		Base      string                     `json:"base"`
+		Timestamp int64                      `json:"timestamp,omitempty"`
+		Rates     map[string]decimal.Decimal `json:"rates"`
+	}{rateSet().Base, timestamp, make(map[string]decimal.Decimal, len(rateSet().Rates))}
+	for c, r := range rateSet().Rates {
+		v.Rates[c] = r
+	}
+	v.Rates[currency] = rate
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+type failingRateProvider struct{}
+
+func (failingRateProvider) Rates(context.Context) (*RateSet, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestParseRates(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		data     string
+		wantBase string
+		wantUSD  string
+		wantErr  assert.ErrorAssertionFunc
+	}{
+		{"fixer", `{"success": true, "base": "EUR", "timestamp": 1668963843, "rates": {"EUR": 1, "USD": 1.03455}}`, "EUR", "1.03455", assert.NoError},
+		{"exponent", `{"base": "EUR", "rates": {"USD": 1.03455e0}}`, "EUR", "1.03455", assert.NoError},
+		{"base not listed", `{"base": "USD", "rates": {"EUR": 0.96}}`, "USD", "1", assert.NoError},
+
+		{"provider error", `{"success": false, "error": {"code": 101}}`, "", "", assert.Error},
+		{"no rates", `{"base": "EUR", "rates": {}}`, "", "", assert.Error},
+		{"no base", `{"rates": {"USD": 1.03455}}`, "", "", assert.Error},
+		{"zero rate", `{"base": "EUR", "rates": {"USD": 0}}`, "", "", assert.Error},
+		{"not json", `rates`, "", "", assert.Error},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseRates(strings.NewReader(tt.data))
+			if !tt.wantErr(t, err, "parseRates(%v)", tt.data) || err != nil {
+				return
+			}
+			assert.Equalf(t, tt.wantBase, got.Base, "parseRates(%v)", tt.data)
+			assert.Equalf(t, tt.wantUSD, got.Rates["USD"].String(), "parseRates(%v)", tt.data)
+			assert.Falsef(t, got.Timestamp.IsZero(), "parseRates(%v)", tt.data)
+		})
+	}
+}
+
+func TestRateProviders(t *testing.T) {
+	t.Parallel()
+	data := `{"success": true, "base": "EUR", "timestamp": 1668963843, "rates": {"USD": 1.1}}`
+
+	path := filepath.Join(t.TempDir(), "rates.json")
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	set, err := NewRateProvider(path).Rates(context.TODO())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.1", set.Rates["USD"].String())
+		assert.Equal(t, time.Unix(1668963843, 0), set.Timestamp)
+	}
+	_, err = NewRateProvider(filepath.Join(t.TempDir(), "missing.json")).Rates(context.TODO())
+	assert.Error(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	}))
+	defer server.Close()
+	set, err = NewRateProvider(server.URL + "/latest").Rates(context.TODO())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1.1", set.Rates["USD"].String())
+	}
+	_, err = NewRateProvider(server.URL + "/missing").Rates(context.TODO())
+	assert.Error(t, err)
+
+	set, err = NewRateProvider("").Rates(context.TODO())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "EUR", set.Base)
+	}
+}
+
+func TestBalanceDatabase_RefreshRates(t *testing.T) {
+	d, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+	t.Cleanup(loadRatesFromStub)
+	path := filepath.Join(t.TempDir(), "rates.json")
+	d.rateProvider = FileRateProvider{Path: path}
+	storeRates(&RateSet{Base: "EUR", Rates: map[string]decimal.Decimal{"EUR": decimal.NewFromInt(1), "USD": decimal.NewFromInt(1)}})
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"base": "EUR", "rates": {"USD": 2}}`), 0o600))
+	assert.NoError(t, d.RefreshRates(context.TODO()))
+	got, err := ConversionRate("EUR", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, "20.00", NewMoney(decimal.NewFromInt(10), "EUR").Convert(got, "USD", d.roundingPolicy).String())
+	assert.False(t, IsCurrencyValid("TRY"))
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"base": "EUR", "rates": {"USD": 3, "TRY": 20}}`), 0o600))
+	assert.NoError(t, d.RefreshRates(context.TODO()))
+	got, err = ConversionRate("EUR", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, "30.00", NewMoney(decimal.NewFromInt(10), "EUR").Convert(got, "USD", d.roundingPolicy).String())
+	assert.True(t, IsCurrencyValid("TRY"))
+
+	// rates missing a currency are rejected, current rates are kept
+	assert.NoError(t, os.WriteFile(path, []byte(`{"base": "EUR", "rates": {"USD": 4}}`), 0o600))
+	assert.Error(t, d.RefreshRates(context.TODO()))
+	got, err = ConversionRate("EUR", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", got.String())
+	assert.True(t, IsCurrencyValid("TRY"))
+
+	// failed refresh keeps current rates
+	d.rateProvider = failingRateProvider{}
+	assert.Error(t, d.RefreshRates(context.TODO()))
+	assert.True(t, IsCurrencyValid("TRY"))
+}
+
+func TestBalanceDatabase_ExchangeRateHistory(t *testing.T) {
+	db, ok := balanceDatabaseCleanup(t)
+	if !ok {
+		return
+	}
+	t.Cleanup(loadRatesFromStub)
+
+	// rates loaded on connect are stored, loading the same rates again keeps them
+	stubID := rateSet().ID
+	assert.NotZero(t, stubID)
+	assert.NoError(t, db.RefreshRates(context.TODO()))
+	assert.Equal(t, stubID, rateSet().ID)
+
+	// new rates close validity period of previous ones
+	path := filepath.Join(t.TempDir(), "rates.json")
+	writeRates(t, path, 1672131600, "USD", decimal.NewFromInt(2))
+	db.rateProvider = FileRateProvider{Path: path}
+	assert.NoError(t, db.RefreshRates(context.TODO()))
+	rateID := rateSet().ID
+	assert.NotEqual(t, stubID, rateID)
+	var stubValidTo *time.Time
+	err := db.db.QueryRow(context.TODO(), `SELECT valid_to FROM exchange_rate WHERE id = $1`, stubID.Int64()).Scan(&stubValidTo)
+	assert.NoError(t, err)
+	assert.NotNil(t, stubValidTo)
+
+	// cross-currency reservation and charge reference the rates they were converted with
+	_, err = db.TopUp(context.TODO(), "rates_Test_1", "rhea", "EUR", "100.00", "")
+	assert.NoError(t, err)
+	err = db.Reserve(context.TODO(), "rhea", "USD", "10.00", "order1", "item", time.Time{})
+	assert.NoError(t, err)
+	var reserveRateID int64
+	var reserveRate decimal.Decimal
+	err = db.db.QueryRow(context.TODO(), `SELECT exchange_rate_id, rate FROM balance_reserve WHERE order_id = 'order1'`).Scan(&reserveRateID, &reserveRate)
+	assert.NoError(t, err)
+	assert.Equal(t, rateID.Int64(), reserveRateID)
+	assert.Truef(t, reserveRate.Equal(decimal.NewFromFloat(0.5)), "rate got: %v want: %v", reserveRate.String(), "0.5")
+
+	// rates change before commit, charge still references the locked ones
+	writeRates(t, path, 1672135200, "USD", decimal.NewFromInt(4))
+	assert.NoError(t, db.RefreshRates(context.TODO()))
+	txID, err := db.CommitReservation(context.TODO(), "", "rhea", "USD", "10.00", "order1", "item", false)
+	assert.NoError(t, err)
+	var txRateID int64
+	var txRate decimal.Decimal
+	err = db.db.QueryRow(context.TODO(), `SELECT exchange_rate_id, exchange_rate FROM transaction WHERE id = $1`, txID.Int64()).Scan(&txRateID, &txRate)
+	assert.NoError(t, err)
+	assert.Equal(t, rateID.Int64(), txRateID)
+	assert.Truef(t, txRate.Equal(decimal.NewFromFloat(0.5)), "rate got: %v want: %v", txRate.String(), "0.5")
+
+	// refund of a single capture references its rates
+	refundID, err := db.Refund(context.TODO(), "rates_Test_2", "rhea", "USD", "4.00", "order1", "item")
+	assert.NoError(t, err)
+	var refundRateID *int64
+	var refundRate decimal.Decimal
+	err = db.db.QueryRow(context.TODO(), `SELECT exchange_rate_id, exchange_rate FROM transaction WHERE id = $1`, refundID.Int64()).Scan(&refundRateID, &refundRate)
+	assert.NoError(t, err)
+	if assert.NotNil(t, refundRateID) {
+		assert.Equal(t, rateID.Int64(), *refundRateID)
+	}
+	assert.Truef(t, refundRate.Equal(decimal.NewFromFloat(0.5)), "rate got: %v want: %v", refundRate.String(), "0.5")
+
+	// captures at different rates are refunded at their average, which is none of the stored rate sets
+	db.rateLockTTL = time.Millisecond
+	err = db.Reserve(context.TODO(), "rhea", "USD", "20.00", "order2", "item", time.Time{})
+	assert.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+	_, err = db.CommitReservation(context.TODO(), "rates_Test_3", "rhea", "USD", "10.00", "order2", "item", true)
+	assert.NoError(t, err)
+	writeRates(t, path, 1672138800, "USD", decimal.NewFromInt(5))
+	assert.NoError(t, db.RefreshRates(context.TODO()))
+	_, err = db.CommitReservation(context.TODO(), "rates_Test_4", "rhea", "USD", "10.00", "order2", "item", false)
+	assert.NoError(t, err)
+	refundID, err = db.Refund(context.TODO(), "rates_Test_5", "rhea", "USD", "", "order2", "item")
+	assert.NoError(t, err)
+	err = db.db.QueryRow(context.TODO(), `SELECT exchange_rate_id, exchange_rate FROM transaction WHERE id = $1`, refundID.Int64()).Scan(&refundRateID, &refundRate)
+	assert.NoError(t, err)
+	assert.Nil(t, refundRateID)
+	assert.Truef(t, refundRate.Equal(decimal.NewFromFloat(0.225)), "rate got: %v want: %v", refundRate.String(), "0.225")
+
+	// rates without provider timestamp are stored once, until they change
+	writeRates(t, path, 0, "USD", decimal.NewFromInt(5))
+	assert.NoError(t, db.RefreshRates(context.TODO()))
+	unpublishedID := rateSet().ID
+	assert.NoError(t, db.RefreshRates(context.TODO()))
+	assert.Equal(t, unpublishedID, rateSet().ID)
+	writeRates(t, path, 0, "USD", decimal.NewFromInt(6))
+	assert.NoError(t, db.RefreshRates(context.TODO()))
+	assert.NotEqual(t, unpublishedID, rateSet().ID)
+}
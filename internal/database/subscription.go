@@ -0,0 +1,343 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/constb/tt-golang/internal/proto"
+	"github.com/constb/tt-golang/internal/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// subscription statuses as stored in subscription.status column
+const (
+	SubscriptionStatusActive    = "active"
+	SubscriptionStatusPaused    = "paused"
+	SubscriptionStatusPastDue   = "past_due" // charge failed more than max retries times, resume to try again
+	SubscriptionStatusCancelled = "cancelled"
+)
+
+const (
+	defaultSubscriptionMaxRetries    = 3
+	defaultSubscriptionRetryInterval = "1 day"
+)
+
+// intervals are kept in postgres-compatible form, e.g. "1 month" or "2 weeks"
+var subscriptionIntervalRegexp = regexp.MustCompile(`^[1-9][0-9]{0,2} (hour|day|week|month|year)s?$`)
+
+type Subscription struct {
+	ID            snowflake.ID
+	UserID        string
+	Currency      string
+	Value         decimal.Decimal
+	ItemID        string
+	Interval      string
+	Status        string
+	NextAttemptAt time.Time
+	ChargeCount   int
+	RetryCount    int
+	LastError     string
+	CreatedAt     time.Time
+}
+
+const subscriptionColumns = `id, user_id, currency, "value", item_id, charge_interval, status, next_attempt_at, charge_count,
+       retry_count, coalesce(last_error, ''), created_at`
+
+func scanSubscription(row pgx.Row) (*Subscription, error) {
+	s := &Subscription{}
+	err := row.Scan(&s.ID, &s.UserID, &s.Currency, &s.Value, &s.ItemID, &s.Interval, &s.Status, &s.NextAttemptAt,
+		&s.ChargeCount, &s.RetryCount, &s.LastError, &s.CreatedAt)
+	return s, err
+}
+
+// CreateSubscription registers recurring charge of value every interval, first one at startAt (now if empty or in the past). Charges
+// that fail for lack of money are retried maxRetries times every retryInterval (3 times daily if maxRetries is negative
+// and retryInterval is empty), zero maxRetries means no retries.
+func (d *BalanceDatabase) CreateSubscription(ctx context.Context, userID, currency, value, itemID, interval string, startAt time.Time, maxRetries int, retryInterval string) (*Subscription, error) {
+	if userID == "" {
+		return nil, proto.NewBadParameterError("user id")
+	}
+	if !IsCurrencyValid(currency) {
+		return nil, proto.NewBadParameterError("currency")
+	}
+	chargeValue, err := ParseMoney(value, currency)
+	if err != nil || !chargeValue.IsPositive() {
+		return nil, proto.NewBadParameterError("value")
+	}
+	if itemID == "" {
+		return nil, proto.NewBadParameterError("item id")
+	}
+	if !subscriptionIntervalRegexp.MatchString(interval) {
+		return nil, proto.NewBadParameterError("interval")
+	}
+	if maxRetries < 0 {
+		maxRetries = defaultSubscriptionMaxRetries
+	}
+	if retryInterval == "" {
+		retryInterval = defaultSubscriptionRetryInterval
+	}
+	if !subscriptionIntervalRegexp.MatchString(retryInterval) {
+		return nil, proto.NewBadParameterError("retry interval")
+	}
+	if now := time.Now(); startAt.Before(now) {
+		// constb: no charging for periods in the past
+		startAt = now
+	}
+
+	row := d.db.QueryRow(ctx, `
+INSERT INTO subscription (id, user_id, currency, "value", item_id, charge_interval, status, due_at, next_attempt_at,
+                          max_retries, retry_interval)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8, $9, $10)
+RETURNING `+subscriptionColumns,
+		utils.GenerateID().Int64(), userID, currency, chargeValue.Amount, itemID, interval, SubscriptionStatusActive, startAt,
+		maxRetries, retryInterval,
+	)
+	subscription, err := scanSubscription(row)
+	if err != nil {
+		return nil, fmt.Errorf("save subscription: %w", err)
+	}
+	return subscription, nil
+}
+
+// PauseSubscription stops charging until subscription is resumed.
+func (d *BalanceDatabase) PauseSubscription(ctx context.Context, id snowflake.ID) (*Subscription, error) {
+	return d.changeSubscriptionStatus(ctx, id, SubscriptionStatusPaused, SubscriptionStatusActive, SubscriptionStatusPastDue)
+}
+
+// ResumeSubscription continues charging paused or past due subscription. Missed periods are not charged, next charge
+// is made right away if it is overdue.
+func (d *BalanceDatabase) ResumeSubscription(ctx context.Context, id snowflake.ID) (*Subscription, error) {
+	return d.changeSubscriptionStatus(ctx, id, SubscriptionStatusActive, SubscriptionStatusPaused, SubscriptionStatusPastDue)
+}
+
+// CancelSubscription stops charging for good.
+func (d *BalanceDatabase) CancelSubscription(ctx context.Context, id snowflake.ID) (*Subscription, error) {
+	return d.changeSubscriptionStatus(ctx, id, SubscriptionStatusCancelled, SubscriptionStatusActive, SubscriptionStatusPaused, SubscriptionStatusPastDue)
+}
+
+func (d *BalanceDatabase) changeSubscriptionStatus(ctx context.Context, id snowflake.ID, status string, allowedFrom ...string) (subscription *Subscription, err error) {
+	if id == 0 {
+		return nil, proto.NewBadParameterError("subscription id")
+	}
+
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) LOAD SUBSCRIPTION AND LOCK FOR UPDATE (waits for a charge in progress)
+	subscription, err = scanSubscription(tx.QueryRow(ctx, `SELECT `+subscriptionColumns+` FROM subscription WHERE id = $1 FOR UPDATE`, id.Int64()))
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = proto.NewBadParameterError("subscription id")
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load subscription: %w", err)
+	}
+	if subscription.Status == status {
+		// constb: duplicate request, pretend we have changed it now
+		return subscription, nil
+	}
+	allowed := false
+	for _, from := range allowedFrom {
+		allowed = allowed || subscription.Status == from
+	}
+	if !allowed {
+		// must set err to trigger Rollback
+		err = proto.NewInvalidStateError()
+		return nil, err
+	}
+
+	// 2) UPDATE STATUS (resumed subscription starts retries over and skips missed periods)
+	subscription, err = scanSubscription(tx.QueryRow(ctx, `
+UPDATE subscription
+SET status          = $2,
+    retry_count     = CASE WHEN $2 = $3 THEN 0 ELSE retry_count END,
+    due_at          = CASE WHEN $2 = $3 THEN greatest(due_at, $4) ELSE due_at END,
+    next_attempt_at = CASE WHEN $2 = $3 THEN greatest(due_at, $4) ELSE next_attempt_at END
+WHERE id = $1
+RETURNING `+subscriptionColumns,
+		id.Int64(), status, SubscriptionStatusActive, time.Now(),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("update subscription: %w", err)
+	}
+
+	return subscription, nil
+}
+
+// ChargeDueSubscriptions charges up to limit active subscriptions that are due by now, once per subscription even if
+// several periods were missed. Returns number of processed subscriptions, successful or not. Safe to run on several
+// replicas at once.
+func (d *BalanceDatabase) ChargeDueSubscriptions(ctx context.Context, limit int) (int, error) {
+	now := time.Now()
+	var count int
+	for count < limit {
+		ok, err := d.chargeNextSubscription(ctx, now)
+		if err != nil {
+			return count, err
+		}
+		if !ok {
+			break
+		}
+		count++
+	}
+	return count, nil
+}
+
+// chargeNextSubscription charges a single due subscription, returns false if there is nothing to charge.
+func (d *BalanceDatabase) chargeNextSubscription(ctx context.Context, now time.Time) (ok bool, err error) {
+	// x) WRAP IN TRANSACTION
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		} else {
+			_ = tx.Commit(ctx)
+		}
+	}()
+
+	// 1) PICK DUE SUBSCRIPTION AND LOCK FOR UPDATE
+	// constb: other replicas skip locked rows and take the next one, and once we commit, this one is not due anymore
+	var maxRetries int
+	var subscription *Subscription
+	row := tx.QueryRow(ctx, `
+SELECT `+subscriptionColumns+`, max_retries
+FROM subscription
+WHERE status = $1 AND next_attempt_at <= $2
+ORDER BY next_attempt_at
+LIMIT 1
+FOR UPDATE SKIP LOCKED`, SubscriptionStatusActive, now)
+	subscription = &Subscription{}
+	err = row.Scan(&subscription.ID, &subscription.UserID, &subscription.Currency, &subscription.Value, &subscription.ItemID,
+		&subscription.Interval, &subscription.Status, &subscription.NextAttemptAt, &subscription.ChargeCount,
+		&subscription.RetryCount, &subscription.LastError, &subscription.CreatedAt, &maxRetries)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = nil
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("pick subscription: %w", err)
+	}
+
+	// 2) RESERVE AND COMMIT IN A SAVEPOINT, SO THAT FAILED CHARGE CAN BE ROLLED BACK AND RECORDED
+	// constb: order id is unique per period and doubles as idempotency key
+	orderID := fmt.Sprintf("sub-%d-%d", subscription.ID, subscription.ChargeCount+1)
+	value := NewMoney(subscription.Value, subscription.Currency).String()
+	var charge pgx.Tx
+	charge, err = tx.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("begin savepoint: %w", err)
+	}
+	chargeErr := d.reserve(ctx, charge, subscription.UserID, subscription.Currency, value, orderID, subscription.ItemID, time.Time{})
+	if chargeErr == nil {
+		_, chargeErr = d.commitReservation(ctx, charge, orderID, subscription.UserID, subscription.Currency, value, orderID, subscription.ItemID, false, "", Commission{})
+	}
+	var protoErr *proto.Error
+	if chargeErr != nil && !errors.As(chargeErr, &protoErr) {
+		// constb: database failure, roll everything back and try again on the next run
+		err = chargeErr
+		return false, err
+	}
+	if chargeErr != nil {
+		err = charge.Rollback(ctx)
+	} else {
+		err = charge.Commit(ctx)
+	}
+	if err != nil {
+		return false, fmt.Errorf("end savepoint: %w", err)
+	}
+
+	// 3) SCHEDULE NEXT CHARGE OR RETRY
+	switch {
+	case chargeErr == nil:
+		// constb: next period that starts after now, periods missed while charging was not running are skipped the
+		// same way resume skips them
+		_, err = tx.Exec(ctx, `
+UPDATE subscription s
+SET due_at          = n.due_at,
+    next_attempt_at = n.due_at,
+    charge_count    = s.charge_count + 1,
+    retry_count     = 0,
+    last_error      = NULL
+FROM (SELECT min(t) AS due_at
+      FROM subscription,
+           generate_series(due_at + charge_interval::interval, greatest(due_at, $2::timestamptz) + charge_interval::interval,
+                           charge_interval::interval) t
+      WHERE id = $1 AND t > $2::timestamptz) n
+WHERE s.id = $1`, subscription.ID.Int64(), now)
+	case (protoErr.GetNotEnoughMoney() != nil || protoErr.GetAccountFrozen() != nil) && subscription.RetryCount < maxRetries:
+		// constb: user may top up or get unfrozen in the meantime
+		_, err = tx.Exec(ctx, `
+UPDATE subscription
+SET next_attempt_at = $2::timestamptz + retry_interval::interval,
+    retry_count     = retry_count + 1,
+    last_error      = $3
+WHERE id = $1`, subscription.ID.Int64(), now, protoErr.Error())
+	default:
+		// constb: out of retries or an error that won't go away by itself
+		_, err = tx.Exec(ctx, `
+UPDATE subscription
+SET status     = $2,
+    last_error = $3
+WHERE id = $1`, subscription.ID.Int64(), SubscriptionStatusPastDue, protoErr.Error())
+	}
+	if err != nil {
+		return false, fmt.Errorf("update subscription: %w", err)
+	}
+
+	return true, nil
+}
+
+// FetchUserSubscriptions returns all subscriptions of the user, newest first.
+func (d *BalanceDatabase) FetchUserSubscriptions(ctx context.Context, userID string) ([]*Subscription, error) {
+	if userID == "" {
+		return nil, proto.NewBadParameterError("user id")
+	}
+
+	rows, err := d.db.Query(ctx, `SELECT `+subscriptionColumns+` FROM subscription WHERE user_id = $1 ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("load subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subscriptions []*Subscription
+	for rows.Next() {
+		var next *Subscription
+		if next, err = scanSubscription(rows); err != nil {
+			return nil, fmt.Errorf("scan subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, next)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("load subscriptions: %w", err)
+	}
+
+	return subscriptions, nil
+}
@@ -19,6 +19,10 @@ func (m *Error) Error() string {
 		return fmt.Sprintf("invalid currency %s", e.InvalidCurrency.Currency)
 	case *Error_InvalidState:
 		return "order is in invalid state"
+	case *Error_IdempotencyConflict:
+		return fmt.Sprintf("idempotency conflict %s", e.IdempotencyConflict.Name)
+	case *Error_AccountFrozen:
+		return fmt.Sprintf("account is %s", e.AccountFrozen.Status)
 	default:
 		return m.String()
 	}
@@ -47,3 +51,11 @@ func NewInvalidCurrencyError(currency string) *Error {
 func NewInvalidStateError() *Error {
 	return &Error{OneError: &Error_InvalidState{&InvalidStateError{}}}
 }
+
+func NewIdempotencyConflictError(name string) *Error {
+	return &Error{OneError: &Error_IdempotencyConflict{&IdempotencyConflictError{Name: name}}}
+}
+
+func NewAccountFrozenError(status string) *Error {
+	return &Error{OneError: &Error_AccountFrozen{&AccountFrozenError{Status: status}}}
+}
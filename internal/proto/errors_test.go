@@ -18,6 +18,8 @@ func TestError_Error(t *testing.T) {
 		{"not enough money", &Error_NotEnoughMoney{NotEnoughMoney: &NotEnoughMoneyError{}}, "not enough money"},
 		{"user not found", &Error_UserNotFound{UserNotFound: &UserNotFoundError{}}, "user not found"},
 		{"invalid currency", &Error_InvalidCurrency{InvalidCurrency: &InvalidCurrencyError{Currency: "xxx"}}, "invalid currency xxx"},
+		{"idempotency conflict", &Error_IdempotencyConflict{IdempotencyConflict: &IdempotencyConflictError{Name: "value"}}, "idempotency conflict value"},
+		{"account frozen", &Error_AccountFrozen{AccountFrozen: &AccountFrozenError{Status: "frozen"}}, "account is frozen"},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -100,3 +102,21 @@ func TestNewUserNotFoundError(t *testing.T) {
 		t.Errorf("NewNotEnoughMoneyError() = %v, want %v", got, want)
 	}
 }
+
+func TestNewIdempotencyConflictError(t *testing.T) {
+	t.Parallel()
+
+	want := &Error{OneError: &Error_IdempotencyConflict{IdempotencyConflict: &IdempotencyConflictError{Name: "value"}}}
+	if got := NewIdempotencyConflictError("value"); !reflect.DeepEqual(got, want) {
+		t.Errorf("NewIdempotencyConflictError() = %v, want %v", got, want)
+	}
+}
+
+func TestNewAccountFrozenError(t *testing.T) {
+	t.Parallel()
+
+	want := &Error{OneError: &Error_AccountFrozen{AccountFrozen: &AccountFrozenError{Status: "blocked"}}}
+	if got := NewAccountFrozenError("blocked"); !reflect.DeepEqual(got, want) {
+		t.Errorf("NewAccountFrozenError() = %v, want %v", got, want)
+	}
+}
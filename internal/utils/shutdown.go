@@ -5,6 +5,7 @@ import (
 	"os/signal"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 var shutdown atomic.Bool
@@ -15,16 +16,18 @@ func init() {
 	shutdown.Store(false)
 	waitForShutdown = make(chan struct{})
 
+	// constb: subscribe before starting goroutine, otherwise early signal is not caught
+	c := make(chan os.Signal, 1)
+	signal.Notify(c,
+		// https://www.gnu.org/software/libc/manual/html_node/Termination-Signals.html
+		syscall.SIGTERM, // "the normal way to politely ask a program to terminate"
+		syscall.SIGINT,  // Ctrl+C
+		syscall.SIGQUIT, // Ctrl-\
+		syscall.SIGKILL, // "always fatal", "SIGKILL and SIGSTOP may not be caught by a program"
+		syscall.SIGHUP,  // "terminal is disconnected"
+	)
+
 	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c,
-			// https://www.gnu.org/software/libc/manual/html_node/Termination-Signals.html
-			syscall.SIGTERM, // "the normal way to politely ask a program to terminate"
-			syscall.SIGINT,  // Ctrl+C
-			syscall.SIGQUIT, // Ctrl-\
-			syscall.SIGKILL, // "always fatal", "SIGKILL and SIGSTOP may not be caught by a program"
-			syscall.SIGHUP,  // "terminal is disconnected"
-		)
 		<-c
 		shutdown.Store(true)
 		close(waitForShutdown)
@@ -40,3 +43,29 @@ func WaitForShutdownSignal() {
 	<-waitForShutdown
 	logger.Info("Shutdown signal received")
 }
+
+// RunPeriodically calls fn every interval until shutdown signal is received. Returned channel is closed after
+// the running call of fn (if any) is complete, wait for it before exiting.
+func RunPeriodically(interval time.Duration, fn func()) <-chan struct{} {
+	return runPeriodically(interval, waitForShutdown, fn)
+}
+
+func runPeriodically(interval time.Duration, stop <-chan struct{}, fn func()) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+
+	return done
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,3 +18,24 @@ func TestIsShuttingDown(t *testing.T) {
 	WaitForShutdownSignal()
 	assert.Equal(t, true, IsShuttingDown(), "SIGINT signal trap")
 }
+
+func TestRunPeriodically(t *testing.T) {
+	stop := make(chan struct{})
+	calls := make(chan struct{}, 10)
+	done := runPeriodically(time.Millisecond, stop, func() {
+		select {
+		case calls <- struct{}{}:
+		default:
+		}
+	})
+
+	<-calls
+	<-calls
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("periodic runner did not stop")
+	}
+}
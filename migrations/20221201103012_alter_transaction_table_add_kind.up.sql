@@ -0,0 +1,8 @@
+alter table transaction
+    add column kind varchar(16);
+
+update transaction
+set kind = case when sender_id is null then 'top_up' else 'charge' end;
+
+alter table transaction
+    alter column kind set not null;
@@ -0,0 +1,13 @@
+delete from transaction
+where kind = 'refund';
+
+drop index transaction_order_id_index;
+
+create unique index transaction_order_id_index
+    on "transaction" ((order_data ->> 'order_id'))
+    where (order_data ->> 'order_id') is not null;
+
+drop index transaction_refund_of_index;
+
+alter table transaction
+    drop column refund_of;
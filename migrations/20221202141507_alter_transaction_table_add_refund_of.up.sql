@@ -0,0 +1,15 @@
+alter table transaction
+    add column refund_of int8
+        constraint transaction_transaction_refund_of_fk
+            references transaction (id)
+            on update restrict on delete restrict;
+
+create index transaction_refund_of_index
+    on transaction (refund_of)
+    where refund_of is not null;
+
+drop index transaction_order_id_index;
+
+create unique index transaction_order_id_index
+    on "transaction" ((order_data ->> 'order_id'))
+    where (order_data ->> 'order_id') is not null and kind = 'charge';
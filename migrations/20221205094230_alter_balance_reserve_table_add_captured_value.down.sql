@@ -0,0 +1,8 @@
+drop index transaction_order_id_index;
+
+create unique index transaction_order_id_index
+    on "transaction" ((order_data ->> 'order_id'))
+    where (order_data ->> 'order_id') is not null and kind = 'charge';
+
+alter table balance_reserve
+    drop column captured_value;
@@ -0,0 +1,8 @@
+alter table balance_reserve
+    add column captured_value numeric(10, 2) default 0 not null;
+
+drop index transaction_order_id_index;
+
+create index transaction_order_id_index
+    on "transaction" ((order_data ->> 'order_id'))
+    where (order_data ->> 'order_id') is not null;
@@ -0,0 +1,2 @@
+alter table balance_reserve
+    drop column expires_at;
@@ -0,0 +1,2 @@
+alter table balance_reserve
+    add column expires_at timestamptz;
@@ -0,0 +1,6 @@
+alter table balance_reserve
+    drop constraint balance_reserve_pk;
+
+alter table balance_reserve
+    add constraint balance_reserve_pk
+        primary key (order_id);
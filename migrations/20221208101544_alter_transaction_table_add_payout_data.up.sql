@@ -0,0 +1,2 @@
+alter table transaction
+    add column payout_data jsonb;
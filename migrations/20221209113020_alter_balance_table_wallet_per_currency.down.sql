@@ -0,0 +1,32 @@
+alter table balance_reserve
+    drop constraint balance_reserve_balance_user_id_fk;
+
+alter table balance_reserve
+    drop column wallet_currency;
+
+alter table transaction
+    drop constraint transaction_balance__fk;
+
+alter table transaction
+    drop constraint transaction_balance_sender_id_fk;
+
+alter table balance
+    drop constraint balance_pk;
+
+alter table balance
+    add constraint balance_pk
+        primary key (user_id);
+
+alter table balance_reserve
+    add constraint balance_reserve_balance_user_id_fk
+        foreign key (user_id) references balance (user_id);
+
+alter table transaction
+    add constraint transaction_balance__fk
+        foreign key (recipient_id) references balance (user_id)
+            on update restrict on delete restrict;
+
+alter table transaction
+    add constraint transaction_balance_sender_id_fk
+        foreign key (sender_id) references balance (user_id)
+            on update restrict on delete restrict;
@@ -0,0 +1,40 @@
+alter table balance_reserve
+    drop constraint balance_reserve_balance_user_id_fk;
+
+alter table transaction
+    drop constraint transaction_balance__fk;
+
+alter table transaction
+    drop constraint transaction_balance_sender_id_fk;
+
+alter table balance
+    drop constraint balance_pk;
+
+alter table balance
+    add constraint balance_pk
+        primary key (user_id, currency);
+
+alter table balance_reserve
+    add column wallet_currency varchar(3);
+
+update balance_reserve
+set wallet_currency = balance.currency
+from balance
+where balance.user_id = balance_reserve.user_id;
+
+alter table balance_reserve
+    alter column wallet_currency set not null;
+
+alter table balance_reserve
+    add constraint balance_reserve_balance_user_id_fk
+        foreign key (user_id, wallet_currency) references balance (user_id, currency);
+
+alter table transaction
+    add constraint transaction_balance__fk
+        foreign key (recipient_id, recipient_currency) references balance (user_id, currency)
+            on update restrict on delete restrict;
+
+alter table transaction
+    add constraint transaction_balance_sender_id_fk
+        foreign key (sender_id, sender_currency) references balance (user_id, currency)
+            on update restrict on delete restrict;
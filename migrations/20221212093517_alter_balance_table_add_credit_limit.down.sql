@@ -0,0 +1,2 @@
+alter table balance
+    drop column credit_limit;
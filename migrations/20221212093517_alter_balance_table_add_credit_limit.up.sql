@@ -0,0 +1,4 @@
+alter table balance
+    add column credit_limit numeric(10, 2) default 0 not null
+        constraint balance_credit_limit_check
+            check (credit_limit >= 0);
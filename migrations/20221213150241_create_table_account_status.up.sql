@@ -0,0 +1,13 @@
+create table account_status
+(
+    id         int8                                not null,
+    user_id    varchar(36)                         not null,
+    status     varchar(16)                         not null,
+    reason     text                                not null,
+    created_at timestamp default CURRENT_TIMESTAMP not null,
+    constraint account_status_pk
+        primary key (id)
+);
+
+create index account_status_user_id_index
+    on account_status (user_id, id);
@@ -0,0 +1,5 @@
+alter table balance_reserve
+    drop column rate_expires_at;
+
+alter table balance_reserve
+    drop column rate;
@@ -0,0 +1,5 @@
+alter table balance_reserve
+    add column rate numeric;
+
+alter table balance_reserve
+    add column rate_expires_at timestamptz;
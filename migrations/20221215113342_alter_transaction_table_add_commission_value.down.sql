@@ -0,0 +1,2 @@
+alter table transaction
+    drop column commission_value;
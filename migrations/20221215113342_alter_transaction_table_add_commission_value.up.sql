@@ -0,0 +1,2 @@
+alter table transaction
+    add column commission_value numeric(10, 2);
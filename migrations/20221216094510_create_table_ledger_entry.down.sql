@@ -0,0 +1 @@
+drop table ledger_entry;
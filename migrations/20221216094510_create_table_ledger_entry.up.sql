@@ -0,0 +1,24 @@
+-- ledger starts with this migration, transactions made earlier have no entries
+create table ledger_entry
+(
+    id             int8                                not null,
+    transaction_id int8                                not null,
+    account        varchar(16)                         not null,
+    user_id        varchar(36),
+    currency       varchar(3)                          not null,
+    amount         numeric(12, 2)                      not null,
+    created_at     timestamp default CURRENT_TIMESTAMP not null,
+    constraint ledger_entry_pk
+        primary key (id),
+    constraint ledger_entry_transaction_id_fk
+        foreign key (transaction_id) references transaction (id)
+            on update restrict on delete restrict,
+    constraint ledger_entry_user_id_check
+        check ((account = 'user') = (user_id is not null))
+);
+
+create index ledger_entry_transaction_id_index
+    on ledger_entry (transaction_id);
+
+create index ledger_entry_account_currency_index
+    on ledger_entry (account, currency, created_at);
@@ -0,0 +1,27 @@
+create table subscription
+(
+    id              int8                                not null,
+    user_id         varchar(36)                         not null,
+    currency        varchar(3)                          not null,
+    value           numeric(10, 2)                      not null,
+    item_id         varchar(36)                         not null,
+    charge_interval varchar(16)                         not null,
+    status          varchar(16)                         not null,
+    due_at          timestamptz                         not null,
+    next_attempt_at timestamptz                         not null,
+    charge_count    int4      default 0                 not null,
+    retry_count     int4      default 0                 not null,
+    max_retries     int4                                not null,
+    retry_interval  varchar(16)                         not null,
+    last_error      text,
+    created_at      timestamp default CURRENT_TIMESTAMP not null,
+    constraint subscription_pk
+        primary key (id)
+);
+
+create index subscription_next_attempt_at_index
+    on subscription (next_attempt_at)
+    where status = 'active';
+
+create index subscription_user_id_index
+    on subscription (user_id, id);
@@ -0,0 +1,20 @@
+alter table ledger_entry
+    drop constraint ledger_entry_user_id_check;
+
+alter table ledger_entry
+    add constraint ledger_entry_user_id_check
+        check ((account = 'user') = (user_id is not null));
+
+drop table bonus;
+
+alter table transaction
+    drop column bonus_expires_at;
+
+alter table transaction
+    drop column bonus_value;
+
+alter table balance_reserve
+    drop column bonus_value;
+
+alter table balance
+    drop column bonus_value;
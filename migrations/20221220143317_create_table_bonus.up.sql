@@ -0,0 +1,48 @@
+alter table balance
+    add column bonus_value numeric(10, 2) default 0 not null
+        constraint balance_bonus_value_check
+            check (bonus_value >= 0);
+
+alter table balance_reserve
+    add column bonus_value numeric(10, 2) default 0 not null;
+
+alter table transaction
+    add column bonus_value numeric(10, 2);
+
+alter table transaction
+    add column bonus_expires_at timestamptz;
+
+create table bonus
+(
+    id              int8                                not null,
+    user_id         varchar(36)                         not null,
+    currency        varchar(3)                          not null,
+    value           numeric(10, 2)                      not null,
+    remaining_value numeric(10, 2)                      not null,
+    expires_at      timestamptz                         not null,
+    transaction_id  int8                                not null,
+    created_at      timestamp default CURRENT_TIMESTAMP not null,
+    constraint bonus_pk
+        primary key (id),
+    constraint bonus_balance_fk
+        foreign key (user_id, currency) references balance (user_id, currency),
+    constraint bonus_transaction_fk
+        foreign key (transaction_id) references transaction (id),
+    constraint bonus_remaining_value_check
+        check (remaining_value >= 0 and remaining_value <= value)
+);
+
+create index bonus_user_id_currency_expires_at_index
+    on bonus (user_id, currency, expires_at)
+    where remaining_value > 0;
+
+create index bonus_expires_at_index
+    on bonus (expires_at)
+    where remaining_value > 0;
+
+alter table ledger_entry
+    drop constraint ledger_entry_user_id_check;
+
+alter table ledger_entry
+    add constraint ledger_entry_user_id_check
+        check ((account in ('user', 'user_bonus')) = (user_id is not null));
@@ -0,0 +1,10 @@
+alter table balance
+    drop column pending_value;
+
+drop index transaction_status_index;
+
+alter table transaction
+    drop column pending_top_up;
+
+alter table transaction
+    drop column status;
@@ -0,0 +1,12 @@
+alter table transaction
+    add column status varchar(16) default 'completed' not null;
+
+alter table transaction
+    add column pending_top_up boolean default false not null;
+
+create index transaction_status_index
+    on transaction (status)
+    where status = 'pending';
+
+alter table balance
+    add column pending_value numeric(10, 2) default 0 not null;
@@ -0,0 +1,13 @@
+do
+$$
+    begin
+        if exists(select 1 from transaction where kind = 'reversal') then
+            raise exception 'reversals exist, they can''t be kept without reversal_of';
+        end if;
+    end
+$$;
+
+drop index transaction_reversal_of_index;
+
+alter table transaction
+    drop column reversal_of;
@@ -0,0 +1,9 @@
+alter table transaction
+    add column reversal_of int8
+        constraint transaction_transaction_reversal_of_fk
+            references transaction (id)
+            on update restrict on delete restrict;
+
+create unique index transaction_reversal_of_index
+    on transaction (reversal_of)
+    where reversal_of is not null;
@@ -0,0 +1,25 @@
+create table debt
+(
+    id              int8                                not null,
+    user_id         varchar(36)                         not null,
+    currency        varchar(3)                          not null,
+    value           numeric(10, 2)                      not null,
+    remaining_value numeric(10, 2)                      not null,
+    transaction_id  int8                                not null,
+    order_id        varchar(255),
+    item_id         varchar(255),
+    created_at      timestamp default CURRENT_TIMESTAMP not null,
+    repaid_at       timestamp,
+    constraint debt_pk
+        primary key (id),
+    constraint debt_balance_fk
+        foreign key (user_id, currency) references balance (user_id, currency),
+    constraint debt_transaction_fk
+        foreign key (transaction_id) references transaction (id),
+    constraint debt_remaining_value_check
+        check (remaining_value >= 0 and remaining_value <= value)
+);
+
+create index debt_user_id_currency_index
+    on debt (user_id, currency, id)
+    where remaining_value > 0;
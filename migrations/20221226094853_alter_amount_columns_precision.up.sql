@@ -0,0 +1,36 @@
+alter table balance
+    alter column current_value type numeric(20, 8),
+    alter column credit_limit type numeric(20, 8),
+    alter column bonus_value type numeric(20, 8),
+    alter column pending_value type numeric(20, 8);
+
+alter table transaction
+    alter column transaction_value type numeric(20, 8),
+    alter column sender_value type numeric(20, 8),
+    alter column sender_balance_before type numeric(20, 8),
+    alter column sender_balance_after type numeric(20, 8),
+    alter column recipient_value type numeric(20, 8),
+    alter column recipient_balance_before type numeric(20, 8),
+    alter column recipient_balance_after type numeric(20, 8),
+    alter column commission_value type numeric(20, 8),
+    alter column bonus_value type numeric(20, 8);
+
+alter table balance_reserve
+    alter column value type numeric(20, 8),
+    alter column user_currency_value type numeric(20, 8),
+    alter column captured_value type numeric(20, 8),
+    alter column bonus_value type numeric(20, 8);
+
+alter table subscription
+    alter column value type numeric(20, 8);
+
+alter table bonus
+    alter column value type numeric(20, 8),
+    alter column remaining_value type numeric(20, 8);
+
+alter table debt
+    alter column value type numeric(20, 8),
+    alter column remaining_value type numeric(20, 8);
+
+alter table ledger_entry
+    alter column amount type numeric(22, 8);
@@ -0,0 +1,8 @@
+alter table balance_reserve
+    drop column exchange_rate_id;
+
+alter table transaction
+    drop column exchange_rate,
+    drop column exchange_rate_id;
+
+drop table exchange_rate;
@@ -0,0 +1,27 @@
+create table exchange_rate
+(
+    id           int8                                  not null,
+    base         varchar(3)                            not null,
+    rates        jsonb                                 not null,
+    published_at timestamptz                           not null,
+    valid_from   timestamptz default CURRENT_TIMESTAMP not null,
+    valid_to     timestamptz,
+    constraint exchange_rate_pk
+        primary key (id)
+);
+
+create index exchange_rate_valid_from_index
+    on exchange_rate (valid_from);
+
+alter table transaction
+    add column exchange_rate_id int8
+        constraint transaction_exchange_rate_id_fk
+            references exchange_rate (id)
+            on update restrict on delete restrict,
+    add column exchange_rate numeric;
+
+alter table balance_reserve
+    add column exchange_rate_id int8
+        constraint balance_reserve_exchange_rate_id_fk
+            references exchange_rate (id)
+            on update restrict on delete restrict;